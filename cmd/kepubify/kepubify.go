@@ -38,8 +38,9 @@ func main() {
 	output := pflag.StringP("output", "o", "", "[>1 inputs || 1 file input with existing dir output]: Directory to place converted files/dirs under; [1 file input with nonexistent output]: Output filename; [1 dir input]: Output directory for contents of input (default: current directory)")
 	calibre := pflag.Bool("calibre", false, "Use .kepub instead of .kepub.epub as the output extension (for Calibre compatibility, only use if you know what you are doing)")
 	copy := pflag.StringSliceP("copy", "x", nil, "Copy files with the specified extension (with a leading period) to the output unchanged (no effect if the filename ends up the same)")
+	outputtemplate := pflag.String("output-template", "", "Template for the paths of converted files under the output directory, using metadata from the book (e.g. {author}/{title}.kepub.epub) (fields: {author}, {title}, {language}, {publisher}, {series}, {filename})")
 
-	for _, flag := range []string{"update", "inplace", "no-preserve-dirs", "output", "calibre", "copy"} {
+	for _, flag := range []string{"update", "inplace", "no-preserve-dirs", "output", "calibre", "copy", "output-template"} {
 		pflag.CommandLine.SetAnnotation(flag, "category", []string{"2.Output Options"})
 	}
 
@@ -52,8 +53,9 @@ func main() {
 	noadddummytitlepage := pflag.Bool("no-add-dummy-titlepage", false, "Force-disables the dummy titlepage")
 	replace := pflag.StringArrayP("replace", "r", nil, "Find and replace on all html files (repeat any number of times) (format: find|replace)")
 	charset := pflag.String("charset", "utf-8", "Override the HTML charset (use \"auto\" to detect it from the content)")
+	maximagesize := pflag.String("max-image-size", "", "Downscale JPEG and PNG images to fit within the specified size (format: WIDTHxHEIGHT) or the screen of the specified Kobo model (e.g. clara-hd, libra-2, forma)")
 
-	for _, flag := range []string{"smarten-punctuation", "css", "hyphenate", "no-hyphenate", "fullscreen-reading-fixes", "add-dummy-titlepage", "no-add-dummy-titlepage", "replace", "charset"} {
+	for _, flag := range []string{"smarten-punctuation", "css", "hyphenate", "no-hyphenate", "fullscreen-reading-fixes", "add-dummy-titlepage", "no-add-dummy-titlepage", "replace", "charset", "max-image-size"} {
 		pflag.CommandLine.SetAnnotation(flag, "category", []string{"3.Conversion Options"})
 	}
 
@@ -118,6 +120,17 @@ func main() {
 		opts = append(opts, kepub.ConverterOptionFindReplace(spl[0], spl[1]))
 	}
 	opts = append(opts, kepub.ConverterOptionCharset(*charset))
+	if *maximagesize != "" {
+		w, h, ok := kepub.KoboScreenSize(*maximagesize)
+		if !ok {
+			if n, err := fmt.Sscanf(strings.ToLower(*maximagesize), "%dx%d", &w, &h); err != nil || n != 2 || w <= 0 || h <= 0 {
+				fmt.Fprintf(os.Stderr, "Error: Parse max image size %#v: must be in format WIDTHxHEIGHT or one of %s\n", *maximagesize, strings.Join(kepub.KoboScreenSizeModels(), ", "))
+				exit(1)
+				return
+			}
+		}
+		opts = append(opts, kepub.ConverterOptionMaxImageSize(w, h))
+	}
 	converter := kepub.NewConverterWithOptions(opts...)
 
 	// --- Transform paths --- //
@@ -127,7 +140,7 @@ func main() {
 		ext = ".kepub"
 	}
 
-	pathMap, skipList, err := transformer{
+	pathTransformer := transformer{
 		NoPreserveDirs:   *nopreservedirs,
 		Update:           *update,
 		Inplace:          *inplace,
@@ -135,7 +148,23 @@ func main() {
 		ExcludeSuffixes:  []string{".kepub.epub"},
 		PreserveSuffixes: *copy,
 		TargetSuffix:     ext,
-	}.TransformPaths(*output, pflag.Args()...)
+	}
+
+	var pathMap map[string]string
+	var skipList []string
+	var err error
+	if *outputtemplate == "" {
+		pathMap, skipList, err = pathTransformer.TransformPaths(*output, pflag.Args()...)
+	} else {
+		// existing files can only be skipped once the templated paths are known
+		update := pathTransformer.Update
+		pathTransformer.Update = false
+		pathMap, _, err = pathTransformer.TransformPaths(*output, pflag.Args()...)
+		pathTransformer.Update = update
+		if err == nil {
+			pathMap, skipList, err = pathTransformer.TemplatePaths(*outputtemplate, *output, pathMap)
+		}
+	}
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
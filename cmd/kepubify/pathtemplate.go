@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+)
+
+// pathTemplateFields are the fields which can be used in output path
+// templates (e.g., {author}/{title}.kepub.epub).
+var pathTemplateFields = []string{"author", "title", "language", "publisher", "series", "filename"}
+
+// TemplatePaths replaces the output paths of the converted files in pathMap
+// (as returned by TransformPaths) with the expanded template tmpl, relative to
+// output (or the current directory if not specified). Metadata fields are read
+// from the input books. The target suffix is added if the expanded template
+// doesn't already end with it. Preserved files are left as-is. If update is
+// set, inputs where the templated output already exists are skipped.
+func (t transformer) TemplatePaths(tmpl, output string, pathMap map[string]string) (map[string]string, []string, error) {
+	if err := checkPathTemplate(tmpl); err != nil {
+		return nil, nil, err
+	}
+
+	newPathMap := map[string]string{}
+	for in, out := range pathMap {
+		if hasSuffixFold(out, t.TargetSuffix) {
+			md, err := readPathMetadataFile(in)
+			if err != nil {
+				return nil, nil, fmt.Errorf("read metadata for %#v: %w", in, err)
+			}
+			md["filename"] = filepath.Base(in)
+			for _, suffix := range t.Suffixes {
+				if hasSuffixFold(md["filename"], suffix) {
+					md["filename"] = md["filename"][:len(md["filename"])-len(suffix)]
+					break
+				}
+			}
+
+			rel, err := expandPathTemplate(tmpl, md)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !hasSuffixFold(rel, t.TargetSuffix) {
+				rel += t.TargetSuffix
+			}
+			out = filepath.Join(output, filepath.FromSlash(rel))
+		}
+		newPathMap[in] = out
+	}
+
+	var skipList []string
+	seen := map[string]string{}
+	for in, out := range newPathMap {
+		if t.Update {
+			if _, err := os.Stat(out); !os.IsNotExist(err) {
+				skipList = append(skipList, in)
+			}
+		}
+		if _, ok := seen[out]; ok {
+			return nil, nil, fmt.Errorf("overlapping output file %#v for %#v and %#v (add more fields to the output template)", out, seen[out], in)
+		}
+		seen[out] = in
+	}
+	for _, f := range skipList {
+		delete(newPathMap, f)
+	}
+
+	return newPathMap, skipList, nil
+}
+
+// checkPathTemplate checks if an output path template is valid.
+func checkPathTemplate(tmpl string) error {
+	md := map[string]string{}
+	for _, f := range pathTemplateFields {
+		md[f] = f
+	}
+	rel, err := expandPathTemplate(tmpl, md)
+	if err != nil {
+		return err
+	}
+	if path.IsAbs(rel) || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("parse output template %#v: must be a relative path within the output directory", tmpl)
+	}
+	return nil
+}
+
+// expandPathTemplate replaces the {field}s in tmpl with the values from md
+// (made safe for use as a single path component), and returns the cleaned
+// slash-separated path. Empty fields are replaced with "Unknown".
+func expandPathTemplate(tmpl string, md map[string]string) (string, error) {
+	var b strings.Builder
+	for s := tmpl; s != ""; {
+		i := strings.IndexByte(s, '{')
+		if i == -1 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+
+		j := strings.IndexByte(s, '}')
+		if j == -1 {
+			return "", fmt.Errorf("parse output template %#v: unterminated field", tmpl)
+		}
+		field := s[:j]
+		s = s[j+1:]
+
+		var known bool
+		for _, f := range pathTemplateFields {
+			if f == field {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return "", fmt.Errorf("parse output template %#v: unknown field {%s} (available fields: {%s})", tmpl, field, strings.Join(pathTemplateFields, "}, {"))
+		}
+
+		if v := sanitizePathComponent(md[field]); v != "" {
+			b.WriteString(v)
+		} else {
+			b.WriteString("Unknown")
+		}
+	}
+	return path.Clean(strings.ReplaceAll(b.String(), "\\", "/")), nil
+}
+
+// sanitizePathComponent replaces characters which aren't allowed in filenames
+// on common filesystems (including path separators) with underscores,
+// collapses whitespace, and trims leading and trailing spaces and dots.
+func sanitizePathComponent(s string) string {
+	var b strings.Builder
+	var space bool
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case r < ' ' || r == 0x7F:
+			continue
+		}
+		if space && b.Len() != 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strings.Trim(b.String(), " .")
+}
+
+// readPathMetadataFile reads the metadata fields for output path templates
+// from an epub file.
+func readPathMetadataFile(filename string) (map[string]string, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open ebook: %w", err)
+	}
+	defer zr.Close()
+	return readPathMetadata(zr)
+}
+
+// readPathMetadata reads the metadata fields for output path templates from an
+// unpacked epub.
+func readPathMetadata(epub fs.FS) (map[string]string, error) {
+	rootfile, err := func() (string, error) {
+		rc, err := epub.Open("META-INF/container.xml")
+		if err != nil {
+			return "", fmt.Errorf("could not open container.xml: %w", err)
+		}
+		defer rc.Close()
+
+		doc := etree.NewDocument()
+		if _, err := doc.ReadFrom(rc); err != nil {
+			return "", fmt.Errorf("could not parse container.xml: %w", err)
+		}
+		if el := doc.FindElement("//rootfiles/rootfile[@full-path]"); el != nil {
+			return strings.TrimLeft(el.SelectAttrValue("full-path", ""), "/"), nil
+		}
+		return "", errors.New("could not find package document")
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := epub.Open(rootfile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open package document: %w", err)
+	}
+	defer rc.Close()
+
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(rc); err != nil {
+		return nil, fmt.Errorf("could not parse package document: %w", err)
+	}
+
+	md := map[string]string{}
+	for _, el := range doc.FindElements("//metadata/creator") {
+		if v := strings.TrimSpace(el.Text()); v != "" {
+			// prefer the first author, but fall back to the first creator
+			if role := el.SelectAttrValue("role", "aut"); role == "aut" {
+				md["author"] = v
+				break
+			} else if md["author"] == "" {
+				md["author"] = v
+			}
+		}
+	}
+	for _, field := range []string{"title", "language", "publisher"} {
+		if el := doc.FindElement("//metadata/" + field); el != nil {
+			md[field] = strings.TrimSpace(el.Text())
+		}
+	}
+	if el := doc.FindElement("//meta[@name='calibre:series']"); el != nil {
+		md["series"] = strings.TrimSpace(el.SelectAttrValue("content", ""))
+	} else if el := doc.FindElement("//meta[@property='belongs-to-collection']"); el != nil {
+		md["series"] = strings.TrimSpace(el.Text())
+	}
+	return md, nil
+}
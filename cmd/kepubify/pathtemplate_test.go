@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+const testPathTemplateContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`
+
+const testPathTemplatePackage = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:opf="http://www.idpf.org/2007/opf" version="2.0">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+		<dc:title>  The Book: A Story?  </dc:title>
+		<dc:creator opf:role="edt">Some Editor</dc:creator>
+		<dc:creator opf:role="aut">Some Author</dc:creator>
+		<dc:language>en</dc:language>
+		<meta name="calibre:series" content="Some Series"/>
+	</metadata>
+	<manifest/>
+	<spine/>
+</package>`
+
+func TestReadPathMetadata(t *testing.T) {
+	md, err := readPathMetadata(fstest.MapFS{
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(testPathTemplateContainer)},
+		"OEBPS/content.opf":      &fstest.MapFile{Data: []byte(testPathTemplatePackage)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := map[string]string{
+		"author":   "Some Author",
+		"title":    "The Book: A Story?",
+		"language": "en",
+		"series":   "Some Series",
+	}; !reflect.DeepEqual(md, exp) {
+		t.Errorf("expected %#v, got %#v", exp, md)
+	}
+
+	if _, err := readPathMetadata(fstest.MapFS{
+		"OEBPS/content.opf": &fstest.MapFile{Data: []byte(testPathTemplatePackage)},
+	}); err == nil {
+		t.Errorf("expected error for missing container.xml")
+	}
+}
+
+func TestExpandPathTemplate(t *testing.T) {
+	md := map[string]string{
+		"author":   "Some Author",
+		"title":    "The Book: A Story?",
+		"language": "en",
+		"series":   "../Some/Series",
+	}
+	for _, c := range []struct {
+		Template string
+		Output   string
+		Error    bool
+	}{
+		{"{author}/{title}.kepub.epub", "Some Author/The Book_ A Story_.kepub.epub", false},
+		{"{language}/{author} - {title}", "en/Some Author - The Book_ A Story_", false},
+		{"{series}/{title}", "_Some_Series/The Book_ A Story_", false},
+		{"{publisher}/{title}", "Unknown/The Book_ A Story_", false},
+		{"./books//{author}/", "books/Some Author", false},
+		{"{isbn}/{title}", "", true},
+		{"{author/{title}", "", true},
+		{"{author", "", true},
+	} {
+		out, err := expandPathTemplate(c.Template, md)
+		if c.Error {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q", c.Template, out)
+			}
+		} else if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.Template, err)
+		} else if out != c.Output {
+			t.Errorf("%q: expected %q, got %q", c.Template, c.Output, out)
+		}
+	}
+}
+
+func TestTemplatePaths(t *testing.T) {
+	td := t.TempDir()
+
+	book := filepath.Join(td, "book.epub")
+	if err := func() error {
+		f, err := os.Create(book)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		zw := zip.NewWriter(f)
+		for _, x := range [][2]string{
+			{"mimetype", "application/epub+zip"},
+			{"META-INF/container.xml", testPathTemplateContainer},
+			{"OEBPS/content.opf", testPathTemplatePackage},
+		} {
+			w, err := zw.Create(x[0])
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte(x[1])); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return f.Close()
+	}(); err != nil {
+		t.Fatalf("create test epub: %v", err)
+	}
+
+	tr := transformer{
+		Suffixes:        []string{".epub"},
+		ExcludeSuffixes: []string{".kepub.epub"},
+		TargetSuffix:    ".kepub.epub",
+	}
+
+	for _, c := range []struct {
+		Template string
+		Output   string
+	}{
+		{"{author}/{title}.kepub.epub", "out/Some Author/The Book_ A Story_.kepub.epub"},
+		{"{author}/{filename}", "out/Some Author/book.kepub.epub"},
+	} {
+		pathMap, skipList, err := tr.TemplatePaths(c.Template, "out", map[string]string{book: "book_converted.kepub.epub"})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.Template, err)
+			continue
+		}
+		if len(skipList) != 0 {
+			t.Errorf("%q: unexpected skipped files %#v", c.Template, skipList)
+		}
+		if out := filepath.ToSlash(pathMap[book]); out != c.Output {
+			t.Errorf("%q: expected %q, got %q", c.Template, c.Output, out)
+		}
+	}
+
+	if _, _, err := tr.TemplatePaths("../{title}", "out", map[string]string{book: "book_converted.kepub.epub"}); err == nil {
+		t.Errorf("expected error for template outside output dir")
+	}
+}
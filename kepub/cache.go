@@ -0,0 +1,62 @@
+package kepub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// contentCache caches transformed content documents by the SHA-256 hash of the
+// input. It is safe for concurrent use.
+type contentCache struct {
+	mu      sync.Mutex
+	max     int64 // zero for unbounded
+	size    int64
+	entries map[[sha256.Size]byte][]byte
+}
+
+// transform writes the cached output for r to w, or calls fn and caches its
+// output if r hasn't been seen before with the same variant (e.g., the book
+// language, which fn's output also depends on). If fn returns an error,
+// nothing is written to w.
+func (cc *contentCache) transform(w io.Writer, r io.Reader, variant string, fn func(w io.Writer, r io.Reader) error) error {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read content: %w", err)
+	}
+	h := sha256.New()
+	h.Write([]byte(variant))
+	h.Write([]byte{0})
+	h.Write(in)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	cc.mu.Lock()
+	out, ok := cc.entries[key]
+	cc.mu.Unlock()
+
+	if !ok {
+		buf := bytes.NewBuffer(nil)
+		if err := fn(buf, bytes.NewReader(in)); err != nil {
+			return err
+		}
+		out = buf.Bytes()
+
+		cc.mu.Lock()
+		if _, exists := cc.entries[key]; !exists && (cc.max <= 0 || cc.size+int64(len(out)) <= cc.max) {
+			if cc.entries == nil {
+				cc.entries = map[[sha256.Size]byte][]byte{}
+			}
+			cc.entries[key] = out
+			cc.size += int64(len(out))
+		}
+		cc.mu.Unlock()
+	}
+
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("write content: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package kepub
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestContentCache(t *testing.T) {
+	t.Run("Converter", func(t *testing.T) {
+		c := NewConverterWithOptions(ConverterOptionSmartypants(), ConverterOptionContentCache(0))
+		doc := `<!DOCTYPE html><html><head><title></title></head><body><p>"Chapter." Text.</p></body></html>`
+
+		var out [3]bytes.Buffer
+		for i, in := range []string{doc, doc, strings.Replace(doc, "Text", "Other", 1)} {
+			if err := c.TransformContent(&out[i], strings.NewReader(in)); err != nil {
+				t.Fatalf("transform %d: unexpected error: %v", i, err)
+			}
+		}
+		if out[0].String() != out[1].String() {
+			t.Errorf("expected cached output to be identical:\n%s\n%s", out[0].String(), out[1].String())
+		}
+		if out[0].String() == out[2].String() {
+			t.Errorf("expected different output for a different document")
+		}
+		if n := len(c.contentCache.entries); n != 2 {
+			t.Errorf("expected 2 cached documents, got %d", n)
+		}
+
+		var traced int
+		c = NewConverterWithOptions(ConverterOptionContentCache(0), ConverterOptionTraceSpans(func(string, ...interface{}) {
+			traced++
+		}))
+		for i := 0; i < 2; i++ {
+			n := traced
+			if err := c.TransformContent(io.Discard, strings.NewReader(doc)); err != nil {
+				t.Fatalf("transform %d: unexpected error: %v", i, err)
+			}
+			if traced == n {
+				t.Errorf("transform %d: expected spans to be traced even if the document was already transformed", i)
+			}
+		}
+
+		ref := bytes.NewBuffer(nil)
+		if err := NewConverterWithOptions(ConverterOptionSmartypants()).TransformContent(ref, strings.NewReader(doc)); err != nil {
+			t.Fatalf("transform: unexpected error: %v", err)
+		}
+		if ref.String() != out[0].String() {
+			t.Errorf("expected output to match the uncached converter:\n%s\n%s", ref.String(), out[0].String())
+		}
+	})
+
+	t.Run("Transform", func(t *testing.T) {
+		var calls int
+		fn := func(w io.Writer, r io.Reader) error {
+			calls++
+			buf, _ := io.ReadAll(r)
+			if string(buf) == "error" {
+				return errors.New("test error")
+			}
+			_, err := w.Write(bytes.ToUpper(buf))
+			return err
+		}
+
+		cc := &contentCache{max: 8}
+		for _, x := range []struct {
+			In    string
+			Out   string
+			Calls int
+		}{
+			{"abcd", "ABCD", 1},
+			{"abcd", "ABCD", 1}, // hit
+			{"efgh", "EFGH", 2},
+			{"efgh", "EFGH", 2}, // hit
+			{"ijkl", "IJKL", 3}, // over max size, not cached
+			{"ijkl", "IJKL", 4},
+			{"error", "", 5},
+			{"error", "", 6}, // errors aren't cached
+		} {
+			buf := bytes.NewBuffer(nil)
+			if err := cc.transform(buf, strings.NewReader(x.In), "", fn); (err != nil) != (x.Out == "") {
+				t.Errorf("%q: unexpected error: %v", x.In, err)
+			}
+			if buf.String() != x.Out {
+				t.Errorf("%q: expected output %q, got %q", x.In, x.Out, buf.String())
+			}
+			if calls != x.Calls {
+				t.Errorf("%q: expected %d calls to transform, got %d", x.In, x.Calls, calls)
+			}
+		}
+	})
+}
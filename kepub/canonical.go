@@ -0,0 +1,107 @@
+package kepub
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// Canonicalize parses and re-renders an HTML/XHTML document in a canonical form
+// for comparing transformed documents (e.g., against golden files in tests).
+// Attributes are sorted, runs of whitespace in text are collapsed to a single
+// space, and whitespace-only text between block-level elements is removed.
+// The contents of pre, textarea, script, and style elements (and elements with
+// xml:space="preserve") are left as-is.
+// Two documents which only differ in those ways will have identical output.
+// The output is not intended to be used in a book.
+func Canonicalize(w io.Writer, r io.Reader) error {
+	doc, err := html.ParseWithOptions(r,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return fmt.Errorf("parse html: %w", err)
+	}
+
+	canonicalize(doc)
+
+	if err := html.RenderWithOptions(w, doc,
+		html.RenderOptionAllowXMLDeclarations(true),
+		html.RenderOptionPolyglot(true)); err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+	return nil
+}
+
+func canonicalize(n *html.Node) {
+	if n.Type == html.ElementNode {
+		sort.SliceStable(n.Attr, func(i, j int) bool {
+			if n.Attr[i].Namespace != n.Attr[j].Namespace {
+				return n.Attr[i].Namespace < n.Attr[j].Namespace
+			}
+			return n.Attr[i].Key < n.Attr[j].Key
+		})
+		switch n.DataAtom {
+		case atom.Pre, atom.Textarea, atom.Script, atom.Style:
+			return
+		}
+		if preservesSpace(n) {
+			return
+		}
+	}
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.TextNode {
+			if isSpace(c.Data) && !isPhrasing(c.PrevSibling) && !isPhrasing(c.NextSibling) {
+				n.RemoveChild(c)
+			} else {
+				c.Data = collapseSpace(c.Data)
+			}
+		} else {
+			canonicalize(c)
+		}
+		c = next
+	}
+}
+
+// isPhrasing checks if n is text or an element which is usually rendered
+// inline, where surrounding whitespace is significant. Unknown elements are
+// assumed to be inline.
+func isPhrasing(n *html.Node) bool {
+	if n == nil {
+		return false
+	}
+	switch n.Type {
+	case html.TextNode:
+		return true
+	case html.ElementNode:
+		switch n.DataAtom {
+		case 0, atom.A, atom.Abbr, atom.B, atom.Bdi, atom.Bdo, atom.Br, atom.Cite, atom.Code, atom.Data, atom.Dfn, atom.Em, atom.I, atom.Img, atom.Kbd, atom.Mark, atom.Math, atom.Q, atom.Rp, atom.Rt, atom.Ruby, atom.S, atom.Samp, atom.Small, atom.Span, atom.Strong, atom.Sub, atom.Sup, atom.Svg, atom.Time, atom.U, atom.Var, atom.Wbr:
+			return true
+		}
+	}
+	return false
+}
+
+// collapseSpace replaces runs of whitespace with a single space.
+func collapseSpace(s string) string {
+	var b strings.Builder
+	var space bool
+	for _, r := range s {
+		switch r {
+		case ' ', '\t', '\n', '\r', '\f':
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+		default:
+			b.WriteRune(r)
+			space = false
+		}
+	}
+	return b.String()
+}
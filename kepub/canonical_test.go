@@ -0,0 +1,49 @@
+package kepub
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	canonical := func(doc string) string {
+		buf := bytes.NewBuffer(nil)
+		if err := Canonicalize(buf, strings.NewReader(doc)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return buf.String()
+	}
+
+	a := canonical(`<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" lang="en">
+	<head>
+		<title>Test</title>
+		<link rel="stylesheet" type="text/css" href="style.css"/>
+	</head>
+	<body>
+		<div class="chapter" id="ch1">
+			<p class="first" id="p1">Some   <b>bold</b>
+				text.</p>
+			<pre>  keep
+  this  </pre>
+		</div>
+	</body>
+</html>`)
+
+	b := canonical(`<!DOCTYPE html><html lang="en" xmlns="http://www.w3.org/1999/xhtml"><head><title>Test</title><link href="style.css" rel="stylesheet" type="text/css"></head><body><div id="ch1" class="chapter"><p id="p1" class="first">Some <b>bold</b> text.</p><pre>  keep
+  this  </pre></div></body></html>`)
+
+	if a != b {
+		t.Errorf("expected equivalent documents to be canonicalized identically:\n%s\n%s", a, b)
+	}
+
+	for _, doc := range []string{
+		`<!DOCTYPE html><html><head><title>Test</title></head><body><p>Some <b>bold</b>text.</p></body></html>`,
+		`<!DOCTYPE html><html><head><title>Test</title></head><body><p>Some <b>bold</b> text.</p><pre>keep this</pre></body></html>`,
+	} {
+		if c := canonical(doc); c == a {
+			t.Errorf("expected different document to be canonicalized differently: %s", c)
+		}
+	}
+}
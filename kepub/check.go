@@ -0,0 +1,209 @@
+package kepub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// checkMaxContentSize is the size above which content documents are reported
+// as being too large. Large documents are slow to paginate on Kobo devices,
+// and very large ones may fail to open at all.
+const checkMaxContentSize = 1 << 20
+
+// Issue is a potential Kobo compatibility problem found by CheckKoboCompat.
+type Issue struct {
+	File    string // the file the issue applies to, if any
+	Message string
+}
+
+func (i Issue) String() string {
+	if i.File == "" {
+		return i.Message
+	}
+	return i.File + ": " + i.Message
+}
+
+// CheckKoboCompat checks the EPUB (or KEPUB) root epub for common problems
+// which affect Kobo eReaders, for example a cover without the cover-image
+// property, content documents without koboSpans, oversized content documents,
+// malformed markup (with the number of repairs the parser needs to make), and
+// remote resources. It can be used before conversion to see what will be
+// fixed, or afterwards to check the output. An error is only returned if the
+// book can't be read.
+func CheckKoboCompat(epub fs.FS) ([]Issue, error) {
+	var issues []Issue
+
+	opf, err := epubPackage(epub)
+	if err != nil {
+		return nil, fmt.Errorf("check kobo compatibility: %w", err)
+	}
+
+	pkg, err := checkKoboCompatOPF(epub, opf)
+	if err != nil {
+		return nil, fmt.Errorf("check kobo compatibility: %w", err)
+	}
+	issues = append(issues, pkg...)
+
+	cd, err := epubContentDocuments(epub, opf)
+	if err != nil {
+		return nil, fmt.Errorf("check kobo compatibility: %w", err)
+	}
+	for _, fn := range cd {
+		doc, err := checkKoboCompatContent(epub, fn)
+		if err != nil {
+			return nil, fmt.Errorf("check kobo compatibility: %w", err)
+		}
+		issues = append(issues, doc...)
+	}
+
+	return issues, nil
+}
+
+func checkKoboCompatOPF(epub fs.FS, opf string) ([]Issue, error) {
+	var issues []Issue
+
+	f, err := epub.Open(opf)
+	if err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(f); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	var hasCoverImage bool
+	for _, el := range doc.FindElements("//manifest/item") {
+		if includes(el.SelectAttrValue("properties", ""), "cover-image") {
+			hasCoverImage = true
+		}
+		if href := el.SelectAttrValue("href", ""); isRemoteURL(href) {
+			issues = append(issues, Issue{opf, fmt.Sprintf("manifest item %q is a remote resource", href)})
+		}
+	}
+	if !hasCoverImage {
+		if el := opfCoverItem(doc); el != nil {
+			issues = append(issues, Issue{opf, fmt.Sprintf("cover image %q is missing the cover-image property", el.SelectAttrValue("href", ""))})
+		} else {
+			issues = append(issues, Issue{opf, "no cover image"})
+		}
+	}
+
+	return issues, nil
+}
+
+func checkKoboCompatContent(epub fs.FS, fn string) ([]Issue, error) {
+	var issues []Issue
+
+	fi, err := fs.Stat(epub, fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Issue{{fn, "content document is missing"}}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("check %q: %w", fn, err)
+	}
+	if fi.Size() > checkMaxContentSize {
+		issues = append(issues, Issue{fn, fmt.Sprintf("content document is too large (%d KiB)", fi.Size()/1024)})
+	}
+
+	buf, err := fs.ReadFile(epub, fn)
+	if err != nil {
+		return nil, fmt.Errorf("check %q: %w", fn, err)
+	}
+
+	if n, err := markupRepairs(bytes.NewReader(buf)); err != nil {
+		return nil, fmt.Errorf("check %q: %w", fn, err)
+	} else if n != 0 {
+		issues = append(issues, Issue{fn, fmt.Sprintf("malformed markup needed %d repairs (unclosed or mismatched tags)", n)})
+	}
+
+	doc, err := html.ParseWithOptions(bytes.NewReader(buf),
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return nil, fmt.Errorf("check %q: parse html: %w", fn, err)
+	}
+
+	if findClass(doc, "koboSpan") == nil {
+		issues = append(issues, Issue{fn, "no koboSpans"})
+	}
+
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode && cur.Data != "a" {
+			for _, a := range cur.Attr {
+				switch a.Key {
+				case "src", "href", "poster", "data":
+					if isRemoteURL(a.Val) {
+						issues = append(issues, Issue{fn, fmt.Sprintf("<%s> references remote resource %q", cur.Data, a.Val)})
+					}
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+
+	return issues, nil
+}
+
+// markupRepairs counts the repairs the HTML parser needs to make to the tags
+// in a content document, i.e., elements which aren't closed and end tags which
+// don't match an open element. Since content documents should be XHTML, this
+// includes omitted optional end tags.
+func markupRepairs(r io.Reader) (int, error) {
+	var n int
+	var stack []string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return 0, fmt.Errorf("tokenize html: %w", err)
+			}
+			return n + len(stack), nil
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			switch a := atom.Lookup(name); a {
+			case atom.Area, atom.Base, atom.Br, atom.Col, atom.Embed, atom.Hr, atom.Img, atom.Input, atom.Keygen, atom.Link, atom.Meta, atom.Param, atom.Source, atom.Track, atom.Wbr:
+				// void element
+			default:
+				stack = append(stack, string(name))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			i := len(stack) - 1
+			for i >= 0 && stack[i] != string(name) {
+				i--
+			}
+			if i < 0 {
+				n++ // no matching start tag
+			} else {
+				n += len(stack) - 1 - i // unclosed elements
+				stack = stack[:i]
+			}
+		}
+	}
+}
+
+// isRemoteURL checks if a URL references a resource outside the EPUB.
+func isRemoteURL(s string) bool {
+	u, err := url.Parse(strings.TrimSpace(s))
+	return err == nil && u.Host != ""
+}
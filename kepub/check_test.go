@@ -0,0 +1,131 @@
+package kepub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+)
+
+func TestCheckKoboCompat(t *testing.T) {
+	hasIssue := func(issues []Issue, file, msg string) bool {
+		for _, is := range issues {
+			if is.File == file && strings.Contains(is.Message, msg) {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("Unconverted", func(t *testing.T) {
+		issues, err := CheckKoboCompat(testEPUB)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, exp := range [][2]string{
+			{"OEBPS/content.opf", `cover image "cover.png" is missing the cover-image property`},
+			{"OEBPS/xhtml/ch01.xhtml", "no koboSpans"},
+			{"OEBPS/xhtml/ch99.xhtml", "no koboSpans"},
+		} {
+			if !hasIssue(issues, exp[0], exp[1]) {
+				t.Errorf("expected issue %q for %q, got %v", exp[1], exp[0], issues)
+			}
+		}
+	})
+
+	t.Run("Converted", func(t *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		if err := NewConverter().Convert(context.Background(), buf, testEPUB); err != nil {
+			t.Fatalf("convert: unexpected error: %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("read kepub: unexpected error: %v", err)
+		}
+		issues, err := CheckKoboCompat(zr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, is := range issues {
+			if is.File != "OEBPS/xhtml/title.xhtml" { // has no text to add spans to
+				t.Errorf("unexpected issue: %s", is)
+			}
+		}
+	})
+
+	t.Run("Problems", func(t *testing.T) {
+		issues, err := CheckKoboCompat(overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="xhtml_ch01" href="xhtml/ch01.xhtml" media-type="application/xhtml+xml"/>
+		<item id="xhtml_ch02" href="xhtml/ch02.xhtml" media-type="application/xhtml+xml"/>
+		<item id="xhtml_ch03" href="xhtml/ch03.xhtml" media-type="application/xhtml+xml"/>
+		<item id="xhtml_missing" href="xhtml/missing.xhtml" media-type="application/xhtml+xml"/>
+		<item id="font" href="https://example.com/font.otf" media-type="font/otf"/>
+	</manifest>
+	<spine>
+		<itemref idref="xhtml_ch01"/>
+		<itemref idref="xhtml_ch02"/>
+		<itemref idref="xhtml_ch03"/>
+		<itemref idref="xhtml_missing"/>
+	</spine>
+</package>`),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title></title><link rel="stylesheet" href="//example.com/style.css"/></head><body><p><span class="koboSpan" id="kobo.1.1">Test. <a href="https://example.com">Link.</a></span></p><img src="https://example.com/image.png"/></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title></title></head><body><p><span class="koboSpan" id="kobo.1.1">` + strings.Repeat("Test. ", checkMaxContentSize/5) + `</span></p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch02.xhtml"].Mode,
+			},
+			"OEBPS/xhtml/ch03.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title></title></head><body><p><span class="koboSpan" id="kobo.1.1">Test <b>bold <i>both</b> text.</i></span></div><p>Unclosed.</body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch03.xhtml"].Mode,
+			},
+		}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, exp := range [][2]string{
+			{"OEBPS/content.opf", `manifest item "https://example.com/font.otf" is a remote resource`},
+			{"OEBPS/content.opf", "no cover image"},
+			{"OEBPS/xhtml/ch01.xhtml", `<link> references remote resource "//example.com/style.css"`},
+			{"OEBPS/xhtml/ch01.xhtml", `<img> references remote resource "https://example.com/image.png"`},
+			{"OEBPS/xhtml/ch02.xhtml", "content document is too large"},
+			{"OEBPS/xhtml/ch03.xhtml", "malformed markup needed 5 repairs"},
+			{"OEBPS/xhtml/missing.xhtml", "content document is missing"},
+		} {
+			if !hasIssue(issues, exp[0], exp[1]) {
+				t.Errorf("expected issue %q for %q, got %v", exp[1], exp[0], issues)
+			}
+		}
+		if n := len(issues); n != 7 {
+			t.Errorf("expected 7 issues, got %d: %v", n, issues)
+		}
+	})
+}
+
+func TestMarkupRepairs(t *testing.T) {
+	for _, c := range []struct {
+		In      string
+		Repairs int
+	}{
+		{`<!DOCTYPE html><html><head><title></title><meta charset="utf-8"/></head><body><p>Text<br/><img src="a.png"></p><svg><path d="M0 0"/></svg><script>if (a<b) {}</script></body></html>`, 0},
+		{`<html><body><p>One<p>Two</body></html>`, 2},
+		{`<html><body><p><b>One <i>two</b></i></p></body></html>`, 2},
+		{`<html><body><div>Text</span></div></body>`, 2},
+	} {
+		if n, err := markupRepairs(strings.NewReader(c.In)); err != nil {
+			t.Errorf("%q: unexpected error: %v", c.In, err)
+		} else if n != c.Repairs {
+			t.Errorf("%q: expected %d repairs, got %d", c.In, c.Repairs, n)
+		}
+	}
+}
@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"io/fs"
 	"math"
+	"net/url"
 	"path"
 	"runtime"
 	"strings"
 	"sync"
 
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
 	"github.com/pgaskin/kepubify/v4/internal/zip"
 	"golang.org/x/sync/errgroup"
 )
@@ -32,6 +36,10 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		FileActionIgnore           = 1
 		FileActionTransformContent = 2
 		FileActionTransformOPF     = 3
+		FileActionTransformNCX     = 4
+		FileActionTransformNav     = 5
+		FileActionTransformImage   = 6
+		FileActionTransformCSS     = 7
 	)
 
 	p := ctxProgress(ctx)
@@ -96,16 +104,46 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		return fmt.Errorf("read source EPUB: %w", err)
 	}
 
+	if c.language == "" {
+		lang, err := epubLanguage(r, opf)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if lang != "" {
+			c1 := *c
+			c1.language = lang
+			c = &c1
+		}
+	}
+
 	cd, err := epubContentDocuments(r, opf)
 	if err != nil {
 		return fmt.Errorf("read source EPUB: %w", err)
 	}
 
+	// check for DRM
+	if enc, err := epubEncryptedFiles(r); err != nil {
+		return fmt.Errorf("read source EPUB: %w", err)
+	} else if len(enc) != 0 {
+		e := &EncryptedError{}
+		for _, fn := range cd {
+			if enc[fn] {
+				e.Files = append(e.Files, fn)
+			}
+		}
+		if len(e.Files) != 0 {
+			return fmt.Errorf("read source EPUB: %w", e)
+		}
+	}
+
 	// mark the opf to be transformed
 	fileAct[fileIdx[opf]] = FileActionTransformOPF
 
 	// mark the content files to be transformed
 	for _, fn := range cd {
+		if c.metadataOnly {
+			break
+		}
 		if i, ok := fileIdx[fn]; ok {
 			fileAct[i] = FileActionTransformContent
 		} else {
@@ -137,6 +175,190 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		}
 	}
 
+	// mark the blocked resources to be removed
+	removed := map[string]bool{}
+	if len(c.blockMediaTypes) != 0 {
+		bl, err := epubManifestFiles(r, opf, c.isBlockedMediaType)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		for _, fn := range bl {
+			if i, ok := fileIdx[fn]; ok && i != fileIdx[opf] {
+				fileAct[i] = FileActionIgnore
+				removed[fn] = true
+			}
+		}
+	}
+
+	// mark the NCX to be updated if anything it might point to was removed
+	if len(removed) != 0 {
+		ncx, err := epubNCX(r, opf)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if i, ok := fileIdx[ncx]; ok && fileAct[i] == FileActionCopy {
+			fileAct[i] = FileActionTransformNCX
+		}
+	}
+
+	// mark the nav to be updated with a page list if there are page breaks
+	var pages []pageListEntry
+	if c.pageList && !c.metadataOnly {
+		nav, err := epubNav(r, opf)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if i, ok := fileIdx[nav]; ok && fileAct[i] == FileActionTransformContent {
+			if pages, err = epubPageBreaks(r, opf, nav, cd); err != nil {
+				return fmt.Errorf("read source EPUB: %w", err)
+			}
+			if len(pages) != 0 {
+				fileAct[i] = FileActionTransformNav
+			}
+		}
+	}
+
+	// mark the images to be downscaled
+	if c.maxImageSize != (image.Point{}) && !c.metadataOnly {
+		imgs, err := epubManifestFiles(r, opf, func(mediaType string) bool {
+			return mediaType == "image/jpeg" || mediaType == "image/png"
+		})
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		for _, fn := range imgs {
+			if i, ok := fileIdx[fn]; ok && fileAct[i] == FileActionCopy {
+				fileAct[i] = FileActionTransformImage
+			}
+		}
+	}
+
+	// mark the stylesheets to have their imports resolved
+	if c.cssImports && !c.metadataOnly {
+		css, err := epubManifestFiles(r, opf, func(mediaType string) bool {
+			return mediaType == "text/css"
+		})
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		for _, fn := range css {
+			if i, ok := fileIdx[fn]; ok && fileAct[i] == FileActionCopy {
+				fileAct[i] = FileActionTransformCSS
+			}
+		}
+	}
+
+	// find the data URIs to extract from the content documents
+	var dataURIs []dataURIFile
+	if c.dataURIs && !c.metadataOnly {
+		var fns []string
+		for i, f := range files {
+			if fileAct[i] == FileActionTransformContent || fileAct[i] == FileActionTransformNav {
+				fns = append(fns, f.Name)
+			}
+		}
+		found, err := epubDataURIs(r, fns, c.dataURIMinSize)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		for _, f := range found {
+			if _, ok := fileIdx[f.Name]; !ok {
+				dataURIs = append(dataURIs, f)
+			}
+		}
+	}
+
+	// find the cover using the guide if it isn't otherwise specified
+	guideCover, err := epubGuideCover(r, opf)
+	if err != nil {
+		return fmt.Errorf("read source EPUB: %w", err)
+	}
+
+	// find the cover page for the full-bleed cover
+	var coverPage, coverImage string
+	if c.fullBleedCover && !c.metadataOnly {
+		if coverPage, err = epubGuideCoverPage(r, opf); err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if coverImage, err = epubCoverImage(r, opf); err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+	}
+
+	// generate a cover if there isn't one
+	var placeholderCover []byte
+	if c.placeholderCover && !c.metadataOnly {
+		if placeholderCover, err = epubPlaceholderCover(r, opf); err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if _, ok := fileIdx[path.Join(path.Dir(opf), placeholderCoverName)]; ok {
+			placeholderCover = nil
+		}
+	}
+
+	// find the ids in the content documents to check links against
+	var linkIDs map[string]map[string]bool
+	if (c.deadLinkLog != nil || c.removeDeadLinks) && !c.metadataOnly {
+		var fns []string
+		for i, f := range files {
+			if fileAct[i] == FileActionTransformContent || fileAct[i] == FileActionTransformNav {
+				fns = append(fns, f.Name)
+			}
+		}
+		if linkIDs, err = epubContentIDs(r, fns); err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+	}
+
+	// isDeadLink checks if a link in the content document fn points to a file
+	// which doesn't exist (or was removed), or an id which doesn't exist in a
+	// content document.
+	isDeadLink := func(fn, href string) bool {
+		u, err := url.Parse(href)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || (u.Path == "" && u.Fragment == "") {
+			return false
+		}
+		target := fn
+		if u.Path != "" {
+			target = path.Join(path.Dir(fn), u.Path)
+		}
+		if i, ok := fileIdx[target]; !ok || fileAct[i] == FileActionIgnore {
+			return true
+		}
+		if ids, ok := linkIDs[target]; ok && u.Fragment != "" && !ids[u.Fragment] {
+			return true
+		}
+		return false
+	}
+
+	// deadLink returns the function for checking and logging the dead links in
+	// the content document fn, or nil if dead links aren't being checked.
+	deadLink := func(fn string) func(href string) bool {
+		if linkIDs == nil {
+			return nil
+		}
+		return func(href string) bool {
+			if isDeadLink(fn, href) {
+				if c.deadLinkLog != nil {
+					c.deadLinkLog("dead link in %q: %q", fn, href)
+				}
+				return true
+			}
+			return false
+		}
+	}
+
+	// generate a nav from the NCX if there isn't one
+	var generatedNav []byte
+	if c.generateNav && !c.metadataOnly {
+		if generatedNav, err = epubGeneratedNav(r, opf, removed); err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if _, ok := fileIdx[path.Join(path.Dir(opf), generatedNavName)]; ok {
+			generatedNav = nil
+		}
+	}
+
 	// we'll manually create the mimetype file
 	if i, ok := fileIdx["mimetype"]; ok {
 		fileAct[i] = FileActionIgnore
@@ -159,6 +381,9 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		// significantly reduced by using a buffer pool rather than passing
 		// around new slices each time.
 		Bytes *bytes.Buffer
+		// New files created while transforming this one, to be written
+		// after it.
+		New []File
 	}
 
 	g, ctx := errgroup.WithContext(ctx)
@@ -187,9 +412,57 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 			}
 		}
 
+		// and the placeholder cover
+		if placeholderCover != nil {
+			fh := &zip.FileHeader{
+				Name:   path.Join(path.Dir(opf), placeholderCoverName),
+				Method: zip.Deflate,
+			}
+			fh.SetMode(0666)
+			buf := pool.Get().(*bytes.Buffer)
+			buf.Write(placeholderCover)
+			select {
+			case output <- File{Index: -1, Header: fh, Bytes: buf}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// and the generated nav
+		if generatedNav != nil {
+			fh := &zip.FileHeader{
+				Name:   path.Join(path.Dir(opf), generatedNavName),
+				Method: zip.Deflate,
+			}
+			fh.SetMode(0666)
+			buf := pool.Get().(*bytes.Buffer)
+			buf.Write(generatedNav)
+			select {
+			case output <- File{Index: -1, Header: fh, Bytes: buf}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// and the images extracted from data URIs
+		for _, f := range dataURIs {
+			fh := &zip.FileHeader{
+				Name:   f.Name,
+				Method: zip.Deflate,
+			}
+			fh.SetMode(0666)
+			buf := pool.Get().(*bytes.Buffer)
+			buf.Write(f.Data)
+			select {
+			case output <- File{Index: -1, Header: fh, Bytes: buf}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
 		// then queue the files to be transformed in parallel
 		for i := range files {
-			if fileAct[i] == FileActionTransformOPF || fileAct[i] == FileActionTransformContent {
+			if fileAct[i] == FileActionTransformOPF || fileAct[i] == FileActionTransformContent || fileAct[i] == FileActionTransformNCX || fileAct[i] == FileActionTransformNav || fileAct[i] == FileActionTransformImage || fileAct[i] == FileActionTransformCSS {
 				select {
 				case queue <- i:
 				case <-ctx.Done():
@@ -202,7 +475,11 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 	})
 
 	// start the transformation goroutines
-	for i := 0; i < runtime.NumCPU(); i++ {
+	workers := c.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	for i := 0; i < workers; i++ {
 		g.Go(func() error {
 			for i := range queue {
 				f := files[i]
@@ -213,11 +490,26 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 				}
 
 				buf := pool.Get().(*bytes.Buffer)
+				var extra []File
 
 				switch a := fileAct[i]; a {
 				case FileActionTransformOPF:
-					err = c.TransformOPF(buf, rc)
-					if err == nil {
+					add := opfAdditions{
+						GuideCover: guideCover,
+						DataURIs:   make([]dataURIFile, len(dataURIs)),
+					}
+					for i, f := range dataURIs {
+						add.DataURIs[i] = f
+						add.DataURIs[i].Name = relativePath(path.Dir(opf), f.Name)
+					}
+					if placeholderCover != nil {
+						add.PlaceholderCover = placeholderCoverName
+					}
+					if generatedNav != nil {
+						add.GeneratedNav = generatedNavName
+					}
+					err = c.transformOPF(buf, rc, add)
+					if err == nil && !c.metadataOnly {
 						if fn, r, a, err1 := c.TransformDummyTitlepage(r, opf, buf); err1 != nil {
 							err = err1
 						} else if a {
@@ -230,16 +522,46 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 									Method: zip.Deflate,
 								}
 								fh.SetMode(0666)
-								output <- File{
+								extra = append(extra, File{
 									Index:  -1,
 									Header: fh,
 									Bytes:  buf1,
-								}
+								})
 							}
 						}
 					}
 				case FileActionTransformContent:
-					err = c.TransformContent(buf, rc)
+					err = c.transformContentDocument(buf, rc, contentDocument{
+						Name:       f.Name,
+						CoverPage:  f.Name == coverPage,
+						CoverImage: coverImage,
+						DeadLink:   deadLink(f.Name),
+					})
+				case FileActionTransformNCX:
+					err = transformNCX(buf, rc, func(src string) bool {
+						return removed[path.Join(path.Dir(f.Name), src)]
+					})
+				case FileActionTransformNav:
+					// the nav is also a content document
+					buf1 := pool.Get().(*bytes.Buffer)
+					if err = transformNav(buf1, rc, pages); err == nil {
+						err = c.transformContentDocument(buf, buf1, contentDocument{
+							Name:     f.Name,
+							DeadLink: deadLink(f.Name),
+						})
+					}
+					buf1.Reset()
+					pool.Put(buf1)
+				case FileActionTransformImage:
+					var resized bool
+					if resized, err = transformImage(buf, rc, c.maxImageSize); err == nil && !resized {
+						// copy it as-is if it didn't need to be resized
+						buf.Reset()
+						pool.Put(buf)
+						buf = nil
+					}
+				case FileActionTransformCSS:
+					err = transformCSS(buf, rc, r, f.Name)
 				default:
 					panic(fmt.Sprintf("unexpected action %d in transformation goroutine", a))
 				}
@@ -247,13 +569,15 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 				rc.Close()
 
 				if err != nil {
-					buf.Reset()
-					pool.Put(buf)
+					if buf != nil {
+						buf.Reset()
+						pool.Put(buf)
+					}
 					return fmt.Errorf("transform %q: %w", f.Name, err)
 				}
 
 				select {
-				case output <- File{Index: i, Bytes: buf}:
+				case output <- File{Index: i, Bytes: buf, New: extra}:
 				case <-ctx.Done():
 					return ctx.Err()
 				}
@@ -275,16 +599,30 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		return fmt.Errorf("write mimetype: %w", err)
 	}
 
+	// the transformed files are written in order regardless of when they were
+	// finished so the output is deterministic
+	var transformed []int
+	for i := range files {
+		switch fileAct[i] {
+		case FileActionCopy, FileActionIgnore:
+		default:
+			transformed = append(transformed, i)
+		}
+	}
+	var nextTransformed int
+	pending := map[int]File{}
+
 	// write the files
 	var n int
-	for of := range output {
+	var write func(of File) error
+	write = func(of File) error {
 		if of.Index == -1 {
 			if err := zipReplace(zw, of.Header, of.Bytes); err != nil {
 				return fmt.Errorf("write new file %q to output EPUB: %w", of.Header.Name, err)
 			}
 			of.Bytes.Reset()
 			pool.Put(of.Bytes)
-			continue
+			return nil
 		}
 		f := files[of.Index]
 		switch b := of.Bytes; b {
@@ -309,6 +647,32 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 			n++
 			p(false, n, len(files))
 		}
+		for _, nf := range of.New {
+			if err := write(nf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for of := range output {
+		if of.Index == -1 || fileAct[of.Index] == FileActionCopy {
+			if err := write(of); err != nil {
+				return err
+			}
+			continue
+		}
+		pending[of.Index] = of
+		for nextTransformed < len(transformed) {
+			of, ok := pending[transformed[nextTransformed]]
+			if !ok {
+				break
+			}
+			delete(pending, of.Index)
+			nextTransformed++
+			if err := write(of); err != nil {
+				return err
+			}
+		}
 	}
 	if err := g.Wait(); err != nil {
 		return err
@@ -325,6 +689,30 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 	return nil
 }
 
+// ConvertZip is like Convert, but reads the EPUB from a zip file of the
+// specified size (e.g., an *os.File). Files which Convert doesn't need to
+// change are copied without being decompressed and recompressed. See
+// ConvertBytes for converting an EPUB in memory.
+func (c *Converter) ConvertZip(ctx context.Context, w io.Writer, r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("read source EPUB: %w", err)
+	}
+	return c.Convert(ctx, w, zr)
+}
+
+// ConvertBytes is like ConvertZip, but reads the EPUB from and writes the
+// converted one to memory, without creating any temporary files. It is the
+// simplest way to convert a book which is already in memory (e.g., from an
+// upload or in WebAssembly).
+func (c *Converter) ConvertBytes(ctx context.Context, in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.ConvertZip(ctx, &buf, bytes.NewReader(in), int64(len(in))); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // epubWriteMimetype writes the mimetype file to an EPUB. It must be called
 // before any other files are written.
 func epubWriteMimetype(epub *zip.Writer) error {
@@ -385,7 +773,8 @@ func epubPackage(epub fs.FS) (string, error) {
 //
 // While application/xhtml+xml is the only officially accepted type (as of EPUB
 // 2.0.1 - 3.3), some invalid EPUBs use text/html, and others use
-// application/xml or text/xml with a .htm, .xhtml, or .html extension.
+// application/xml or text/xml with a .htm, .xhtml, or .html extension. SVG
+// content documents are never included, even if they have an HTML extension.
 func epubContentDocuments(epub fs.FS, pkg string) ([]string, error) {
 	var opf struct {
 		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
@@ -412,6 +801,8 @@ func epubContentDocuments(epub fs.FS, pkg string) ([]string, error) {
 		case "application/xhtml+xml", "text/html":
 			docs = append(docs, path.Join(path.Dir(pkg), it.Href))
 			continue
+		case "image/svg+xml":
+			continue // EPUB3 SVG content documents must not be parsed as HTML
 		}
 		switch strings.ToLower(path.Ext(it.Href)) {
 		case ".htm", ".html", ".xhtml":
@@ -423,6 +814,399 @@ func epubContentDocuments(epub fs.FS, pkg string) ([]string, error) {
 	return docs, nil
 }
 
+// epubManifestFiles gets the filenames of the items in the provided EPUB OPF
+// package document with a media type matching fn.
+func epubManifestFiles(epub fs.FS, pkg string, fn func(mediaType string) bool) ([]string, error) {
+	var opf struct {
+		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		ManifestItem []struct {
+			Href      string `xml:"href,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"http://www.idpf.org/2007/opf manifest>item"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	var files []string
+	for _, it := range opf.ManifestItem {
+		if fn(it.MediaType) {
+			files = append(files, path.Join(path.Dir(pkg), it.Href))
+		}
+	}
+
+	return files, nil
+}
+
+// EncryptedError is returned by Convert if content documents in the EPUB are
+// encrypted (i.e., the book has DRM). Font obfuscation is not considered to be
+// encryption.
+type EncryptedError struct {
+	Files []string // encrypted content documents
+}
+
+func (e *EncryptedError) Error() string {
+	return fmt.Sprintf("%d content documents are encrypted (the book probably has DRM)", len(e.Files))
+}
+
+// epubEncryptedFiles gets the paths of the files encrypted with a method other
+// than font obfuscation, according to META-INF/encryption.xml.
+func epubEncryptedFiles(epub fs.FS) (map[string]bool, error) {
+	var enc struct {
+		EncryptedData []struct {
+			EncryptionMethod struct {
+				Algorithm string `xml:"Algorithm,attr"`
+			} `xml:"http://www.w3.org/2001/04/xmlenc# EncryptionMethod"`
+			CipherData struct {
+				CipherReference struct {
+					URI string `xml:"URI,attr"`
+				} `xml:"http://www.w3.org/2001/04/xmlenc# CipherReference"`
+			} `xml:"http://www.w3.org/2001/04/xmlenc# CipherData"`
+		} `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
+	}
+
+	f, err := epub.Open("META-INF/encryption.xml")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("parse OCF encryption: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&enc); err != nil {
+		return nil, fmt.Errorf("parse OCF encryption: %w", err)
+	}
+
+	files := map[string]bool{}
+	for _, d := range enc.EncryptedData {
+		switch d.EncryptionMethod.Algorithm {
+		case "http://www.idpf.org/2008/embedding", "http://ns.adobe.com/pdf/enc#RC":
+			continue // font obfuscation
+		}
+		uri := d.CipherData.CipherReference.URI
+		if u, err := url.PathUnescape(uri); err == nil {
+			uri = u
+		}
+		files[path.Clean(strings.TrimPrefix(uri, "/"))] = true
+	}
+	return files, nil
+}
+
+// epubNCX gets the filename of the EPUB2 NCX in the provided EPUB OPF package
+// document, or an empty string if there isn't one.
+func epubNCX(epub fs.FS, pkg string) (string, error) {
+	var opf struct {
+		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		ManifestItem []struct {
+			ID        string `xml:"id,attr"`
+			Href      string `xml:"href,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"http://www.idpf.org/2007/opf manifest>item"`
+		Spine struct {
+			TOC string `xml:"toc,attr"`
+		} `xml:"http://www.idpf.org/2007/opf spine"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	for _, it := range opf.ManifestItem {
+		if opf.Spine.TOC != "" && it.ID == opf.Spine.TOC {
+			return path.Join(path.Dir(pkg), it.Href), nil
+		}
+	}
+	for _, it := range opf.ManifestItem {
+		if it.MediaType == "application/x-dtbncx+xml" {
+			return path.Join(path.Dir(pkg), it.Href), nil
+		}
+	}
+	return "", nil
+}
+
+// epubNav gets the filename of the EPUB3 navigation document in the provided
+// EPUB OPF package document, or an empty string if there isn't one.
+func epubNav(epub fs.FS, pkg string) (string, error) {
+	var opf struct {
+		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		ManifestItem []struct {
+			Href       string `xml:"href,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"http://www.idpf.org/2007/opf manifest>item"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	for _, it := range opf.ManifestItem {
+		if includes(it.Properties, "nav") {
+			return path.Join(path.Dir(pkg), it.Href), nil
+		}
+	}
+	return "", nil
+}
+
+// epubGeneratedNav generates an EPUB3 navigation document from the NCX of the
+// provided EPUB OPF package document, or returns nil if it already has a nav,
+// doesn't have a NCX, or isn't an EPUB3 package (which can't have a nav).
+// Entries pointing to removed files are left unlinked.
+func epubGeneratedNav(epub fs.FS, pkg string, removed map[string]bool) ([]byte, error) {
+	if nav, err := epubNav(epub, pkg); err != nil || nav != "" {
+		return nil, err
+	}
+
+	if doc, err := epubPackageDocument(epub, pkg); err != nil {
+		return nil, err
+	} else if el := doc.SelectElement("package"); el == nil || !strings.HasPrefix(el.SelectAttrValue("version", ""), "3") {
+		return nil, nil
+	}
+
+	ncx, err := epubNCX(epub, pkg)
+	if err != nil || ncx == "" {
+		return nil, err
+	}
+
+	f, err := epub.Open(ncx)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("generate nav: %w", err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if err := generateNav(&buf, f, func(src string) string {
+		fn, frag := src, ""
+		if i := strings.IndexByte(src, '#'); i != -1 {
+			fn, frag = src[:i], src[i:]
+		}
+		if fn == "" {
+			return ""
+		}
+		fn = path.Join(path.Dir(ncx), fn)
+		if removed[fn] {
+			return ""
+		}
+		return relativePath(path.Dir(pkg), fn) + frag
+	}); err != nil {
+		return nil, fmt.Errorf("generate nav: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// epubSpine gets the filenames of the items in the spine of the provided EPUB
+// OPF package document, in reading order.
+func epubSpine(epub fs.FS, pkg string) ([]string, error) {
+	var opf struct {
+		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		ManifestItem []struct {
+			ID   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.idpf.org/2007/opf manifest>item"`
+		SpineItem []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"http://www.idpf.org/2007/opf spine>itemref"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	href := map[string]string{}
+	for _, it := range opf.ManifestItem {
+		href[it.ID] = it.Href
+	}
+
+	var files []string
+	for _, it := range opf.SpineItem {
+		if h, ok := href[it.IDRef]; ok {
+			files = append(files, path.Join(path.Dir(pkg), h))
+		}
+	}
+	return files, nil
+}
+
+// epubLanguage gets the first dc:language from the provided EPUB OPF package
+// document, if any.
+func epubLanguage(epub fs.FS, pkg string) (string, error) {
+	var opf struct {
+		XMLName  xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		Metadata struct {
+			Language []string `xml:"http://purl.org/dc/elements/1.1/ language"`
+		} `xml:"http://www.idpf.org/2007/opf metadata"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	for _, lang := range opf.Metadata.Language {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			return lang, nil
+		}
+	}
+	return "", nil
+}
+
+// epubPageBreaks gets the page breaks from the content documents cd in the
+// spine of the provided EPUB OPF package document, with hrefs relative to the
+// navigation document nav. Missing documents are skipped.
+func epubPageBreaks(epub fs.FS, pkg, nav string, cd []string) ([]pageListEntry, error) {
+	spine, err := epubSpine(epub, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	isContent := map[string]bool{}
+	for _, fn := range cd {
+		isContent[fn] = true
+	}
+
+	var pages []pageListEntry
+	for _, fn := range spine {
+		if !isContent[fn] || fn == nav {
+			continue
+		}
+
+		f, err := epub.Open(fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("find page breaks in %q: %w", fn, err)
+		}
+
+		doc, err := html.ParseWithOptions(f,
+			html.ParseOptionEnableScripting(true),
+			html.ParseOptionIgnoreBOM(true),
+			html.ParseOptionLenientSelfClosing(true))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("find page breaks in %q: parse html: %w", fn, err)
+		}
+
+		rel := (&url.URL{Path: relativePath(path.Dir(nav), fn)}).String()
+		for _, pg := range contentPageBreaks(doc) {
+			pg.Href = rel + pg.Href
+			pages = append(pages, pg)
+		}
+	}
+	return pages, nil
+}
+
+// epubDataURIs gets the images to extract from data URIs in the content
+// documents cd (see contentDataURIs), with names relative to the root of the
+// EPUB. SVG and missing documents are skipped.
+func epubDataURIs(epub fs.FS, cd []string, minSize int) ([]dataURIFile, error) {
+	var files []dataURIFile
+	seen := map[string]bool{}
+	for _, fn := range cd {
+		buf, err := fs.ReadFile(epub, fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("find data URIs in %q: %w", fn, err)
+		}
+		if isSVGDocument(buf) {
+			continue
+		}
+
+		doc, err := html.ParseWithOptions(bytes.NewReader(buf),
+			html.ParseOptionEnableScripting(true),
+			html.ParseOptionIgnoreBOM(true),
+			html.ParseOptionLenientSelfClosing(true))
+		if err != nil {
+			return nil, fmt.Errorf("find data URIs in %q: parse html: %w", fn, err)
+		}
+
+		contentDataURIs(doc, minSize, func(_ *html.Attribute, f dataURIFile) {
+			if f.Name = path.Join(path.Dir(fn), f.Name); !seen[f.Name] {
+				seen[f.Name] = true
+				files = append(files, f)
+			}
+		})
+	}
+	return files, nil
+}
+
+// epubContentIDs gets the ids (see contentIDs) in each of the content
+// documents cd. Missing documents are skipped.
+func epubContentIDs(epub fs.FS, cd []string) (map[string]map[string]bool, error) {
+	ids := make(map[string]map[string]bool, len(cd))
+	for _, fn := range cd {
+		f, err := epub.Open(fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("find ids in %q: %w", fn, err)
+		}
+
+		doc, err := html.ParseWithOptions(f,
+			html.ParseOptionEnableScripting(true),
+			html.ParseOptionIgnoreBOM(true),
+			html.ParseOptionLenientSelfClosing(true))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("find ids in %q: parse html: %w", fn, err)
+		}
+
+		ids[fn] = map[string]bool{}
+		contentIDs(doc, ids[fn])
+	}
+	return ids, nil
+}
+
+// relativePath gets the slash-separated path of target relative to the
+// directory dir.
+func relativePath(dir, target string) string {
+	ds := strings.Split(path.Clean(dir), "/")
+	ts := strings.Split(path.Clean(target), "/")
+	if ds[0] == "." {
+		ds = ds[1:]
+	}
+	var n int
+	for n < len(ds) && n < len(ts)-1 && ds[n] == ts[n] {
+		n++
+	}
+	var rel []string
+	for range ds[n:] {
+		rel = append(rel, "..")
+	}
+	return path.Join(append(rel, ts[n:]...)...)
+}
+
 // zipReplace copies a file from one zip archive to another, preserving the
 // metadata, replacing the content, and force-enabling compression.
 func zipReplace(z *zip.Writer, f *zip.FileHeader, r io.Reader) error {
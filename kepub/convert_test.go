@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/png"
 	"io"
@@ -180,6 +183,235 @@ func TestConvert(t *testing.T) {
 		},
 	}.Run(t)
 
+	ConvertTestCase{
+		What: "with svg content documents",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`<item id="cover" `, `<item id="svg1" href="svg1.svg" media-type="image/svg+xml"/><item id="svg2" href="svg2.xhtml" media-type="image/svg+xml"/><item id="svg3" href="svg3.xhtml" media-type="application/xhtml+xml"/><item id="cover" `,
+					`<itemref idref="xhtml_title"/>`, `<itemref idref="xhtml_title"/><itemref idref="svg1"/><itemref idref="svg2"/><itemref idref="svg3"/>`,
+				).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/svg1.svg": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?><svg xmlns="http://www.w3.org/2000/svg"><text>Sentence 1. Sentence 2.</text></svg>`),
+				Mode: 0666,
+			},
+			"OEBPS/svg2.xhtml": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?><svg xmlns="http://www.w3.org/2000/svg"><text>Sentence 1. Sentence 2.</text></svg>`),
+				Mode: 0666,
+			},
+			"OEBPS/svg3.xhtml": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?><svg xmlns="http://www.w3.org/2000/svg"><text>Sentence 1. Sentence 2.</text></svg>`),
+				Mode: 0666,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldBeUnchanged("OEBPS/svg1.svg").Because("svg content documents should not be transformed"),
+			ShouldBeUnchanged("OEBPS/svg2.xhtml").Because("svg content documents should not be transformed even if they have an html extension"),
+			ShouldBeUnchanged("OEBPS/svg3.xhtml").Because("svg content documents should be detected by the root element"),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with blocked media types",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`<item id="cover" `, `<item id="audio1" href="audio/track1.mp3" media-type="audio/mpeg"/><item id="cover" `,
+				).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/audio/track1.mp3": &fstest.MapFile{
+				Data: []byte(`not really an mp3`),
+				Mode: 0666,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionBlockMediaType("audio/*"),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("OEBPS/audio/track1.mp3"),
+			ShouldBeUnchanged("OEBPS/cover.png"),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if strings.Contains(contents, `audio1`) {
+					return fmt.Errorf("should not reference removed file")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with blocked media types and an ncx",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`<item id="cover" `, `<item id="audio1" href="audio/track1.mp3" media-type="audio/mpeg"/><item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/><item id="cover" `,
+				).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/audio/track1.mp3": &fstest.MapFile{
+				Data: []byte(`not really an mp3`),
+				Mode: 0666,
+			},
+			"OEBPS/toc.ncx": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+	<navMap>
+		<navPoint id="np1" playOrder="1"><navLabel><text>Chapter 1</text></navLabel><content src="xhtml/ch01.xhtml"/></navPoint>
+		<navPoint id="np2" playOrder="2"><navLabel><text>Audio</text></navLabel><content src="audio/track1.mp3"/></navPoint>
+		<navPoint id="np3" playOrder="3"><navLabel><text>Chapter 2</text></navLabel><content src="xhtml/ch02.xhtml"/></navPoint>
+	</navMap>
+</ncx>`),
+				Mode: 0666,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionBlockMediaType("audio/*"),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("OEBPS/audio/track1.mp3"),
+			FileShould("OEBPS/toc.ncx", func(contents string) error {
+				if strings.Contains(contents, `track1.mp3`) {
+					return fmt.Errorf("should not reference removed file")
+				}
+				if !strings.Contains(contents, `<navPoint id="np3" playOrder="2">`) {
+					return fmt.Errorf("should renumber play order")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	generatedNavEPUB := func(oldnew ...string) fstest.MapFS {
+		return overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(append([]string{
+					`<item href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`, `<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>`,
+				}, oldnew...)...).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/nav.xhtml": nil,
+			"OEBPS/toc.ncx": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+	<navMap>
+		<navPoint id="np1" playOrder="1"><navLabel><text>Chapter 1</text></navLabel><content src="xhtml/ch01.xhtml"/></navPoint>
+		<navPoint id="np2" playOrder="2"><navLabel><text>Chapter 2</text></navLabel><content src="xhtml/ch02.xhtml#start"/></navPoint>
+	</navMap>
+</ncx>`),
+				Mode: 0666,
+			},
+		})
+	}
+
+	ConvertTestCase{
+		What:        "with generated nav",
+		EPUB:        generatedNavEPUB(),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionGenerateNav(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(1),
+			FileShould("OEBPS/kepubify-nav.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `<nav epub:type="toc" id="toc">`) {
+					return fmt.Errorf("should have a toc nav")
+				}
+				if !strings.Contains(contents, `<a href="xhtml/ch01.xhtml">Chapter 1</a>`) || !strings.Contains(contents, `<a href="xhtml/ch02.xhtml#start">Chapter 2</a>`) {
+					return fmt.Errorf("should have links to the ncx targets")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if !strings.Contains(contents, `<item id="kepubify-nav" href="kepubify-nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`) {
+					return fmt.Errorf("generated nav not added to manifest")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with generated nav and a conflicting id",
+		EPUB:        generatedNavEPUB(`<item id="cover" href="cover.png"`, `<item id="kepubify-nav" href="cover.png"`),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionGenerateNav(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(1),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if !strings.Contains(contents, `<item id="kepubify-nav-2" href="kepubify-nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`) {
+					return fmt.Errorf("generated nav not added to manifest with a unique id")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with generated nav for an EPUB2 book",
+		EPUB:        generatedNavEPUB(`version="3.0"`, `version="2.0"`),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionGenerateNav(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("OEBPS/kepubify-nav.xhtml"),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if strings.Contains(contents, `properties="nav"`) {
+					return fmt.Errorf("nav property should not be added to an EPUB2 package")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with generated nav and metadata only",
+		EPUB:        generatedNavEPUB(),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionGenerateNav(),
+			ConverterOptionMetadataOnly(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("OEBPS/kepubify-nav.xhtml"),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with generated nav for a book with a nav",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionGenerateNav(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("OEBPS/kepubify-nav.xhtml"),
+		},
+	}.Run(t)
+
 	ConvertTestCase{
 		What:        "with cover fix forced",
 		EPUB:        testEPUB,
@@ -349,6 +581,49 @@ func TestConvert(t *testing.T) {
 		},
 	}.Run(t)
 
+	ConvertTestCase{
+		What: "with smart punctuation and hyphenation for the book language",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.Replace(string(testEPUB["OEBPS/content.opf"].Data), `</dc:title>`, `</dc:title><dc:language>de-DE</dc:language>`, 1)),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title>Replaced Chapter</title></head><body><p>Er sagte: "Es ist 'gut'." Dann ging er.</p></body></html>`),
+				Mode: 0644,
+			},
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html lang="en"><head><title>Replaced Chapter</title></head><body><p>He said: "It's 'good'." Then he left.</p></body></html>`),
+				Mode: 0644,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionSmartypants(),
+			ConverterOptionHyphenate(true),
+		},
+		Checks: []ShouldFunc{
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				for _, x := range []string{
+					`<html lang="de-DE" xml:lang="de-DE"`,
+					`<span class="koboSpan" id="kobo.1.1">Er sagte: „Es ist ‚gut‘.“ </span><span class="koboSpan" id="kobo.1.2">Dann ging er.</span>`,
+				} {
+					if !strings.Contains(doc, x) {
+						return fmt.Errorf("%q does not contain %q", doc, x)
+					}
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch02.xhtml", func(doc string) error {
+				if x := `He said: “It’s ‘good’.” `; !strings.Contains(doc, x) {
+					return fmt.Errorf("%q does not contain %q", doc, x)
+				}
+				return nil
+			}).Because("the document language should take precedence"),
+		},
+	}.Run(t)
+
 	ConvertTestCase{
 		What:        "with hyphenation enable css",
 		EPUB:        testEPUB,
@@ -409,6 +684,26 @@ func TestConvert(t *testing.T) {
 		},
 	}.Run(t)
 
+	ConvertTestCase{
+		What:        "with orphan and widow control css",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionOrphansWidows(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			AllDocumentsShould(func(doc string) error {
+				if !strings.Contains(doc, cssOrphansWidows) {
+					return fmt.Errorf("missing css")
+				}
+				return nil
+			}, nil),
+		},
+	}.Run(t)
+
 	ConvertTestCase{
 		What:        "with custom css",
 		EPUB:        testEPUB,
@@ -429,41 +724,694 @@ func TestConvert(t *testing.T) {
 			}, nil),
 		},
 	}.Run(t)
-}
-
-type ConvertTestCase struct {
-	What        string
-	EPUB        fs.FS
-	ShouldError bool
 
-	Options []ConverterOption
-	Checks  []ShouldFunc
-}
+	ConvertTestCase{
+		What: "with footnote superscripts",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><p>A word<a href="#n1">1</a> and more.</p><p id="n1">1. The note.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
 
-func (tc ConvertTestCase) Run(t *testing.T) {
-	t.Logf("case %q", tc.What)
+		Options: []ConverterOption{
+			ConverterOptionFootnoteSup(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `<sup><a href="#n1">`) {
+					return fmt.Errorf("expected footnote reference to be wrapped in sup: %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
 
-	kepub := bytes.NewBuffer(nil)
+	ConvertTestCase{
+		What: "with page list",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title></title></head><body><p>One.<span epub:type="pagebreak" id="page1" title="1"/></p><p>Two.<span role="doc-pagebreak" id="page2">2</span></p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title></title></head><body><div epub:type="pagebreak" id="page_iii" aria-label="iii"></div><p>Three.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch02.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
 
-	if err := NewConverterWithOptions(tc.Options...).Convert(context.Background(), kepub, tc.EPUB); err != nil {
-		if !tc.ShouldError {
-			t.Errorf("case %q: convert: unexpected error: %v", tc.What, err)
-		}
-		return
-	} else if tc.ShouldError {
-		t.Errorf("case %q: convert: expected error", tc.What)
-		return
-	}
+		Options: []ConverterOption{
+			ConverterOptionPageList(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/nav.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `<nav epub:type="page-list" hidden="hidden">`) {
+					return fmt.Errorf("page list not added: %s", contents)
+				}
+				for _, exp := range []string{"xhtml/ch01.xhtml#page1", "xhtml/ch01.xhtml#page2", "xhtml/ch02.xhtml#page_iii"} {
+					if !strings.Contains(contents, `<a href="`+exp+`">`) {
+						return fmt.Errorf("page list missing %q: %s", exp, contents)
+					}
+				}
+				if a, b, c := strings.Index(contents, "#page1"), strings.Index(contents, "#page2"), strings.Index(contents, "#page_iii"); a > b || b > c {
+					return fmt.Errorf("page list not in reading order: %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
 
-	zr, err := zip.NewReader(bytes.NewReader(kepub.Bytes()), int64(kepub.Len()))
-	if err != nil {
-		panic(err)
-	}
+	ConvertTestCase{
+		What: "with dead links removed",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(testDeadLinksChapter),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
 
-	for _, c := range tc.Checks {
-		if err := c(tc.EPUB, zr); err != nil {
-			t.Errorf("case %q: check: %v", tc.What, err)
-		}
+		Options: []ConverterOption{
+			ConverterOptionDeadLinks(nil, true),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				for _, href := range []string{"#here", "ch02.xhtml", "ch01.xhtml#old", "../cover.png#x", "https://example.com/#x"} {
+					if !strings.Contains(contents, `href="`+href+`"`) {
+						return fmt.Errorf("link to %q should not have been removed: %s", href, contents)
+					}
+				}
+				for _, href := range []string{"ch02.xhtml#nowhere", "missing.xhtml"} {
+					if strings.Contains(contents, `href="`+href+`"`) {
+						return fmt.Errorf("dead link to %q should have been removed: %s", href, contents)
+					}
+				}
+				if !strings.Contains(contents, `>nowhere</span></a>`) {
+					return fmt.Errorf("dead link text should have been kept: %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with span flattening",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><p><span class="w">Hello</span> <span class="w">world.</span></p><p><span><span>Nested</span></span> text.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionFlattenSpans(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if n := strings.Count(contents, `class="w"`); n != 1 {
+					return fmt.Errorf("expected adjacent identical spans to be merged, got %d: %s", n, contents)
+				}
+				if !strings.Contains(contents, `Hello world.`) || !strings.Contains(contents, `Nested text.`) {
+					return fmt.Errorf("expected spans to be merged and unwrapped: %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with mojibake fixes",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><p>Itâ€™s a cafÃ© â€” naÃ¯ve.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionFixMojibake(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `It’s a café — naïve.`) || strings.Contains(contents, `â€`) {
+					return fmt.Errorf("expected mojibake to be fixed: %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with relative font sizes",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><p style="font-size:14px">Small.</p><p style="font-size: 12pt; color: red">Normal.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionRelativeFontSizes(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `style="font-size:0.875em"`) || !strings.Contains(contents, `style="font-size: 1em; color: red"`) {
+					return fmt.Errorf("expected font sizes to be converted to em: %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with justification stripped",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><style type="text/css">p { text-indent: 1em; text-align: justify; }</style><p style="text-align:justify; color: red">Justified.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionStripJustify(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if strings.Contains(contents, `justify`) || !strings.Contains(contents, `style="color: red"`) || !strings.Contains(contents, `text-indent: 1em;`) {
+					return fmt.Errorf("expected text-align: justify to be removed: %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with full-bleed cover",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/title.xhtml": &fstest.MapFile{
+				Data: bytes.ReplaceAll(testEPUB["OEBPS/xhtml/title.xhtml"].Data, []byte(`charset="utf-8/>`), []byte(`charset="utf-8"/>`)),
+				Mode: testEPUB["OEBPS/xhtml/title.xhtml"].Mode,
+			},
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><div><img src="../cover.png" alt="Cover"/></div></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch02.xhtml"].Mode,
+			},
+			"OEBPS/xhtml/ch03.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><div><img src="../map.png" alt="Map"/></div></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch03.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionFullBleedCover(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml", "OEBPS/xhtml/ch02.xhtml"}),
+			FileShould("OEBPS/xhtml/title.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `xlink:href="cover.png"`) || strings.Contains(contents, "<img") {
+					return fmt.Errorf("cover image not wrapped in svg")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch02.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `<title>Cover</title><image width="100%" height="100%" preserveAspectRatio="xMidYMid meet" xlink:href="../cover.png">`) {
+					return fmt.Errorf("page consisting of the cover image not wrapped in svg with the alt text: %s", contents)
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch03.xhtml", func(contents string) error {
+				if strings.Contains(contents, "<svg") || !strings.Contains(contents, `<img src="../map.png" alt="Map"/>`) {
+					return fmt.Errorf("image which isn't the cover should not be wrapped in svg")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with empty element removal",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><div></div><p>One<span></span>.</p><div><div><span></span></div></div><p>Two.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionRemoveEmptyElements(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if strings.Contains(contents, `<div></div>`) || strings.Contains(contents, `<span></span>`) || strings.Count(contents, `<div`) != 2 {
+					return fmt.Errorf("expected empty elements to be removed (leaving only the kobo divs): %s", contents)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with xml declaration",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionXMLDeclaration(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(func(doc string) error {
+				if !strings.HasPrefix(doc, `<?xml version="1.0" encoding="utf-8"?>`) {
+					return fmt.Errorf("missing xml declaration")
+				}
+				return nil
+			}, nil),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with metadata only",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionMetadataOnly(),
+			ConverterOptionDummyTitlepage(true),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldBeUnchanged("OEBPS/cover.png", "OEBPS/nav.xhtml", "OEBPS/xhtml/title.xhtml", "OEBPS/xhtml/ch01.xhtml", "OEBPS/xhtml/ch99.xhtml"),
+			ShouldNotHaveFile("OEBPS/kepubify-titlepage-dummy.xhtml"),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if !strings.Contains(contents, `cover-image`) {
+					return fmt.Errorf("opf not transformed")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with guide cover",
+		EPUB:        testGuideCoverEPUB(`<img src="../cover.png" alt="Cover"/>`),
+		ShouldError: false,
+
+		Options: []ConverterOption{},
+		Checks: []ShouldFunc{
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if !strings.Contains(contents, `<item id="cover_png" href="cover.png" media-type="image/png" properties="cover-image"/>`) {
+					return fmt.Errorf("cover-image property not added to the image on the guide cover page")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with data URI extraction",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(strings.Replace(string(testEPUB["OEBPS/xhtml/ch01.xhtml"].Data), "</body>", `<p><img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" alt=""/></p></body>`, 1)),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionExtractDataURIs(0),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldHaveFile("OEBPS/xhtml/kepubify-data-2f41918f848b5fb0.gif"),
+			FileShould("OEBPS/xhtml/kepubify-data-2f41918f848b5fb0.gif", func(contents string) error {
+				if contents != "GIF89a\x01\x00\x01\x00\x00\x00\x00," {
+					return fmt.Errorf("incorrect image data %q", contents)
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if !strings.Contains(contents, `<img src="kepubify-data-2f41918f848b5fb0.gif" alt=""/>`) {
+					return fmt.Errorf("data URI not replaced")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if !strings.Contains(contents, `<item id="kepubify-data-2f41918f848b5fb0" href="xhtml/kepubify-data-2f41918f848b5fb0.gif" media-type="image/gif"/>`) {
+					return fmt.Errorf("manifest item not added")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	placeholderCoverEPUB := overlayMapFS(testEPUB, fstest.MapFS{
+		"OEBPS/content.opf": &fstest.MapFile{
+			Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+		<dc:title>Test Book</dc:title>
+		<dc:creator>Test Author</dc:creator>
+	</metadata>
+	<manifest>
+		<item id="xhtml_ch01" href="xhtml/ch01.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+	<spine>
+		<itemref idref="xhtml_ch01"/>
+	</spine>
+</package>`),
+			Mode: testEPUB["OEBPS/content.opf"].Mode,
+		},
+	})
+
+	ConvertTestCase{
+		What:        "with placeholder cover",
+		EPUB:        placeholderCoverEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionPlaceholderCover(),
+			ConverterOptionDummyTitlepage(false),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			FileShould("OEBPS/kepubify-cover.png", func(contents string) error {
+				img, err := png.Decode(strings.NewReader(contents))
+				if err != nil {
+					return fmt.Errorf("decode placeholder cover: %w", err)
+				}
+				if sz := img.Bounds().Size(); sz != image.Pt(600, 900) {
+					return fmt.Errorf("expected 600x900 placeholder cover, got %v", sz)
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if !strings.Contains(contents, `<item id="kepubify-cover" href="kepubify-cover.png" media-type="image/png" properties="cover-image"/>`) {
+					return fmt.Errorf("placeholder cover not added to manifest")
+				}
+				if !strings.Contains(contents, `<meta name="cover" content="kepubify-cover"/>`) {
+					return fmt.Errorf("cover meta not added")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with placeholder cover and metadata only",
+		EPUB:        placeholderCoverEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionPlaceholderCover(),
+			ConverterOptionMetadataOnly(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("OEBPS/kepubify-cover.png"),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with placeholder cover for a book with a cover",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionPlaceholderCover(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("OEBPS/kepubify-cover.png"),
+		},
+	}.Run(t)
+
+	bigCover := bytes.NewBuffer(nil)
+	_ = png.Encode(bigCover, image.NewRGBA(image.Rect(0, 0, 1600, 2400)))
+	claraW, claraH, _ := KoboScreenSize("clara-hd")
+
+	ConvertTestCase{
+		What: "with max image size",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/cover.png": &fstest.MapFile{
+				Data: bigCover.Bytes(),
+				Mode: testEPUB["OEBPS/cover.png"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionMaxImageSize(claraW, claraH),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			FileShould("OEBPS/cover.png", func(contents string) error {
+				cfg, format, err := image.DecodeConfig(strings.NewReader(contents))
+				if err != nil {
+					return fmt.Errorf("decode resized image: %w", err)
+				}
+				if format != "png" {
+					return fmt.Errorf("expected resized image to be a png, got %s", format)
+				}
+				if cfg.Width != 965 || cfg.Height != 1448 {
+					return fmt.Errorf("expected resized image to be 965x1448, got %dx%d", cfg.Width, cfg.Height)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with max image size larger than the images",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionMaxImageSize(claraW, claraH),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldBeUnchanged("OEBPS/cover.png"),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with a content document larger than the max size",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title></title></head><body>` + strings.Repeat("<p>Sentence one. Sentence two.</p>\n", 1<<12) + `</body></html>`),
+				Mode: 0644,
+			},
+		}),
+		ShouldError:   true,
+		ErrorContains: `"OEBPS/xhtml/ch02.xhtml": parse html: content document is larger than 65536 bytes`,
+
+		Options: []ConverterOption{
+			ConverterOptionMaxContentSize(1 << 16),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with max image size and a corrupt image",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/cover.png": &fstest.MapFile{
+				Data: bigCover.Bytes()[:bigCover.Len()/2],
+				Mode: testEPUB["OEBPS/cover.png"].Mode,
+			},
+		}),
+		ShouldError:   true,
+		ErrorContains: `"OEBPS/cover.png"`,
+
+		Options: []ConverterOption{
+			ConverterOptionMaxImageSize(claraW, claraH),
+		},
+	}.Run(t)
+
+	hugeCover := bytes.NewBuffer(nil)
+	_ = png.Encode(hugeCover, image.NewGray(image.Rect(0, 0, 1, 1)))
+	binary.BigEndian.PutUint32(hugeCover.Bytes()[16:], 100000) // IHDR width
+	binary.BigEndian.PutUint32(hugeCover.Bytes()[20:], 100000) // IHDR height
+	binary.BigEndian.PutUint32(hugeCover.Bytes()[29:], crc32.ChecksumIEEE(hugeCover.Bytes()[12:29]))
+
+	ConvertTestCase{
+		What: "with max image size and an image with too many pixels",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/cover.png": &fstest.MapFile{
+				Data: hugeCover.Bytes(),
+				Mode: testEPUB["OEBPS/cover.png"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionMaxImageSize(claraW, claraH),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldBeUnchanged("OEBPS/cover.png"),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with Kobo-only profile",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"META-INF/com.apple.ibooks.display-options.xml": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?><display_options><platform name="*"><option name="specified-fonts">true</option></platform></display_options>`),
+				Mode: 0666,
+			},
+			"OEBPS/page-template.xpgt": &fstest.MapFile{
+				Data: []byte(`<ade:template xmlns="http://www.w3.org/1999/xhtml" xmlns:ade="http://ns.adobe.com/2006/ade"/>`),
+				Mode: 0666,
+			},
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`<package `, `<package prefix="ibooks: http://vocabulary.itunes.apple.com/rdf/ibooks/vocabulary-extensions-1.0/ rendition: http://www.idpf.org/vocab/rendition/#" `,
+					`</metadata>`, `<meta property="ibooks:specified-fonts">true</meta><meta property="rendition:layout">reflowable</meta></metadata>`,
+					`</manifest>`, `<item id="template" href="page-template.xpgt" media-type="application/vnd.adobe-page-template+xml"/></manifest>`,
+				).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`<html `, `<html xmlns:ibooks="http://vocabulary.itunes.apple.com/rdf/ibooks/vocabulary-extensions-1.0" ibooks:version="3.0" `,
+					`</title>`, `</title><link rel="stylesheet" type="application/vnd.adobe-page-template+xml" href="../page-template.xpgt"/>`,
+				).Replace(string(testEPUB["OEBPS/xhtml/ch01.xhtml"].Data))),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionKoboOnly(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			ShouldNotHaveFile("META-INF/com.apple.ibooks.display-options.xml", "OEBPS/page-template.xpgt"),
+			FileShould("OEBPS/content.opf", func(contents string) error {
+				if strings.Contains(contents, "ibooks") || strings.Contains(contents, "xpgt") {
+					return fmt.Errorf("iBooks metadata or page template not removed")
+				}
+				if !strings.Contains(contents, `prefix="rendition: http://www.idpf.org/vocab/rendition/#"`) || !strings.Contains(contents, `rendition:layout`) {
+					return fmt.Errorf("standard metadata removed")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if strings.Contains(contents, "ibooks") || strings.Contains(contents, "xpgt") {
+					return fmt.Errorf("iBooks attributes or page template link not removed")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with base removal",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(strings.Replace(string(testEPUB["OEBPS/xhtml/ch01.xhtml"].Data), "<head>", `<head><base href="../"/>`, 1)),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionRemoveBase(),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(contents string) error {
+				if strings.Contains(contents, "<base") {
+					return fmt.Errorf("base element not removed")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with custom span start",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionKoboSpanStart(1, 0),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(func(doc string) error {
+				if !strings.Contains(doc, `id="kobo.1.0"`) {
+					return fmt.Errorf("spans don't start at kobo.1.0")
+				}
+				return nil
+			}, []string{"OEBPS/xhtml/title.xhtml"}),
+		},
+	}.Run(t)
+}
+
+type ConvertTestCase struct {
+	What        string
+	EPUB        fs.FS
+	ShouldError bool
+
+	// ErrorContains, if set, must be in the error message (e.g., the name of
+	// the file which failed to be transformed).
+	ErrorContains string
+
+	Options []ConverterOption
+	Checks  []ShouldFunc
+}
+
+func (tc ConvertTestCase) Run(t *testing.T) {
+	t.Logf("case %q", tc.What)
+
+	kepub := bytes.NewBuffer(nil)
+
+	if err := NewConverterWithOptions(tc.Options...).Convert(context.Background(), kepub, tc.EPUB); err != nil {
+		if !tc.ShouldError {
+			t.Errorf("case %q: convert: unexpected error: %v", tc.What, err)
+		} else if !strings.Contains(err.Error(), tc.ErrorContains) {
+			t.Errorf("case %q: convert: expected error to contain %q, got: %v", tc.What, tc.ErrorContains, err)
+		}
+		return
+	} else if tc.ShouldError {
+		t.Errorf("case %q: convert: expected error", tc.What)
+		return
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(kepub.Bytes()), int64(kepub.Len()))
+	if err != nil {
+		panic(err)
+	}
+
+	for _, c := range tc.Checks {
+		if err := c(tc.EPUB, zr); err != nil {
+			t.Errorf("case %q: check: %v", tc.What, err)
+		}
 	}
 
 	if _, ok := tc.EPUB.(*zip.Reader); ok {
@@ -559,6 +1507,298 @@ func (c ShouldFunc) Because(what string) ShouldFunc {
 	}
 }
 
+func TestConvertEncrypted(t *testing.T) {
+	encryption := func(alg string) *fstest.MapFile {
+		return &fstest.MapFile{
+			Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+	<enc:EncryptedData>
+		<enc:EncryptionMethod Algorithm="` + alg + `"/>
+		<enc:CipherData>
+			<enc:CipherReference URI="OEBPS/xhtml/ch01.xhtml"/>
+		</enc:CipherData>
+	</enc:EncryptedData>
+	<enc:EncryptedData>
+		<enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+		<enc:CipherData>
+			<enc:CipherReference URI="OEBPS/fonts/font.otf"/>
+		</enc:CipherData>
+	</enc:EncryptedData>
+</encryption>`),
+			Mode: 0666,
+		}
+	}
+
+	err := NewConverter().Convert(context.Background(), io.Discard, overlayMapFS(testEPUB, fstest.MapFS{
+		"META-INF/encryption.xml": encryption("http://www.w3.org/2001/04/xmlenc#aes128-cbc"),
+	}))
+	var eerr *EncryptedError
+	if !errors.As(err, &eerr) {
+		t.Fatalf("expected EncryptedError, got %v", err)
+	}
+	if len(eerr.Files) != 1 || eerr.Files[0] != "OEBPS/xhtml/ch01.xhtml" {
+		t.Errorf("expected ch01 to be the only encrypted file, got %q", eerr.Files)
+	}
+
+	if err := NewConverter().Convert(context.Background(), io.Discard, overlayMapFS(testEPUB, fstest.MapFS{
+		"META-INF/encryption.xml": encryption("http://www.idpf.org/2008/embedding"),
+	})); err != nil {
+		t.Errorf("expected no error for font obfuscation, got %v", err)
+	}
+}
+
+func TestConvertZip(t *testing.T) {
+	epub := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(epub)
+	if err := epubWriteMimetype(zw); err != nil {
+		panic(err)
+	}
+	if err := fs.WalkDir(testEPUB, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		w, err := zw.Create(path)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(testEPUB[path].Data)
+		return err
+	}); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+
+	kepub := bytes.NewBuffer(nil)
+	if err := NewConverter().ConvertZip(context.Background(), kepub, bytes.NewReader(epub.Bytes()), int64(epub.Len())); err != nil {
+		t.Fatalf("convert: unexpected error: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(kepub.Bytes()), int64(kepub.Len()))
+	if err != nil {
+		t.Fatalf("open output: %v", err)
+	}
+	if f := zr.File[0]; f.Name != "mimetype" || f.Method != zip.Store {
+		t.Errorf("expected the mimetype to be the first file and uncompressed")
+	}
+	for _, c := range []ShouldFunc{
+		ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+		ShouldBeUnchanged("OEBPS/cover.png"),
+		AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+	} {
+		if err := c(testEPUB, zr); err != nil {
+			t.Errorf("check: %v", err)
+		}
+	}
+
+	if err := NewConverter().ConvertZip(context.Background(), io.Discard, strings.NewReader("not a zip"), 9); err == nil {
+		t.Errorf("expected error for invalid zip")
+	}
+}
+
+func TestConvertBytes(t *testing.T) {
+	// with the mimetype compressed and not first
+	epub := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(epub)
+	if err := fs.WalkDir(testEPUB, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		w, err := zw.Create(path)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(testEPUB[path].Data)
+		return err
+	}); err != nil {
+		panic(err)
+	}
+	if w, err := zw.Create("mimetype"); err != nil {
+		panic(err)
+	} else if _, err := io.WriteString(w, "application/epub+zip"); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+
+	kepub, err := NewConverter().ConvertBytes(context.Background(), epub.Bytes())
+	if err != nil {
+		t.Fatalf("convert: unexpected error: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(kepub), int64(len(kepub)))
+	if err != nil {
+		t.Fatalf("open output: %v", err)
+	}
+	if f := zr.File[0]; f.Name != "mimetype" || f.Method != zip.Store || f.CompressedSize64 != f.UncompressedSize64 || len(f.Extra) != 0 {
+		t.Errorf("expected the mimetype to be the first file, stored, and uncompressed")
+	}
+	if buf, err := fs.ReadFile(zr, "mimetype"); err != nil || string(buf) != "application/epub+zip" {
+		t.Errorf("expected mimetype contents to be correct, got %q (err: %v)", buf, err)
+	}
+	if !bytes.Equal(kepub[30:38], []byte("mimetype")) || !bytes.Equal(kepub[38:58], []byte("application/epub+zip")) {
+		t.Errorf("expected the mimetype to be at the start of the zip without any extra fields")
+	}
+	if err := ShouldHaveAllSourceDocumentsWithSaneOPF(0)(testEPUB, zr); err != nil {
+		t.Errorf("check: %v", err)
+	}
+
+	if _, err := NewConverter().ConvertBytes(context.Background(), []byte("not a zip")); err == nil {
+		t.Errorf("expected error for invalid zip")
+	}
+}
+
+func TestConvertConcurrency(t *testing.T) {
+	var out []string
+	for _, n := range []int{1, 4, 0} {
+		kepub := bytes.NewBuffer(nil)
+		if err := NewConverterWithOptions(ConverterOptionConcurrency(n)).Convert(context.Background(), kepub, testEPUB); err != nil {
+			t.Fatalf("concurrency %d: convert: unexpected error: %v", n, err)
+		}
+		out = append(out, kepub.String())
+	}
+	for i := 1; i < len(out); i++ {
+		if out[i] != out[0] {
+			t.Errorf("expected output to be identical regardless of concurrency")
+		}
+	}
+
+	if err := NewConverterWithOptions(ConverterOptionConcurrency(4), ConverterOptionCharset("invalid")).Convert(context.Background(), io.Discard, testEPUB); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+const testDeadLinksChapter = `<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><p id="here">See <a href="#here">here</a>, <a href="ch02.xhtml">ch2</a>, <a href="ch02.xhtml#nowhere">nowhere</a>, <a href="missing.xhtml">missing</a>, <a name="old">old</a><a href="ch01.xhtml#old">old</a>, <a href="../cover.png#x">cover</a>, and <a href="https://example.com/#x">example</a>.</p></body></html>`
+
+func TestConvertDeadLinks(t *testing.T) {
+	var logged []string
+	kepub := bytes.NewBuffer(nil)
+	if err := NewConverterWithOptions(
+		ConverterOptionConcurrency(1), // so fn doesn't need to be synchronized
+		ConverterOptionDeadLinks(func(format string, a ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, a...))
+		}, false),
+	).Convert(context.Background(), kepub, overlayMapFS(testEPUB, fstest.MapFS{
+		"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+			Data: []byte(testDeadLinksChapter),
+			Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+		},
+		"OEBPS/nav.xhtml": &fstest.MapFile{
+			Data: []byte(strings.Replace(string(testEPUB["OEBPS/nav.xhtml"].Data), `</ol>`, `<li><a href="xhtml/missing.xhtml">Missing</a></li></ol>`, 1)),
+			Mode: testEPUB["OEBPS/nav.xhtml"].Mode,
+		},
+	})); err != nil {
+		t.Fatalf("convert: unexpected error: %v", err)
+	}
+	if exp := []string{
+		`dead link in "OEBPS/nav.xhtml": "xhtml/missing.xhtml"`,
+		`dead link in "OEBPS/xhtml/ch01.xhtml": "ch02.xhtml#nowhere"`,
+		`dead link in "OEBPS/xhtml/ch01.xhtml": "missing.xhtml"`,
+	}; strings.Join(logged, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("expected dead links %q, got %q", exp, logged)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(kepub.Bytes()), int64(kepub.Len()))
+	if err != nil {
+		t.Fatalf("open output: %v", err)
+	}
+	if buf, err := fs.ReadFile(zr, "OEBPS/xhtml/ch01.xhtml"); err != nil {
+		t.Errorf("read output: %v", err)
+	} else if !bytes.Contains(buf, []byte(`href="missing.xhtml"`)) {
+		t.Errorf("expected dead links to be kept")
+	}
+}
+
+func TestConvertReplacementChars(t *testing.T) {
+	var logged []string
+	if err := NewConverterWithOptions(
+		ConverterOptionConcurrency(1), // so fn doesn't need to be synchronized
+		ConverterOptionLogReplacementChars(func(format string, a ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, a...))
+		}, false),
+	).Convert(context.Background(), io.Discard, overlayMapFS(testEPUB, fstest.MapFS{
+		"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+			Data: []byte("<!DOCTYPE html><html><head><title></title></head><body><p>Caf\uFFFD au lait.</p></body></html>"),
+			Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+		},
+	})); err != nil {
+		t.Fatalf("convert: unexpected error: %v", err)
+	}
+	if exp := []string{
+		"replacement character in \"OEBPS/xhtml/ch01.xhtml\" at offset 3: \"Caf\uFFFD au lait.\"",
+	}; strings.Join(logged, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("expected log %q, got %q", exp, logged)
+	}
+}
+
+func BenchmarkConvert(b *testing.B) {
+	epub := benchmarkEPUB(500)
+	for _, n := range []int{1, 0} {
+		name := "Serial"
+		if n == 0 {
+			name = "Concurrent"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := NewConverterWithOptions(ConverterOptionConcurrency(n))
+			for i := 0; i < b.N; i++ {
+				if err := c.Convert(context.Background(), io.Discard, epub); err != nil {
+					b.Fatalf("convert: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkEPUB generates a synthetic EPUB with n content documents, each with
+// a few hundred paragraphs of text.
+func benchmarkEPUB(n int) fstest.MapFS {
+	para := `<p>Lorem ipsum dolor sit amet, <em>consectetur</em> adipiscing elit. Sed do eiusmod tempor incididunt ut labore et dolore magna aliqua? Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat.</p>`
+	doc := `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+	<head>
+		<title>Chapter #</title>
+	</head>
+	<body>
+		<h1>Chapter #</h1>
+		` + strings.Repeat(para+"\n\t\t", 200) + `
+	</body>
+</html>
+`
+	epub := fstest.MapFS{
+		"mimetype":               testEPUB["mimetype"],
+		"META-INF/container.xml": testEPUB["META-INF/container.xml"],
+		"OEBPS/content.opf": &fstest.MapFile{
+			Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+		<dc:title>Benchmark</dc:title>
+	</metadata>
+	<manifest>` + stringFor(`
+		<item id="ch#" href="ch#.xhtml" media-type="application/xhtml+xml"/>`, 0, n, func(s string, i int) string {
+				return strings.ReplaceAll(s, "#", strconv.Itoa(i))
+			}) + `
+	</manifest>
+	<spine>` + stringFor(`
+		<itemref idref="ch#"/>`, 0, n, func(s string, i int) string {
+				return strings.ReplaceAll(s, "#", strconv.Itoa(i))
+			}) + `
+	</spine>
+</package>
+`),
+			Mode: 0666,
+		},
+	}
+	for i := 0; i < n; i++ {
+		epub["OEBPS/ch"+strconv.Itoa(i)+".xhtml"] = &fstest.MapFile{
+			Data: []byte(strings.ReplaceAll(doc, "#", strconv.Itoa(i))),
+			Mode: 0666,
+		}
+	}
+	return epub
+}
+
 func ShouldHaveAllSourceDocumentsWithSaneOPF(withNew int) ShouldFunc {
 	return func(old fs.FS, new *zip.Reader) error {
 		pkgO, err := epubPackage(old)
@@ -0,0 +1,416 @@
+package kepub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ExtractCover decodes the cover image of the EPUB (or KEPUB) root epub without
+// converting the book. It uses the same detection rules as Convert, but
+// prefers an existing cover-image property if present. If the book doesn't
+// have a cover, nil is returned without an error. GIF, JPEG, and PNG covers
+// are supported, along with any other formats registered with the image
+// package.
+//
+// The returned image is not resized; callers wanting thumbnails for library
+// display should scale it themselves.
+func ExtractCover(epub fs.FS) (image.Image, error) {
+	opf, err := epubPackage(epub)
+	if err != nil {
+		return nil, fmt.Errorf("extract cover: %w", err)
+	}
+
+	fn, err := epubCoverImage(epub, opf)
+	if err != nil {
+		return nil, fmt.Errorf("extract cover: %w", err)
+	}
+	if fn == "" {
+		return nil, nil
+	}
+
+	f, err := epub.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("extract cover: open %q: %w", fn, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("extract cover: decode %q: %w", fn, err)
+	}
+	return img, nil
+}
+
+// epubCoverImage gets the filename of the cover image in the provided EPUB OPF
+// package document, or an empty string if there isn't one.
+func epubCoverImage(epub fs.FS, pkg string) (string, error) {
+	doc, err := epubPackageDocument(epub, pkg)
+	if err != nil {
+		return "", err
+	}
+
+	cover := opfCoverImageItem(doc)
+	if cover == nil {
+		cover = opfCoverItem(doc)
+	}
+	if cover == nil {
+		if cover, err = opfGuideCoverItem(epub, pkg, doc); err != nil {
+			return "", err
+		}
+	}
+	if cover == nil {
+		return "", nil
+	}
+
+	href := cover.SelectAttrValue("href", "")
+	if href == "" {
+		return "", nil
+	}
+	return path.Join(path.Dir(pkg), href), nil
+}
+
+// epubGuideCover gets the manifest item ID of the cover image found using the
+// EPUB2 guide (see opfGuideCoverItem) for books which don't otherwise specify
+// one, or an empty string.
+func epubGuideCover(epub fs.FS, pkg string) (string, error) {
+	doc, err := epubPackageDocument(epub, pkg)
+	if err != nil {
+		return "", err
+	}
+	if opfCoverImageItem(doc) != nil || opfCoverItem(doc) != nil {
+		return "", nil
+	}
+	cover, err := opfGuideCoverItem(epub, pkg, doc)
+	if err != nil || cover == nil {
+		return "", err
+	}
+	return cover.SelectAttrValue("id", ""), nil
+}
+
+// epubGuideCoverPage gets the filename of the cover page referenced by the
+// EPUB2 guide, or an empty string if there isn't one (or it's an image).
+func epubGuideCoverPage(epub fs.FS, pkg string) (string, error) {
+	doc, err := epubPackageDocument(epub, pkg)
+	if err != nil {
+		return "", err
+	}
+
+	ref := doc.FindElement("//guide/reference[@type='cover']")
+	if ref == nil {
+		return "", nil
+	}
+
+	u, err := url.Parse(ref.SelectAttrValue("href", ""))
+	if err != nil || u.Scheme != "" || u.Path == "" {
+		return "", nil
+	}
+	fn := path.Join(path.Dir(pkg), u.Path)
+
+	if page := opfManifestItem(doc, pkg, fn); page == nil || strings.HasPrefix(page.SelectAttrValue("media-type", ""), "image/") {
+		return "", nil
+	}
+	return fn, nil
+}
+
+// epubPackageDocument parses the provided EPUB OPF package document.
+func epubPackageDocument(epub fs.FS, pkg string) (*etree.Document, error) {
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(f); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	return doc, nil
+}
+
+// opfCoverImageItem finds the manifest item with the cover-image property.
+func opfCoverImageItem(doc *etree.Document) *etree.Element {
+	for _, el := range doc.FindElements("//manifest/item[@properties]") {
+		if includes(el.SelectAttrValue("properties", ""), "cover-image") {
+			return el
+		}
+	}
+	return nil
+}
+
+// opfGuideCoverItem finds the manifest item of the cover image using the cover
+// reference in the EPUB2 guide. If it references an image, that image is used,
+// otherwise the first image in the referenced cover page is. If the cover page
+// or the image doesn't exist, nil is returned without an error.
+func opfGuideCoverItem(epub fs.FS, pkg string, doc *etree.Document) (*etree.Element, error) {
+	ref := doc.FindElement("//guide/reference[@type='cover']")
+	if ref == nil {
+		return nil, nil
+	}
+
+	u, err := url.Parse(ref.SelectAttrValue("href", ""))
+	if err != nil || u.Scheme != "" || u.Path == "" {
+		return nil, nil
+	}
+	fn := path.Join(path.Dir(pkg), u.Path)
+
+	page := opfManifestItem(doc, pkg, fn)
+	if page == nil || strings.HasPrefix(page.SelectAttrValue("media-type", ""), "image/") {
+		return page, nil
+	}
+
+	f, err := epub.Open(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read cover page %q: %w", fn, err)
+	}
+	defer f.Close()
+
+	node, err := html.ParseWithOptions(f,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return nil, fmt.Errorf("read cover page %q: parse html: %w", fn, err)
+	}
+
+	if u, err = url.Parse(contentFirstImage(node)); err != nil || u.Scheme != "" || u.Path == "" {
+		return nil, nil
+	}
+	if img := opfManifestItem(doc, pkg, path.Join(path.Dir(fn), u.Path)); img != nil && strings.HasPrefix(img.SelectAttrValue("media-type", ""), "image/") {
+		return img, nil
+	}
+	return nil, nil
+}
+
+// opfManifestItem finds the manifest item for the file fn (relative to the root
+// of the EPUB) in the package document pkg.
+func opfManifestItem(doc *etree.Document, pkg, fn string) *etree.Element {
+	for _, el := range doc.FindElements("//manifest/item[@href]") {
+		if href, err := url.PathUnescape(el.SelectAttrValue("href", "")); err == nil && path.Join(path.Dir(pkg), href) == fn {
+			return el
+		}
+	}
+	return nil
+}
+
+// contentFirstImage gets the URL of the first img or SVG image element in a
+// content document, or an empty string if there isn't one.
+func contentFirstImage(n *html.Node) string {
+	if n.Type == html.ElementNode {
+		switch {
+		case n.DataAtom == atom.Img && n.Namespace == "":
+			return attrValue(n, "src")
+		case n.DataAtom == atom.Image && n.Namespace == "svg":
+			return attrValue(n, "href") // or xlink:href
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if src := contentFirstImage(c); src != "" {
+			return src
+		}
+	}
+	return ""
+}
+
+// placeholderCoverName is the filename of the generated placeholder cover,
+// relative to the OPF package document.
+const placeholderCoverName = "kepubify-cover.png"
+
+// epubPlaceholderCover generates a placeholder cover for the EPUB using the
+// title and author from the provided OPF package document, or returns nil if
+// it already has a cover.
+func epubPlaceholderCover(epub fs.FS, pkg string) ([]byte, error) {
+	if fn, err := epubCoverImage(epub, pkg); err != nil || fn != "" {
+		return nil, err
+	}
+
+	doc, err := epubPackageDocument(epub, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	var title, author string
+	if el := doc.FindElement("//metadata/title"); el != nil {
+		title = strings.Join(strings.Fields(el.Text()), " ")
+	}
+	if el := doc.FindElement("//metadata/creator"); el != nil {
+		author = strings.Join(strings.Fields(el.Text()), " ")
+	}
+	return placeholderCover(title, author)
+}
+
+// placeholderCoverColors are the background colors for placeholder covers.
+var placeholderCoverColors = []color.RGBA{
+	{0x2f, 0x48, 0x58, 0xff},
+	{0x33, 0x65, 0x8a, 0xff},
+	{0x55, 0x25, 0x1d, 0xff},
+	{0x5a, 0x4a, 0x42, 0xff},
+	{0x3d, 0x5a, 0x45, 0xff},
+	{0x4a, 0x3b, 0x5c, 0xff},
+}
+
+// placeholderCover renders a simple PNG cover with the title and author (since
+// Kobo requires a raster cover image for library thumbnails). The background
+// color is chosen based on the title and author.
+func placeholderCover(title, author string) ([]byte, error) {
+	h := fnv.New32a()
+	h.Write([]byte(title + "\x00" + author))
+
+	img := image.NewPaletted(image.Rect(0, 0, 600, 900), color.Palette{
+		placeholderCoverColors[h.Sum32()%uint32(len(placeholderCoverColors))],
+		color.White,
+	})
+	draw.Draw(img, image.Rect(30, 30, 570, 34), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(30, 866, 570, 870), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(30, 30, 34, 870), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(566, 30, 570, 870), image.White, image.Point{}, draw.Src)
+
+	lines := wrapWords(title, 16)
+	if len(lines) > 6 {
+		lines = append(lines[:5], lines[5]+"\u2026")
+	}
+	for i, line := range lines {
+		drawPlaceholderText(img, line, 400-len(lines)*28+i*56, 5)
+	}
+	if lines := wrapWords(author, 26); len(lines) != 0 {
+		drawPlaceholderText(img, lines[0], 780, 3)
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return nil, fmt.Errorf("encode placeholder cover: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// drawPlaceholderText draws s centered horizontally at y using placeholderFont
+// scaled by scale. Characters without a glyph are drawn as a box after
+// removing diacritics and converting to uppercase.
+func drawPlaceholderText(img draw.Image, s string, y, scale int) {
+	s = strings.NewReplacer("\u2018", "'", "\u2019", "'", "\u201c", `"`, "\u201d", `"`, "\u2013", "-", "\u2014", "-", "\u2026", "...").Replace(s)
+	s = strings.ToUpper(norm.NFD.String(s))
+
+	var glyphs [][7]uint8
+	for _, r := range s {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if r == ' ' {
+			glyphs = append(glyphs, [7]uint8{})
+		} else if g, ok := placeholderFont[r]; ok {
+			glyphs = append(glyphs, g)
+		} else {
+			glyphs = append(glyphs, [7]uint8{0b11111, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b11111})
+		}
+	}
+
+	x := (img.Bounds().Dx() - len(glyphs)*6*scale + scale) / 2
+	for _, g := range glyphs {
+		for row, bits := range g {
+			for col := 0; col < 5; col++ {
+				if bits&(1<<(4-col)) != 0 {
+					draw.Draw(img, image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale), image.White, image.Point{}, draw.Src)
+				}
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// placeholderFont is a 5x7 bitmap font for placeholder covers. Each row is
+// stored in the lower five bits, with the leftmost pixel first.
+var placeholderFont = map[rune][7]uint8{
+	'A':  {0b01110, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'B':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10001, 0b10001, 0b11110},
+	'C':  {0b01110, 0b10001, 0b10000, 0b10000, 0b10000, 0b10001, 0b01110},
+	'D':  {0b11110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b11110},
+	'E':  {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b11111},
+	'F':  {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b10000},
+	'G':  {0b01110, 0b10001, 0b10000, 0b10111, 0b10001, 0b10001, 0b01111},
+	'H':  {0b10001, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'I':  {0b01110, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'J':  {0b00111, 0b00010, 0b00010, 0b00010, 0b00010, 0b10010, 0b01100},
+	'K':  {0b10001, 0b10010, 0b10100, 0b11000, 0b10100, 0b10010, 0b10001},
+	'L':  {0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b11111},
+	'M':  {0b10001, 0b11011, 0b10101, 0b10101, 0b10001, 0b10001, 0b10001},
+	'N':  {0b10001, 0b10001, 0b11001, 0b10101, 0b10011, 0b10001, 0b10001},
+	'O':  {0b01110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'P':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10000, 0b10000, 0b10000},
+	'Q':  {0b01110, 0b10001, 0b10001, 0b10001, 0b10101, 0b10010, 0b01101},
+	'R':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10100, 0b10010, 0b10001},
+	'S':  {0b01111, 0b10000, 0b10000, 0b01110, 0b00001, 0b00001, 0b11110},
+	'T':  {0b11111, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100},
+	'U':  {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'V':  {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01010, 0b00100},
+	'W':  {0b10001, 0b10001, 0b10001, 0b10101, 0b10101, 0b10101, 0b01010},
+	'X':  {0b10001, 0b10001, 0b01010, 0b00100, 0b01010, 0b10001, 0b10001},
+	'Y':  {0b10001, 0b10001, 0b01010, 0b00100, 0b00100, 0b00100, 0b00100},
+	'Z':  {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0b11111},
+	'0':  {0b01110, 0b10001, 0b10011, 0b10101, 0b11001, 0b10001, 0b01110},
+	'1':  {0b00100, 0b01100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'2':  {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0b01000, 0b11111},
+	'3':  {0b11111, 0b00010, 0b00100, 0b00010, 0b00001, 0b10001, 0b01110},
+	'4':  {0b00010, 0b00110, 0b01010, 0b10010, 0b11111, 0b00010, 0b00010},
+	'5':  {0b11111, 0b10000, 0b11110, 0b00001, 0b00001, 0b10001, 0b01110},
+	'6':  {0b00110, 0b01000, 0b10000, 0b11110, 0b10001, 0b10001, 0b01110},
+	'7':  {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b01000, 0b01000},
+	'8':  {0b01110, 0b10001, 0b10001, 0b01110, 0b10001, 0b10001, 0b01110},
+	'9':  {0b01110, 0b10001, 0b10001, 0b01111, 0b00001, 0b00010, 0b01100},
+	'.':  {0b00000, 0b00000, 0b00000, 0b00000, 0b00000, 0b01100, 0b01100},
+	',':  {0b00000, 0b00000, 0b00000, 0b00000, 0b01100, 0b00100, 0b01000},
+	'\'': {0b00100, 0b00100, 0b01000, 0b00000, 0b00000, 0b00000, 0b00000},
+	'"':  {0b01010, 0b01010, 0b00000, 0b00000, 0b00000, 0b00000, 0b00000},
+	'!':  {0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00000, 0b00100},
+	'?':  {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0b00000, 0b00100},
+	'-':  {0b00000, 0b00000, 0b00000, 0b11111, 0b00000, 0b00000, 0b00000},
+	':':  {0b00000, 0b01100, 0b01100, 0b00000, 0b01100, 0b01100, 0b00000},
+	';':  {0b00000, 0b01100, 0b01100, 0b00000, 0b01100, 0b00100, 0b01000},
+	'&':  {0b01100, 0b10010, 0b10100, 0b01000, 0b10101, 0b10010, 0b01101},
+	'(':  {0b00010, 0b00100, 0b01000, 0b01000, 0b01000, 0b00100, 0b00010},
+	')':  {0b01000, 0b00100, 0b00010, 0b00010, 0b00010, 0b00100, 0b01000},
+	'/':  {0b00000, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0b00000},
+	'<':  {0b00010, 0b00100, 0b01000, 0b10000, 0b01000, 0b00100, 0b00010},
+	'>':  {0b01000, 0b00100, 0b00010, 0b00001, 0b00010, 0b00100, 0b01000},
+}
+
+// wrapWords splits s into lines of up to n characters at word boundaries.
+// Words longer than n are not split.
+func wrapWords(s string, n int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(s) {
+		if line != "" && utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > n {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
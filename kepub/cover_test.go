@@ -0,0 +1,163 @@
+package kepub
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestExtractCover(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		img, err := ExtractCover(testEPUB)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if img == nil {
+			t.Fatalf("expected cover to be found")
+		}
+		if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 600 {
+			t.Errorf("expected 300x600 cover, got %dx%d", b.Dx(), b.Dy())
+		}
+	})
+
+	t.Run("ZIP", func(t *testing.T) {
+		zr, err := epubFsToZip(testEPUB)
+		if err != nil {
+			panic(err)
+		}
+		img, err := ExtractCover(zr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if img == nil {
+			t.Fatalf("expected cover to be found")
+		}
+	})
+
+	t.Run("NoCover", func(t *testing.T) {
+		img, err := ExtractCover(overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="xhtml_title" href="xhtml/title.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+	<spine>
+		<itemref idref="xhtml_title"/>
+	</spine>
+</package>`),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+		}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if img != nil {
+			t.Errorf("expected no cover")
+		}
+	})
+
+	t.Run("Guide", func(t *testing.T) {
+		for _, page := range []string{
+			`<img src="../cover.png" alt="Cover"/>`,
+			`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 300 600"><image width="300" height="600" xlink:href="../cover.png"/></svg>`,
+		} {
+			img, err := ExtractCover(testGuideCoverEPUB(page))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if img == nil {
+				t.Errorf("expected cover to be found using the guide for %q", page)
+			}
+		}
+	})
+
+	t.Run("BadImage", func(t *testing.T) {
+		if _, err := ExtractCover(overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/cover.png": &fstest.MapFile{
+				Data: []byte(`not an image`),
+				Mode: testEPUB["OEBPS/cover.png"].Mode,
+			},
+		})); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestPlaceholderCover(t *testing.T) {
+	buf, err := placeholderCover("The <Long> Title of a Test Book & More", "Some Author")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("expected valid png, got error: %v", err)
+	}
+	if sz := img.Bounds().Size(); sz != image.Pt(600, 900) {
+		t.Errorf("expected 600x900 image, got %v", sz)
+	}
+	for _, rect := range []image.Rectangle{
+		image.Rect(40, 200, 560, 600), // title
+		image.Rect(40, 760, 560, 820), // author
+	} {
+		var text bool
+		for y := rect.Min.Y; y < rect.Max.Y && !text; y++ {
+			for x := rect.Min.X; x < rect.Max.X && !text; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				text = r == 0xffff && g == 0xffff && b == 0xffff
+			}
+		}
+		if !text {
+			t.Errorf("expected text in %v", rect)
+		}
+	}
+
+	if a, _ := placeholderCover("One", "Author"); true {
+		if b, _ := placeholderCover("One", "Author"); !bytes.Equal(a, b) {
+			t.Errorf("expected placeholder cover to be deterministic")
+		}
+		if b, _ := placeholderCover("Two", "Author"); bytes.Equal(a, b) {
+			t.Errorf("expected placeholder cover to depend on the title")
+		}
+	}
+
+	if lines := wrapWords(strings.Repeat("word ", 40), 16); len(lines) != 14 {
+		t.Errorf("expected 14 lines, got %q", lines)
+	}
+}
+
+// testGuideCoverEPUB returns a copy of testEPUB where the cover is only
+// referenced by the guide, with a cover page with the provided body.
+func testGuideCoverEPUB(body string) fstest.MapFS {
+	return overlayMapFS(testEPUB, fstest.MapFS{
+		"OEBPS/content.opf": &fstest.MapFile{
+			Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+	<manifest>
+		<item id="cover_page" href="xhtml/cover.xhtml" media-type="application/xhtml+xml"/>
+		<item id="xhtml_ch01" href="xhtml/ch01.xhtml" media-type="application/xhtml+xml"/>
+		<item id="cover_png" href="cover.png" media-type="image/png"/>
+	</manifest>
+	<spine>
+		<itemref idref="cover_page"/>
+		<itemref idref="xhtml_ch01"/>
+	</spine>
+	<guide>
+		<reference href="xhtml/cover.xhtml#start" title="Cover" type="cover"/>
+	</guide>
+</package>`),
+			Mode: testEPUB["OEBPS/content.opf"].Mode,
+		},
+		"OEBPS/xhtml/cover.xhtml": &fstest.MapFile{
+			Data: []byte(`<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Cover</title></head>
+<body><div id="start">` + body + `</div></body>
+</html>`),
+			Mode: testEPUB["OEBPS/content.opf"].Mode,
+		},
+	})
+}
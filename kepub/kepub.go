@@ -3,7 +3,10 @@ package kepub
 
 import (
 	"context"
+	"image"
 	"math"
+	"sort"
+	"strings"
 )
 
 // Converter converts EPUB2/EPUB3 books to Kobo's KEPUB format.
@@ -11,9 +14,12 @@ type Converter struct {
 	// extra css
 	extraCSS      []string
 	extraCSSClass []string
+	hyphenate     bool // also sets the document language, which is required for hyphenation
 
 	// smart punctuation
-	smartypants bool
+	smartypants           bool
+	noSmartEllipses       bool
+	noSmartSpacedEllipses bool
 
 	// find/replace in raw html output
 	find    [][]byte
@@ -25,6 +31,87 @@ type Converter struct {
 
 	// charset override
 	charset string // "auto" for auto-detection
+	// charset declaration normalization
+	charsetMeta bool
+
+	// koboSpan customization
+	spans koboSpanOptions
+
+	// disabled transformations
+	noKoboStyles bool
+	noKoboDivs   bool
+	noKoboSpans  bool
+	noClean      bool
+
+	// replacement characters
+	replacementLog  func(format string, a ...interface{})
+	keepReplacement bool
+
+	// dead links
+	deadLinkLog     func(format string, a ...interface{})
+	removeDeadLinks bool
+
+	// span flattening
+	flattenSpans bool
+	// footnote references
+	footnoteSup bool
+
+	// mojibake repair
+	fixMojibake bool
+	// unicode normalization
+	normalizeUnicode bool
+
+	// removed resources
+	blockMediaTypes []string
+
+	// inline style tweaks
+	relativeFontSizes bool
+	stripJustify      bool
+	// inline style normalization
+	normalizeInlineStyles bool
+	// ascii art detection
+	asciiArt bool
+	// cover page fix
+	fullBleedCover bool
+	// empty element removal
+	removeEmpty bool
+	// xml declaration
+	xmlDeclaration bool
+	// non-breaking space representation
+	nbsp string
+	// only transform the OPF
+	metadataOnly bool
+	// base element removal
+	removeBase bool
+	// transformed content documents
+	contentCache *contentCache
+	// page list generation
+	pageList bool
+	// content document titles
+	contentTitles bool
+	// poster images for removed videos
+	mediaPosters bool
+	// chapter markers
+	chapterMarkers bool
+	// generated cover
+	placeholderCover bool
+	// generated nav
+	generateNav bool
+	// data uri extraction
+	dataURIs       bool
+	dataURIMinSize int
+	// image downscaling
+	maxImageSize image.Point
+	// css @import resolution
+	cssImports bool
+	// other reading system hint removal
+	koboOnly bool
+	// book language (from the OPF if not set)
+	language string
+	// number of files to transform concurrently (GOMAXPROCS if zero)
+	workers int
+	// content document size guard
+	maxContentSize int64
 }
 
 // ConverterOption configures a Converter.
@@ -51,6 +138,23 @@ func ConverterOptionSmartypants() ConverterOption {
 	}
 }
 
+// ConverterOptionNoSmartEllipses disables converting three dots (...) and
+// spaced dots (. . .) into an ellipsis when smart punctuation is enabled.
+func ConverterOptionNoSmartEllipses() ConverterOption {
+	return func(c *Converter) {
+		c.noSmartEllipses = true
+	}
+}
+
+// ConverterOptionNoSmartSpacedEllipses disables converting spaced dots (. . .)
+// into an ellipsis when smart punctuation is enabled. Three dots (...) are
+// still converted.
+func ConverterOptionNoSmartSpacedEllipses() ConverterOption {
+	return func(c *Converter) {
+		c.noSmartSpacedEllipses = true
+	}
+}
+
 // ConverterOptionFindReplace replaces a raw string in the transformed HTML.
 func ConverterOptionFindReplace(find, replace string) ConverterOption {
 	return func(c *Converter) {
@@ -70,6 +174,35 @@ func ConverterOptionDummyTitlepage(add bool) ConverterOption {
 	}
 }
 
+// ConverterOptionConcurrency sets the maximum number of files Convert will
+// transform concurrently. If n is zero (the default), GOMAXPROCS is used.
+func ConverterOptionConcurrency(n int) ConverterOption {
+	return func(c *Converter) {
+		c.workers = n
+	}
+}
+
+// ConverterOptionMaxContentSize makes TransformContent (and Convert) return a
+// *ContentTooLargeError for content documents larger than n bytes rather than
+// parsing them. Since the entire document is parsed into memory, this can be
+// used to guard against pathologically large inputs. If n is zero (the
+// default), there is no limit.
+func ConverterOptionMaxContentSize(n int64) ConverterOption {
+	return func(c *Converter) {
+		c.maxContentSize = n
+	}
+}
+
+// ConverterOptionLanguage sets the language used for language-dependent
+// transformations (e.g., the quote style for smart punctuation). By default,
+// Convert uses the first dc:language in the OPF. The lang attribute of a
+// content document takes precedence over both.
+func ConverterOptionLanguage(lang string) ConverterOption {
+	return func(c *Converter) {
+		c.language = lang
+	}
+}
+
 // ConverterOptionAddCSS adds CSS code to a book.
 func ConverterOptionAddCSS(css string) ConverterOption {
 	return converterOptionAddCSS("kepubify-extracss", css)
@@ -78,10 +211,13 @@ func ConverterOptionAddCSS(css string) ConverterOption {
 // ConverterOptionHyphenate force-enables or force-disables hyphenation. If not
 // set, no specific state is enforced by kepubify.
 func ConverterOptionHyphenate(hyphenate bool) ConverterOption {
-	if hyphenate {
-		return converterOptionAddCSS("kepubify-hyphenate", cssHyphenate)
+	return func(c *Converter) {
+		if c.hyphenate = hyphenate; hyphenate {
+			converterOptionAddCSS("kepubify-hyphenate", cssHyphenate)(c)
+		} else {
+			converterOptionAddCSS("kepubify-nohyphenate", cssNoHyphenate)(c)
+		}
 	}
-	return converterOptionAddCSS("kepubify-nohyphenate", cssNoHyphenate)
 }
 
 // ConverterOptionFullScreenFixes applies fullscreen fixes for firmware versions
@@ -90,6 +226,12 @@ func ConverterOptionFullScreenFixes() ConverterOption {
 	return converterOptionAddCSS("kepubify-fullscreenfixes", cssFullScreenFixes)
 }
 
+// ConverterOptionOrphansWidows adds CSS to prevent orphans and widows, and to
+// prevent page breaks directly after or inside headings.
+func ConverterOptionOrphansWidows() ConverterOption {
+	return converterOptionAddCSS("kepubify-orphanswidows", cssOrphansWidows)
+}
+
 // ConverterOptionCharset overrides the charset for all content documents. Use
 // "auto" to automatically detect the charset.
 func ConverterOptionCharset(charset string) ConverterOption {
@@ -98,6 +240,467 @@ func ConverterOptionCharset(charset string) ConverterOption {
 	}
 }
 
+// ConverterOptionNormalizeCharsetMeta replaces the charset declarations in
+// content documents (meta[charset] or meta[http-equiv="content-type"]) with a
+// single <meta charset="UTF-8"/>, adding one if there isn't any.
+func ConverterOptionNormalizeCharsetMeta() ConverterOption {
+	return func(c *Converter) {
+		c.charsetMeta = true
+	}
+}
+
+// ConverterOptionKoboSpanStart sets the paragraph number of the first koboSpan
+// in each content document, and the segment number of the first koboSpan in
+// each paragraph. By default, like official KEPUBs, the first id is kobo.1.1.
+func ConverterOptionKoboSpanStart(para, seg int) ConverterOption {
+	return func(c *Converter) {
+		c.spans.ParagraphBase = para - 1
+		c.spans.SegmentBase = seg - 1
+	}
+}
+
+// ConverterOptionWrapSpans puts koboSpans outside existing spans which only
+// contain a single sentence (i.e. <span class="koboSpan"><span>...</span></span>)
+// rather than inside them.
+func ConverterOptionWrapSpans() ConverterOption {
+	return func(c *Converter) {
+		c.spans.WrapSpans = true
+	}
+}
+
+// ConverterOptionListItemParagraphs numbers each list item as a separate
+// paragraph in the koboSpans (Kobo uses one paragraph for each list, excluding
+// nested lists), so read-aloud and highlights follow list items.
+func ConverterOptionListItemParagraphs() ConverterOption {
+	return func(c *Converter) {
+		c.spans.ListItemParagraphs = true
+	}
+}
+
+// ConverterOptionLineBreakParagraphs starts a new koboSpan paragraph after each
+// br and hr element, so each line of poetry or an address gets its own
+// paragraph number. By default, like official KEPUBs, the lines are segments in
+// the same paragraph.
+func ConverterOptionLineBreakParagraphs() ConverterOption {
+	return func(c *Converter) {
+		c.spans.LineBreakParagraphs = true
+	}
+}
+
+// ConverterOptionInlineSentences allows koboSpans to contain inline elements
+// (e.g., em and a) so sentences crossing their edges (e.g., "He said
+// <em>hello</em>. Then left.") are kept in a single span rather than split into
+// one for each text node. Elements containing anything else are handled as
+// usual.
+func ConverterOptionInlineSentences() ConverterOption {
+	return func(c *Converter) {
+		c.spans.InlineSentences = true
+	}
+}
+
+// ConverterOptionWordSpans wraps each word in a koboSpan rather than each
+// sentence, for finer-grained highlights and reading statistics. The spans are
+// numbered the same way as sentences would be. ConverterOptionWrapSpans and
+// ConverterOptionInlineSentences have no effect if this is set.
+func ConverterOptionWordSpans() ConverterOption {
+	return func(c *Converter) {
+		c.spans.Words = true
+	}
+}
+
+// ConverterOptionAbbreviations prevents sentences from being split into
+// separate koboSpans after the specified abbreviations (e.g., "Dr. Smith"),
+// which must include the trailing period. If none are specified, a default list
+// of common English abbreviations (Mr., Mrs., Dr., vs., etc., e.g., i.e.) is
+// used. This is heuristic, so it may join sentences which actually end with
+// one of them.
+func ConverterOptionAbbreviations(abbr ...string) ConverterOption {
+	return func(c *Converter) {
+		if len(abbr) == 0 {
+			abbr = defaultAbbreviations
+		}
+		c.spans.Abbreviations = abbr
+	}
+}
+
+// ConverterOptionTraceSpans calls fn (e.g. log.Printf) with debugging messages
+// for each node visited, the current paragraph and segment numbers, and the
+// sentences and koboSpans produced. Since content documents are transformed in
+// parallel, fn must be safe for concurrent use, and messages from different
+// documents may be interleaved.
+func ConverterOptionTraceSpans(fn func(format string, a ...interface{})) ConverterOption {
+	return func(c *Converter) {
+		c.spans.Trace = fn
+	}
+}
+
+// ConverterOptionSpanAttr adds an attribute (e.g., data-sentence-index) to each
+// koboSpan, with the value returned by fn for the paragraph and segment numbers
+// in the span id, and the zero-based index of the span in the content document.
+func ConverterOptionSpanAttr(key string, fn func(para, seg, idx int) string) ConverterOption {
+	return func(c *Converter) {
+		c.spans.Attrs = append(c.spans.Attrs, koboSpanAttr{Key: key, Val: fn})
+	}
+}
+
+// ConverterOptionSpanID sets the function used to generate koboSpan ids from
+// the paragraph and segment numbers, and the zero-based index of the span in
+// the content document. By default, the ids are kobo.PARA.SEG, which is what
+// the Kobo firmware expects for reading positions, highlights, and statistics,
+// so this should usually only be used for other tools or debugging. The ids must
+// be unique within each content document. Note that ContentStats only counts
+// koboSpans with kobo.PARA.SEG ids, so books converted with custom ids will
+// have zero spans and paragraphs.
+func ConverterOptionSpanID(fn func(para, seg, idx int) string) ConverterOption {
+	return func(c *Converter) {
+		c.spans.ID = fn
+	}
+}
+
+// ConverterOptionNoKoboStyles disables adding Kobo's style tweaks to content
+// documents.
+func ConverterOptionNoKoboStyles() ConverterOption {
+	return func(c *Converter) {
+		c.noKoboStyles = true
+	}
+}
+
+// ConverterOptionNoKoboDivs disables wrapping the body of content documents in
+// the divs Kobo uses to apply pagination styles. This can be used for books
+// with special formatting which the wrappers break, but the output won't
+// match official KEPUBs.
+func ConverterOptionNoKoboDivs() ConverterOption {
+	return func(c *Converter) {
+		c.noKoboDivs = true
+	}
+}
+
+// ConverterOptionNoKoboSpans disables adding koboSpans to content documents.
+// Highlighting, bookmarking, and other related features won't work without
+// them.
+func ConverterOptionNoKoboSpans() ConverterOption {
+	return func(c *Converter) {
+		c.noKoboSpans = true
+	}
+}
+
+// ConverterOptionNoCleanup disables removing Adept meta tags, empty MS Office
+// tags, and Unicode replacement characters from content documents.
+func ConverterOptionNoCleanup() ConverterOption {
+	return func(c *Converter) {
+		c.noClean = true
+	}
+}
+
+// ConverterOptionLogReplacementChars calls fn (e.g. log.Printf) with the
+// position and surrounding text of each Unicode replacement character (U+FFFD)
+// in content documents, which usually indicates an encoding problem in the
+// source. The position is the offset in runes from the start of the text in the
+// document. Like ConverterOptionTraceSpans, fn must be safe for concurrent use.
+// If keep is true, the replacement characters are left as-is instead of being
+// removed during cleanup.
+func ConverterOptionLogReplacementChars(fn func(format string, a ...interface{}), keep bool) ConverterOption {
+	return func(c *Converter) {
+		c.replacementLog = fn
+		c.keepReplacement = keep
+	}
+}
+
+// ConverterOptionDeadLinks checks the internal links in content documents when
+// converting a book with Convert, calling fn (e.g. log.Printf, or nil to not
+// log them) with each one pointing to a file or id which doesn't exist in the
+// book. Like ConverterOptionTraceSpans, fn must be safe for concurrent use. If
+// remove is true, the href is removed from those links, leaving the text.
+func ConverterOptionDeadLinks(fn func(format string, a ...interface{}), remove bool) ConverterOption {
+	return func(c *Converter) {
+		c.deadLinkLog = fn
+		c.removeDeadLinks = remove
+	}
+}
+
+// ConverterOptionFlattenSpans unwraps redundant spans and merges adjacent
+// spans with identical attributes before adding koboSpans. This is useful for
+// books which wrap nearly every word in a styled span.
+func ConverterOptionFlattenSpans() ConverterOption {
+	return func(c *Converter) {
+		c.flattenSpans = true
+	}
+}
+
+// ConverterOptionFixMojibake repairs common mojibake (e.g. `â€™` instead of
+// `’`) caused by UTF-8 text being decoded as Windows-1252.
+func ConverterOptionFixMojibake() ConverterOption {
+	return func(c *Converter) {
+		c.fixMojibake = true
+	}
+}
+
+// ConverterOptionNormalizeUnicode converts the text in content documents to
+// Unicode Normalization Form C (NFC), so decomposed characters (e.g., e followed
+// by U+0301) are replaced with the equivalent precomposed ones (e.g., é).
+// Attributes are left as-is.
+func ConverterOptionNormalizeUnicode() ConverterOption {
+	return func(c *Converter) {
+		c.normalizeUnicode = true
+	}
+}
+
+// ConverterOptionBlockMediaType removes all files with the specified media
+// type (e.g. audio/mpeg) from the book, along with their manifest items and
+// spine entries. A type ending in /* (e.g. video/*) matches all subtypes.
+func ConverterOptionBlockMediaType(mediaType string) ConverterOption {
+	return func(c *Converter) {
+		c.blockMediaTypes = append(c.blockMediaTypes, strings.ToLower(mediaType))
+	}
+}
+
+// ConverterOptionMediaPosters replaces video elements with their poster image if
+// all of their sources have a media type removed by
+// ConverterOptionBlockMediaType, so the page isn't left blank.
+func ConverterOptionMediaPosters() ConverterOption {
+	return func(c *Converter) {
+		c.mediaPosters = true
+	}
+}
+
+// ConverterOptionExtractDataURIs moves GIF, JPEG, PNG, SVG, and WebP images
+// embedded as data URIs in img src and SVG image href attributes with at least
+// minSize bytes of data into separate files next to the content document, and
+// adds them to the manifest. The files themselves are added by Convert.
+func ConverterOptionExtractDataURIs(minSize int) ConverterOption {
+	return func(c *Converter) {
+		c.dataURIs = true
+		c.dataURIMinSize = minSize
+	}
+}
+
+// ConverterOptionRelativeFontSizes converts absolute font sizes (px and pt) in
+// inline styles to em so Kobo's font size setting isn't overridden.
+func ConverterOptionRelativeFontSizes() ConverterOption {
+	return func(c *Converter) {
+		c.relativeFontSizes = true
+	}
+}
+
+// ConverterOptionNormalizeInlineStyles removes or replaces inline style
+// properties which Kobo renders poorly in content documents. Letter and word
+// spacing are removed, and uppercase or lowercase text transforms are applied
+// to the text itself. Style elements and external stylesheets are not
+// modified.
+func ConverterOptionNormalizeInlineStyles() ConverterOption {
+	return func(c *Converter) {
+		c.normalizeInlineStyles = true
+	}
+}
+
+// ConverterOptionASCIIArt converts paragraphs which look like ASCII art (at
+// least three br-separated lines made up mostly of symbols and aligned with
+// runs of spaces) into pre elements so they don't get reflowed or split into
+// spans. The detection is conservative, so some art may be missed.
+func ConverterOptionASCIIArt() ConverterOption {
+	return func(c *Converter) {
+		c.asciiArt = true
+	}
+}
+
+// ConverterOptionStripJustify removes text-align: justify from inline styles
+// and style elements in content documents so the justification setting on the
+// Kobo isn't overridden. External stylesheets are not modified.
+func ConverterOptionStripJustify() ConverterOption {
+	return func(c *Converter) {
+		c.stripJustify = true
+	}
+}
+
+// ConverterOptionFullBleedCover wraps the image on the cover page (the one
+// referenced by the guide, or one consisting only of the cover image) in an SVG
+// which scales it to fill the screen. This only applies to Convert, since the
+// cover is found using the OPF package document.
+func ConverterOptionFullBleedCover() ConverterOption {
+	return func(c *Converter) {
+		c.fullBleedCover = true
+	}
+}
+
+// ConverterOptionRemoveEmptyElements removes divs and spans which don't have
+// any attributes or content after the other transformations are applied.
+func ConverterOptionRemoveEmptyElements() ConverterOption {
+	return func(c *Converter) {
+		c.removeEmpty = true
+	}
+}
+
+// ConverterOptionXMLDeclaration adds an XML declaration to content documents
+// which don't already have one.
+func ConverterOptionXMLDeclaration() ConverterOption {
+	return func(c *Converter) {
+		c.xmlDeclaration = true
+	}
+}
+
+// ConverterOptionNonBreakingSpace sets the representation of non-breaking
+// spaces in the output content documents. It must be one of "&#160;" (the
+// default), "&#xA0;", or a literal "\u00a0". Note that "&nbsp;" isn't
+// supported, since it isn't defined in XHTML documents without a DTD.
+func ConverterOptionNonBreakingSpace(repr string) ConverterOption {
+	return func(c *Converter) {
+		c.nbsp = repr
+	}
+}
+
+// ConverterOptionMetadataOnly only transforms the OPF package document (e.g.,
+// to add the cover-image property and remove Calibre metadata), and copies
+// content documents as-is. The dummy titlepage, placeholder cover, and generated
+// nav are never added in this mode.
+func ConverterOptionMetadataOnly() ConverterOption {
+	return func(c *Converter) {
+		c.metadataOnly = true
+	}
+}
+
+// ConverterOptionRemoveBase removes <base href> elements from content
+// documents, rewriting relative links to be relative to the document itself if
+// the base is also relative. Links are left as-is for remote bases, since they
+// would otherwise point outside the book.
+func ConverterOptionRemoveBase() ConverterOption {
+	return func(c *Converter) {
+		c.removeBase = true
+	}
+}
+
+// ConverterOptionFootnoteSup wraps links to notes which consist of only a
+// number directly following a word (e.g., "word<a href="#n1">1</a>", common in
+// OCR'd books) in a sup element. This is a heuristic.
+func ConverterOptionFootnoteSup() ConverterOption {
+	return func(c *Converter) {
+		c.footnoteSup = true
+	}
+}
+
+// ConverterOptionContentTitles sets missing or empty content document titles to
+// the text of the first heading in the document. Existing titles are left
+// as-is.
+func ConverterOptionContentTitles() ConverterOption {
+	return func(c *Converter) {
+		c.contentTitles = true
+	}
+}
+
+// ConverterOptionChapterMarkers adds an anchor with the id "kepubify-top" to
+// the start of each content document, and ids to headings without one, so
+// navigation and reading position sync have a consistent target.
+func ConverterOptionChapterMarkers() ConverterOption {
+	return func(c *Converter) {
+		c.chapterMarkers = true
+	}
+}
+
+// ConverterOptionPageList adds an EPUB3 page-list to the navigation document
+// based on the page break markers (epub:type="pagebreak" or
+// role="doc-pagebreak") in the content documents, if it doesn't already have
+// one. This allows print page numbers to be shown.
+func ConverterOptionPageList() ConverterOption {
+	return func(c *Converter) {
+		c.pageList = true
+	}
+}
+
+// ConverterOptionPlaceholderCover adds a generated PNG cover image with the
+// title and author from the metadata to books which don't have a cover (or
+// where it can't be detected).
+func ConverterOptionPlaceholderCover() ConverterOption {
+	return func(c *Converter) {
+		c.placeholderCover = true
+	}
+}
+
+// ConverterOptionGenerateNav adds an EPUB3 navigation document generated from
+// the NCX to EPUB3 books which don't already have one. EPUB2 packages are not
+// changed, since they can't declare a nav.
+func ConverterOptionGenerateNav() ConverterOption {
+	return func(c *Converter) {
+		c.generateNav = true
+	}
+}
+
+// ConverterOptionMaxImageSize downscales JPEG and PNG images larger than w by h
+// pixels to fit, preserving the aspect ratio. Images which already fit are left
+// as-is. See KoboScreenSize for the screen sizes of common devices.
+func ConverterOptionMaxImageSize(w, h int) ConverterOption {
+	return func(c *Converter) {
+		c.maxImageSize = image.Pt(w, h)
+	}
+}
+
+// KoboScreenSize returns the portrait screen resolution of a Kobo eReader
+// model (e.g., "clara-hd", "libra-2", "forma"), for use with
+// ConverterOptionMaxImageSize.
+func KoboScreenSize(model string) (w, h int, ok bool) {
+	if sz, ok := koboScreenSizes[strings.ToLower(model)]; ok {
+		return sz.X, sz.Y, true
+	}
+	return 0, 0, false
+}
+
+// KoboScreenSizeModels returns the models supported by KoboScreenSize.
+func KoboScreenSizeModels() []string {
+	models := make([]string, 0, len(koboScreenSizes))
+	for model := range koboScreenSizes {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+var koboScreenSizes = map[string]image.Point{
+	"touch":     image.Pt(600, 800),
+	"mini":      image.Pt(600, 800),
+	"glo":       image.Pt(758, 1024),
+	"aura":      image.Pt(758, 1024),
+	"nia":       image.Pt(758, 1024),
+	"aura-hd":   image.Pt(1080, 1440),
+	"aura-h2o":  image.Pt(1080, 1430),
+	"glo-hd":    image.Pt(1072, 1448),
+	"clara-hd":  image.Pt(1072, 1448),
+	"clara-2e":  image.Pt(1072, 1448),
+	"libra-h2o": image.Pt(1264, 1680),
+	"libra-2":   image.Pt(1264, 1680),
+	"aura-one":  image.Pt(1404, 1872),
+	"elipsa":    image.Pt(1404, 1872),
+	"forma":     image.Pt(1440, 1920),
+	"sage":      image.Pt(1440, 1920),
+}
+
+// ConverterOptionResolveCSSImports replaces local @import rules in stylesheets
+// with the contents of the imported stylesheet (or with a link element for
+// style elements in content documents), and removes remote ones.
+func ConverterOptionResolveCSSImports() ConverterOption {
+	return func(c *Converter) {
+		c.cssImports = true
+	}
+}
+
+// ConverterOptionKoboOnly removes files, metadata, and attributes which are
+// only used by other reading systems (iBooks display options and attributes,
+// and ADE page templates) for books which will only be read on a Kobo.
+func ConverterOptionKoboOnly() ConverterOption {
+	return func(c *Converter) {
+		c.koboOnly = true
+	}
+}
+
+// ConverterOptionContentCache caches transformed content documents by a hash
+// of their contents, so identical documents (e.g., template-generated chapters,
+// or the same files across books converted by the same Converter) are only
+// transformed once. Once the cached output reaches maxSize bytes, new documents
+// are no longer cached. If maxSize is zero, the cache is unbounded. Documents
+// aren't cached when options which log messages for each document are set.
+func ConverterOptionContentCache(maxSize int64) ConverterOption {
+	return func(c *Converter) {
+		c.contentCache = &contentCache{max: maxSize}
+	}
+}
+
 func converterOptionAddCSS(class, css string) ConverterOption {
 	return func(c *Converter) {
 		c.extraCSS = append(c.extraCSS, css)
@@ -137,6 +740,16 @@ body>div {
     padding-right: 0.2em !important;
 }`
 
+const cssOrphansWidows = `p {
+    orphans: 2;
+    widows: 2;
+}
+
+h1, h2, h3, h4, h5, h6 {
+    page-break-after: avoid;
+    page-break-inside: avoid;
+}`
+
 // These are for use by certain kepubify frontends for progress information
 // during conversions. It is not exported for general use, must be imported via
 // an unsafe go:linkname directive, and is subject to change.
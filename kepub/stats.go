@@ -0,0 +1,163 @@
+package kepub
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"unicode"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// DocumentStats contains statistics about a content document in a KEPUB.
+type DocumentStats struct {
+	File       string
+	Spans      int // number of koboSpans with kobo.PARA.SEG ids
+	Paragraphs int // number of distinct koboSpan paragraphs (PARA in the ids)
+	Words      int // number of whitespace-separated words in the text (excluding pre)
+}
+
+// ContentStats gets statistics for each content document in the KEPUB (or
+// EPUB) root epub, in manifest order. It is mainly useful for spotting
+// documents which weren't segmented correctly (e.g., a document with a single
+// paragraph and thousands of spans). Missing content documents are skipped.
+func ContentStats(epub fs.FS) ([]DocumentStats, error) {
+	opf, err := epubPackage(epub)
+	if err != nil {
+		return nil, fmt.Errorf("content stats: %w", err)
+	}
+
+	cd, err := epubContentDocuments(epub, opf)
+	if err != nil {
+		return nil, fmt.Errorf("content stats: %w", err)
+	}
+
+	var stats []DocumentStats
+	for _, fn := range cd {
+		st, err := documentStats(epub, fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("content stats: %w", err)
+		}
+		stats = append(stats, st)
+	}
+
+	return stats, nil
+}
+
+func documentStats(epub fs.FS, fn string) (DocumentStats, error) {
+	st := DocumentStats{File: fn}
+
+	f, err := epub.Open(fn)
+	if err != nil {
+		return st, fmt.Errorf("open %q: %w", fn, err)
+	}
+	defer f.Close()
+
+	doc, err := html.ParseWithOptions(f,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return st, fmt.Errorf("parse %q: %w", fn, err)
+	}
+
+	body := findAtom(doc, atom.Body)
+	if body == nil {
+		return st, nil
+	}
+
+	paras := map[string]bool{}
+
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, body)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			if matchAttr(cur, "class", "koboSpan") {
+				if id := strings.Split(attrValue(cur, "id"), "."); len(id) == 3 && id[0] == "kobo" {
+					st.Spans++
+					paras[id[1]] = true
+				}
+			}
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+
+	// words can be split across text nodes by koboSpans and inline elements,
+	// so keep track of the state between them
+	var inWord bool
+	walkText(body, func(text string) {
+		for _, r := range text {
+			if unicode.IsSpace(r) {
+				inWord = false
+			} else if !inWord {
+				inWord = true
+				st.Words++
+			}
+		}
+	})
+
+	st.Paragraphs = len(paras)
+	return st, nil
+}
+
+// BookReport summarizes the result of converting a single book.
+type BookReport struct {
+	File   string
+	Error  string          // the conversion error, if any
+	Stats  []DocumentStats // see ContentStats
+	Issues []Issue         // see CheckKoboCompat
+}
+
+// ReportBook gets the BookReport for the converted KEPUB root kepub.
+func ReportBook(file string, kepub fs.FS) (BookReport, error) {
+	r := BookReport{File: file}
+
+	var err error
+	if r.Stats, err = ContentStats(kepub); err != nil {
+		return r, fmt.Errorf("report %q: %w", file, err)
+	}
+	if r.Issues, err = CheckKoboCompat(kepub); err != nil {
+		return r, fmt.Errorf("report %q: %w", file, err)
+	}
+	return r, nil
+}
+
+// BatchReport combines the BookReports for multiple books, with totals for the
+// whole batch. It is intended to be marshaled (e.g., as JSON) for other tools.
+type BatchReport struct {
+	Books []BookReport
+
+	Converted  int // books without an error
+	Failed     int // books with an error
+	Issues     int
+	Documents  int
+	Spans      int
+	Paragraphs int
+	Words      int
+}
+
+// Add adds a book to the report and updates the totals.
+func (r *BatchReport) Add(b BookReport) {
+	r.Books = append(r.Books, b)
+	if b.Error != "" {
+		r.Failed++
+	} else {
+		r.Converted++
+	}
+	r.Issues += len(b.Issues)
+	r.Documents += len(b.Stats)
+	for _, st := range b.Stats {
+		r.Spans += st.Spans
+		r.Paragraphs += st.Paragraphs
+		r.Words += st.Words
+	}
+}
@@ -0,0 +1,137 @@
+package kepub
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+)
+
+func TestContentStats(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		stats, err := ContentStats(overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title></title><style>p { color: black; }</style></head><body><p><span class="koboSpan" id="kobo.1.1">One two. </span><span class="koboSpan" id="kobo.1.2">Th<b>ree</b>.</span></p><p><span class="koboSpan" id="kobo.2.1">Four</span></p><p>Five</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var found bool
+		for _, st := range stats {
+			if st.File == "OEBPS/xhtml/ch01.xhtml" {
+				found = true
+				if exp := (DocumentStats{File: "OEBPS/xhtml/ch01.xhtml", Spans: 3, Paragraphs: 2, Words: 5}); st != exp {
+					t.Errorf("expected %+v, got %+v", exp, st)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("missing stats for ch01")
+		}
+	})
+
+	t.Run("Converted", func(t *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		if err := NewConverter().Convert(context.Background(), buf, testEPUB); err != nil {
+			t.Fatalf("convert: unexpected error: %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("read kepub: unexpected error: %v", err)
+		}
+		stats, err := ContentStats(zr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var n int
+		for _, st := range stats {
+			if st.File == "OEBPS/xhtml/title.xhtml" {
+				continue
+			}
+			n++
+			if st.Spans == 0 || st.Paragraphs == 0 || st.Words == 0 || st.Paragraphs > st.Spans {
+				t.Errorf("unexpected stats for %q: %+v", st.File, st)
+			}
+		}
+		if n < 99 {
+			t.Errorf("expected stats for at least 99 chapters, got %d", n)
+		}
+	})
+}
+
+func TestBatchReport(t *testing.T) {
+	book := func(body string) fstest.MapFS {
+		return fstest.MapFS{
+			"META-INF/container.xml": testEPUB["META-INF/container.xml"],
+			"OEBPS/content.opf": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+		<dc:title>Test</dc:title>
+	</metadata>
+	<manifest>
+		<item id="text" href="text.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+	<spine>
+		<itemref idref="text"/>
+	</spine>
+</package>`)},
+			"OEBPS/text.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title></title></head><body>` + body + `</body></html>`)},
+		}
+	}
+
+	var report BatchReport
+	for _, b := range []struct {
+		File string
+		EPUB fstest.MapFS
+	}{
+		{"one.epub", book(`<p>One two. Three.</p>`)},
+		{"two.epub", book(`<p>Four.</p><p>Five <b>six</b>.</p><img src="https://example.com/img.png"/>`)},
+		{"drm.epub", overlayMapFS(book(`<p>Seven.</p>`), fstest.MapFS{
+			"META-INF/encryption.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+	<enc:EncryptedData>
+		<enc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+		<enc:CipherData>
+			<enc:CipherReference URI="OEBPS/text.xhtml"/>
+		</enc:CipherData>
+	</enc:EncryptedData>
+</encryption>`)},
+		})},
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := NewConverterWithOptions(ConverterOptionDummyTitlepage(false)).Convert(context.Background(), buf, b.EPUB); err != nil {
+			report.Add(BookReport{File: b.File, Error: err.Error()})
+			continue
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("read kepub: unexpected error: %v", err)
+		}
+		br, err := ReportBook(b.File, zr)
+		if err != nil {
+			t.Fatalf("report %q: unexpected error: %v", b.File, err)
+		}
+		report.Add(br)
+	}
+
+	if len(report.Books) != 3 {
+		t.Fatalf("expected 3 books, got %d", len(report.Books))
+	}
+	if report.Books[2].Error == "" {
+		t.Errorf("expected an error for the encrypted book")
+	}
+	var issues int
+	for _, b := range report.Books {
+		issues += len(b.Issues)
+	}
+	if len(report.Books[1].Issues) == 0 {
+		t.Errorf("expected an issue for the remote image")
+	}
+	if report.Converted != 2 || report.Failed != 1 || report.Documents != 2 || report.Spans != 7 || report.Paragraphs != 4 || report.Words != 6 || report.Issues != issues {
+		t.Errorf("unexpected totals: converted=%d failed=%d documents=%d spans=%d paragraphs=%d words=%d issues=%d (expected %d)", report.Converted, report.Failed, report.Documents, report.Spans, report.Paragraphs, report.Words, report.Issues, issues)
+	}
+}
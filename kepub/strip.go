@@ -0,0 +1,107 @@
+package kepub
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// StripKoboSpans is like StripKoboContent, but operates on a string.
+func StripKoboSpans(content string) (string, error) {
+	var b strings.Builder
+	if err := StripKoboContent(&b, strings.NewReader(content)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// StripKoboContent reverts the Kobo-specific changes made to a content document
+// by TransformContent, so it can be edited as a plain EPUB content document.
+// The koboSpans and the div#book-columns > div#book-inner wrappers are
+// unwrapped (keeping their contents as-is), and the Kobo style tweaks are
+// removed. Other optional transformations (e.g., smart punctuation) are not
+// reverted.
+func StripKoboContent(w io.Writer, r io.Reader) error {
+	doc, err := html.ParseWithOptions(r,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return fmt.Errorf("parse html: %w", err)
+	}
+
+	transformContentCharsetUTF8(doc)
+	stripKoboStyles(doc)
+	stripKoboDivs(doc)
+	stripKoboSpans(doc)
+
+	if err := renderProlog(w, doc); err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+
+	if err := html.RenderWithOptions(w, doc,
+		html.RenderOptionAllowXMLDeclarations(true),
+		html.RenderOptionPolyglot(true)); err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+	return nil
+}
+
+// stripKoboStyles removes the style element added by transformContentKoboStyles.
+func stripKoboStyles(doc *html.Node) {
+	head := findAtom(doc, atom.Head)
+	if head == nil {
+		return
+	}
+	for c := head.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && c.DataAtom == atom.Style && (matchAttr(c, "class", "kobostylehacks") || matchAttr(c, "id", "kobostylehacks")) {
+			head.RemoveChild(c)
+		}
+		c = next
+	}
+}
+
+// stripKoboDivs unwraps the divs added by transformContentKoboDivs.
+func stripKoboDivs(doc *html.Node) {
+	for _, id := range []string{"book-columns", "book-inner"} {
+		body := findAtom(doc, atom.Body)
+		if body == nil {
+			return
+		}
+		for c := body.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.DataAtom == atom.Div && matchAttr(c, "id", id) {
+				unwrap(c)
+				break
+			}
+		}
+	}
+}
+
+// stripKoboSpans unwraps the spans added by transformContentKoboSpans.
+func stripKoboSpans(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode {
+			stripKoboSpans(c)
+			if c.DataAtom == atom.Span && matchAttr(c, "class", "koboSpan") {
+				unwrap(c)
+			}
+		}
+		c = next
+	}
+	mergeText(n)
+}
+
+// unwrap replaces n with its children.
+func unwrap(n *html.Node) {
+	for n.FirstChild != nil {
+		c := n.FirstChild
+		n.RemoveChild(c)
+		n.Parent.InsertBefore(c, n)
+	}
+	n.Parent.RemoveChild(n)
+}
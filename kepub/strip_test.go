@@ -0,0 +1,64 @@
+package kepub
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStripKoboSpans(t *testing.T) {
+	const in = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" lang="en">
+	<head>
+		<title>Test</title>
+		<style type="text/css">p { margin: 0; }</style>
+	</head>
+	<body>
+		<h1>Chapter <em>One</em></h1>
+		<p>First sentence. Second one? <span class="x">Third, in a span.</span> </p>
+		<p>Line one<br/>line two</p>
+		<img src="image.png" alt=""/>
+		<ul>
+			<li>Item <a href="#">one</a>.</li>
+			<li>Item two.</li>
+		</ul>
+		<pre>  keep
+  this  </pre>
+	</body>
+</html>`
+
+	kepub := bytes.NewBuffer(nil)
+	if err := NewConverter().TransformContent(kepub, strings.NewReader(in)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	if !strings.Contains(kepub.String(), `class="koboSpan"`) || !strings.Contains(kepub.String(), `id="book-inner"`) || !strings.Contains(kepub.String(), `kobostylehacks`) {
+		t.Fatalf("expected transformed document to have kobo spans, divs, and styles")
+	}
+
+	stripped := bytes.NewBuffer(nil)
+	if err := StripKoboContent(stripped, bytes.NewReader(kepub.Bytes())); err != nil {
+		t.Fatalf("strip: unexpected error: %v", err)
+	}
+	for _, x := range []string{"koboSpan", "book-columns", "book-inner", "kobostylehacks"} {
+		if strings.Contains(stripped.String(), x) {
+			t.Errorf("expected stripped document not to contain %q: %s", x, stripped.String())
+		}
+	}
+	if str, err := StripKoboSpans(kepub.String()); err != nil {
+		t.Errorf("strip string: unexpected error: %v", err)
+	} else if str != stripped.String() {
+		t.Errorf("expected StripKoboSpans to match StripKoboContent:\n%s\n%s", str, stripped)
+	}
+
+	a, b := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	if err := Canonicalize(a, strings.NewReader(in)); err != nil {
+		t.Fatalf("canonicalize original: unexpected error: %v", err)
+	}
+	if err := Canonicalize(b, stripped); err != nil {
+		t.Fatalf("canonicalize stripped: unexpected error: %v", err)
+	}
+	if a.String() != b.String() {
+		t.Errorf("expected stripped document to match the original:\n%s\n%s", a, b)
+	}
+}
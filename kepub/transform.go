@@ -1,13 +1,26 @@
 package kepub
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/fs"
+	"math"
 	"mime"
+	"net/url"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -16,6 +29,7 @@ import (
 	"github.com/beevik/etree"
 	"github.com/kr/smartypants"
 	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
 	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
@@ -32,7 +46,14 @@ import (
 //
 //  * [extra] remove Windows metadata
 //
+//  * [optional] remove iBooks display options and ADE page templates
+//
 func (c *Converter) TransformFileFilter(fn string) bool {
+	if c.koboOnly {
+		if fn == "META-INF/com.apple.ibooks.display-options.xml" || strings.EqualFold(path.Ext(fn), ".xpgt") {
+			return true
+		}
+	}
 	switch path.Base(fn) {
 	case "calibre_bookmarks.txt": // Calibre
 		return true
@@ -57,19 +78,77 @@ func (c *Converter) TransformFileFilter(fn string) bool {
 //    cover (`manifest>item[properties="cover-image"]`), but most older EPUBs
 //    will reference the manifest item with a meta element like
 //    `meta[name="cover"][content="{manifest-item-id}"]`. or just set the
-//    manifest item ID to `cover` instead of using `properties`.
+//    manifest item ID to `cover` instead of using `properties`. If neither is
+//    present, Convert also falls back to the image on the cover page
+//    referenced by the EPUB2 guide.
 //
 //  * [extra] remove unnecessary Calibre metadata.
 //    Removes extraneous metadata elements commonly added by Calibre.
 //
+//  * [optional] remove blocked media types.
+//    Removes manifest items (and the spine itemrefs referencing them) with a
+//    media type blocked by ConverterOptionBlockMediaType. The files themselves
+//    are removed by Convert.
+//
+//  * [optional] add extracted data URIs.
+//    Adds manifest items for the images extracted from data URIs by Convert
+//    (see ConverterOptionExtractDataURIs).
+//
+//  * [optional] add placeholder cover.
+//    Adds the placeholder cover generated by Convert for books without a
+//    cover (see ConverterOptionPlaceholderCover).
+//
+//  * [optional] remove other reading system hints.
+//    Removes iBooks metadata and ADE page templates (see
+//    ConverterOptionKoboOnly).
+//
 func (c *Converter) TransformOPF(w io.Writer, r io.Reader) error {
+	return c.transformOPF(w, r, opfAdditions{})
+}
+
+// opfAdditions are changes to the OPF which depend on the other files in the
+// EPUB, and are only made by Convert.
+type opfAdditions struct {
+	GuideCover       string        // manifest item ID (see epubGuideCover)
+	DataURIs         []dataURIFile // with names relative to the OPF
+	PlaceholderCover string        // href relative to the OPF
+	GeneratedNav     string        // href relative to the OPF
+}
+
+// transformOPF is like TransformOPF, but also applies the additions.
+func (c *Converter) transformOPF(w io.Writer, r io.Reader, add opfAdditions) error {
 	doc := etree.NewDocument()
 	if _, err := doc.ReadFrom(r); err != nil {
 		return fmt.Errorf("parse: %w", err)
 	}
 
 	transformOPFCoverImage(doc) // mandatory
+	if add.GuideCover != "" {
+		transformOPFGuideCover(doc, add.GuideCover)
+	}
 	transformOPFCalibreMeta(doc)
+	transformOPFSeries(doc)
+
+	if c.koboOnly {
+		transformOPFKoboOnly(doc)
+	}
+
+	if len(c.blockMediaTypes) != 0 {
+		transformOPFBlockMediaTypes(doc, c.isBlockedMediaType)
+	}
+
+	if len(add.DataURIs) != 0 {
+		transformOPFDataURIs(doc, add.DataURIs)
+	}
+
+	if add.PlaceholderCover != "" {
+		transformOPFPlaceholderCover(doc, add.PlaceholderCover)
+	}
+
+	if add.GeneratedNav != "" {
+		transformOPFGeneratedNav(doc, add.GeneratedNav)
+	}
+
 	doc.Indent(4)
 
 	if _, err := doc.WriteTo(w); err != nil {
@@ -81,13 +160,48 @@ func (c *Converter) TransformOPF(w io.Writer, r io.Reader) error {
 
 func transformOPFCoverImage(doc *etree.Document) {
 	// property based on Kobo (checked with 3 books) as of 2020-01-12
+	if opfCoverImageItem(doc) != nil {
+		return // already declared (e.g., EPUB3)
+	}
+	if el := opfCoverItem(doc); el != nil && el.Tag == "item" {
+		addOPFItemProperty(el, "cover-image")
+	}
+}
+
+// transformOPFGuideCover adds the cover-image property to the manifest item
+// with the specified ID if no item has it yet.
+func transformOPFGuideCover(doc *etree.Document, id string) {
+	if opfCoverImageItem(doc) != nil {
+		return
+	}
+	for _, el := range doc.FindElements("//manifest/item[@id]") {
+		if el.SelectAttrValue("id", "") == id {
+			addOPFItemProperty(el, "cover-image")
+			return
+		}
+	}
+}
+
+// addOPFItemProperty adds prop to the properties of the manifest item el,
+// keeping the existing ones.
+func addOPFItemProperty(el *etree.Element, prop string) {
+	if props := el.SelectAttrValue("properties", ""); props != "" {
+		if !includes(props, prop) {
+			el.CreateAttr("properties", props+" "+prop)
+		}
+	} else {
+		el.CreateAttr("properties", prop)
+	}
+}
+
+// opfCoverItem finds the manifest item referenced by the legacy cover meta
+// element, or the item with the ID "cover" if there isn't one.
+func opfCoverItem(doc *etree.Document) *etree.Element {
 	coverID := "cover"
 	if el := doc.FindElement("//meta[@name='cover']"); el != nil {
 		coverID = el.SelectAttrValue("content", coverID)
 	}
-	if el := doc.FindElement("//[@id='" + coverID + "']"); el != nil {
-		el.CreateAttr("properties", "cover-image")
-	}
+	return doc.FindElement("//[@id='" + coverID + "']")
 }
 
 func transformOPFCalibreMeta(doc *etree.Document) {
@@ -99,152 +213,1959 @@ func transformOPFCalibreMeta(doc *etree.Document) {
 	}
 }
 
-// TransformContent transforms an HTML4/HTML5/XHTML1.1 document for a KEPUB.
-//
-//  * [important] parses the XHTML with XHTML/XML/HTML4/HTML5-compatible rules
-//    Quite a few books have invalid XHTML, and this prevents the markup from
-//    being mangled any more than absolutely necessary. This also has the side
-//    effect of fixing bad markup when combined with the render step at the end.
-//    The intention is to match or exceed the kepub renderer's leniency. This
-//    lenient parsing is also why kepubify often works better with badly-formed
-//    HTML than Calibre. See the documentation in the x/net/html fork for more
-//    information about how this works.
-//
-//    The most important changes to default HTML5 parsing rules are to allow
-//    more tags to be self-closing, to ignore UTF-8 byte order marks, and to
-//    preserve XML instructions.
-//
-//  * [mandatory] add Kobo style tweaks
-//    To match official KEPUBs.
-//
-//  * [mandatory] add Kobo div wrappers
-//    To match official KEPUBs. Kobo wraps the body with two div tags,
-//    `div#book-columns > div#book-inner`, to provide a target for applying
-//    pagination styles.
-//
-//  * [mandatory] add Kobo spans
-//    To match official KEPUBs. Kobo adds spans surrounding each fragment (see
-//    the regexp and matching logic) to provide better references to chunks of
-//    text. Highlighting, bookmarking, and other related features don't work
-//    without this.
-//
-//  * [optional] add extra CSS
-//    For customization or to fix common issues.
-//
-//  * [optional] smarten punctuation
-//    A common tweak to improve badly-formatted books.
-//
-//  * [extra] content cleanup
-//    Removes Adept tags, extraneous MS Office tags, Unicode replacement chars,
-//    etc.
-//
-//  * [important] renders the HTML as polyglot XHTML/HTML4/HTML5
-//    The HTML is rendered for maximum compatibility and to be as close to the
-//    original HTML as possible. See the documentation in the x/net/html fork
-//    for more information about how this works.
-//
-//    The most important aspects are: the use of &#160; for non-breaking spaces,
-//    always specifying xmlns on html/math/svg, always specifying a type on
-//    script and style, always specifying a value for boolean attributes, always
-//    adding a closing slash to void elements, never self-closing non-void
-//    elements, only using XML-defined named escapes `<>&`, only using
-//    HTML-style comments, ensuring table contents are well-formed, and
-//    preserving the XML declaration if in the original code.
-//
-//  * [optional] find/replace
-//    To allow users to apply quick one-off fixes to the generated HTML.
-//
-//  * [important] ensure charset is UTF-8
-//    EPUBs (and KEPUBs by extension) must be UTF-8/UTF-16.
-//
-func (c *Converter) TransformContent(w io.Writer, r io.Reader) error {
-	switch strings.ToLower(c.charset) {
-	case "utf-8", "":
-		// do nothing
-	case "auto":
-		cr, err := charset.NewReader(r, "")
-		if err != nil {
-			return fmt.Errorf("parse html: detect charset: %w", err)
+// transformOPFSeries adds EPUB3 belongs-to-collection metadata for the
+// calibre:series and calibre:series_index meta elements if the package is EPUB3
+// and doesn't already have a series collection. The calibre meta elements are
+// kept for older firmware versions.
+func transformOPFSeries(doc *etree.Document) {
+	pkg := doc.SelectElement("package")
+	if pkg == nil || !strings.HasPrefix(pkg.SelectAttrValue("version", ""), "3") {
+		return
+	}
+	md := pkg.SelectElement("metadata")
+	if md == nil {
+		return
+	}
+
+	var series, index string
+	for _, el := range md.SelectElements("meta") {
+		switch el.SelectAttrValue("name", "") {
+		case "calibre:series":
+			series = strings.TrimSpace(el.SelectAttrValue("content", ""))
+		case "calibre:series_index":
+			index = strings.TrimSpace(el.SelectAttrValue("content", ""))
 		}
-		r = cr
-	default:
-		enc, _ := charset.Lookup(c.charset)
-		if enc == nil {
-			return fmt.Errorf("parset html: invalid charset %q", c.charset)
+		if el.SelectAttrValue("property", "") == "belongs-to-collection" {
+			return
 		}
-		r = enc.NewDecoder().Reader(r)
+	}
+	if series == "" {
+		return
 	}
 
-	doc, err := html.ParseWithOptions(r,
-		html.ParseOptionEnableScripting(true),
-		html.ParseOptionIgnoreBOM(true),
-		html.ParseOptionLenientSelfClosing(true))
+	meta := func(property, refines, value string) *etree.Element {
+		el := md.CreateElement("meta")
+		el.Space = md.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		if refines != "" {
+			el.CreateAttr("refines", refines)
+		}
+		el.CreateAttr("property", property)
+		el.SetText(value)
+		return el
+	}
+	meta("belongs-to-collection", "", series).CreateAttr("id", "kepubify-series")
+	meta("collection-type", "#kepubify-series", "series")
+	if index != "" {
+		meta("group-position", "#kepubify-series", index)
+	}
+}
+
+// transformOPFKoboOnly removes iBooks metadata (e.g., ibooks:specified-fonts)
+// and ADE page templates from the OPF.
+func transformOPFKoboOnly(doc *etree.Document) {
+	for _, el := range doc.FindElements("//metadata/meta[@property]") {
+		if strings.HasPrefix(el.SelectAttrValue("property", ""), "ibooks:") {
+			el.Parent().RemoveChild(el)
+		}
+	}
+	for _, el := range doc.FindElements("//manifest/item") {
+		if el.SelectAttrValue("media-type", "") == "application/vnd.adobe-page-template+xml" || strings.EqualFold(path.Ext(el.SelectAttrValue("href", "")), ".xpgt") {
+			el.Parent().RemoveChild(el)
+		}
+	}
+	if pkg := doc.SelectElement("package"); pkg != nil {
+		if a := pkg.SelectAttr("prefix"); a != nil {
+			// prefix is a list of "prefix: uri" pairs
+			var prefixes []string
+			f := strings.Fields(a.Value)
+			for i := 0; i < len(f); i++ {
+				if i+1 < len(f) && strings.HasSuffix(f[i], ":") {
+					if f[i] != "ibooks:" {
+						prefixes = append(prefixes, f[i]+" "+f[i+1])
+					}
+					i++
+				}
+			}
+			if len(prefixes) == 0 {
+				pkg.RemoveAttr("prefix")
+			} else {
+				a.Value = strings.Join(prefixes, " ")
+			}
+		}
+	}
+}
+
+func transformOPFBlockMediaTypes(doc *etree.Document, blocked func(mediaType string) bool) {
+	ids := map[string]bool{}
+	for _, el := range doc.FindElements("//manifest/item[@media-type]") {
+		if blocked(el.SelectAttrValue("media-type", "")) {
+			if id := el.SelectAttrValue("id", ""); id != "" {
+				ids[id] = true
+			}
+			el.Parent().RemoveChild(el)
+		}
+	}
+	for _, el := range doc.FindElements("//spine/itemref[@idref]") {
+		if ids[el.SelectAttrValue("idref", "")] {
+			el.Parent().RemoveChild(el)
+		}
+	}
+}
+
+// transformOPFDataURIs adds manifest items (relative to the OPF) for the images
+// extracted from data URIs, skipping ones which are already there.
+func transformOPFDataURIs(doc *etree.Document, files []dataURIFile) {
+	manifest := doc.FindElement("//manifest")
+	if manifest == nil {
+		return
+	}
+	for _, f := range files {
+		if manifest.FindElement("item[@href='"+f.Name+"']") != nil {
+			continue
+		}
+		it := manifest.CreateElement("item")
+		it.CreateAttr("id", strings.TrimSuffix(path.Base(f.Name), path.Ext(f.Name)))
+		it.CreateAttr("href", f.Name)
+		it.CreateAttr("media-type", f.MediaType)
+	}
+}
+
+func transformOPFPlaceholderCover(doc *etree.Document, href string) {
+	manifest := doc.FindElement("//manifest")
+	if manifest == nil {
+		return
+	}
+	it := manifest.CreateElement("item")
+	it.CreateAttr("id", "kepubify-cover")
+	it.CreateAttr("href", href)
+	it.CreateAttr("media-type", "image/png")
+	it.CreateAttr("properties", "cover-image")
+
+	// for EPUB2 readers
+	if el := doc.FindElement("//meta[@name='cover']"); el != nil {
+		el.CreateAttr("content", "kepubify-cover")
+	} else if md := doc.FindElement("//metadata"); md != nil {
+		el := md.CreateElement("meta")
+		el.CreateAttr("name", "cover")
+		el.CreateAttr("content", "kepubify-cover")
+	}
+}
+
+// transformOPFGeneratedNav adds the generated nav to the manifest. The nav
+// property is only valid in EPUB3, so EPUB2 packages are left as-is.
+func transformOPFGeneratedNav(doc *etree.Document, href string) {
+	pkg := doc.SelectElement("package")
+	if pkg == nil || !strings.HasPrefix(pkg.SelectAttrValue("version", ""), "3") {
+		return
+	}
+	manifest := pkg.SelectElement("manifest")
+	if manifest == nil {
+		return
+	}
+	id := "kepubify-nav"
+	for i := 2; doc.FindElement("//*[@id='"+id+"']") != nil; i++ {
+		id = "kepubify-nav-" + strconv.Itoa(i)
+	}
+	it := manifest.CreateElement("item")
+	it.CreateAttr("id", id)
+	it.CreateAttr("href", href)
+	it.CreateAttr("media-type", "application/xhtml+xml")
+	it.CreateAttr("properties", "nav")
+}
+
+// isBlockedMediaType checks if the media type matches one blocked by
+// ConverterOptionBlockMediaType.
+func (c *Converter) isBlockedMediaType(mediaType string) bool {
+	if i := strings.IndexByte(mediaType, ';'); i != -1 {
+		mediaType = mediaType[:i]
+	}
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, b := range c.blockMediaTypes {
+		if b == mediaType || (strings.HasSuffix(b, "/*") && strings.HasPrefix(mediaType, b[:len(b)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformCSS resolves the @import rules in the stylesheet fn (read from r)
+// from the EPUB. Remote imports are removed, and local ones are replaced with
+// the contents of the imported stylesheet (wrapped in @media if the import had
+// media queries), with the relative URLs in it updated. Imports which can't be
+// resolved are left as-is (and are kept before the inlined stylesheets, since
+// @import rules must come first), and circular ones are removed.
+func transformCSS(w io.Writer, r io.Reader, epub fs.FS, fn string) error {
+	buf, err := io.ReadAll(r)
 	if err != nil {
-		return fmt.Errorf("parse html: %w", err)
+		return fmt.Errorf("read: %w", err)
+	}
+	_, err = w.Write(resolveCSSImports(epub, fn, buf, map[string]bool{fn: true}))
+	return err
+}
+
+// cssImportRe matches a CSS comment or @import rule, with the URL in one of the
+// first five submatches (depending on the quoting), and the media queries in the
+// sixth.
+var cssImportRe = regexp.MustCompile(`/\*[\s\S]*?\*/|@import\s+(?:url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)|"([^"]*)"|'([^']*)')([^;]*);?`)
+
+// cssURLRe matches a CSS url(), with the URL in one of the three submatches.
+var cssURLRe = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+
+// cssImports calls fn for each @import rule in css (outside comments),
+// replacing it with the returned string if fn returns true.
+func cssImports(css []byte, fn func(href, media string) (string, bool)) []byte {
+	return cssImportRe.ReplaceAllFunc(css, func(rule []byte) []byte {
+		if bytes.HasPrefix(rule, []byte("/*")) {
+			return rule
+		}
+		m := cssImportRe.FindSubmatch(rule)
+		href := string(m[1]) + string(m[2]) + string(m[3]) + string(m[4]) + string(m[5])
+		if r, ok := fn(href, strings.TrimSpace(string(m[6]))); ok {
+			return []byte(r)
+		}
+		return rule
+	})
+}
+
+// resolveCSSImports replaces the imports in css (from the file fn) as described
+// in transformCSS, skipping the files in seen.
+func resolveCSSImports(epub fs.FS, fn string, css []byte, seen map[string]bool) []byte {
+	// the resolved imports are replaced with a marker, then the inlined
+	// stylesheets are inserted after the last import
+	const marker = "\x00"
+	var inlined []string
+	css = cssImports(css, func(href, media string) (string, bool) {
+		if isRemoteURL(href) {
+			return "", true
+		}
+		u, err := url.Parse(href)
+		if err != nil || u.Scheme != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+			return "", false
+		}
+
+		imp := path.Join(path.Dir(fn), u.Path)
+		if seen[imp] {
+			return "", true
+		}
+		buf, err := fs.ReadFile(epub, imp)
+		if err != nil {
+			return "", false
+		}
+		seen[imp] = true
+		buf = resolveCSSImports(epub, imp, buf, seen)
+		delete(seen, imp)
+
+		// make the URLs relative to the importing stylesheet
+		if dir := path.Dir(u.Path); dir != "." {
+			buf = cssURLRe.ReplaceAllFunc(buf, func(m []byte) []byte {
+				sm := cssURLRe.FindSubmatch(m)
+				ref := string(sm[1]) + string(sm[2]) + string(sm[3])
+				if r, err := url.Parse(ref); err != nil || r.Scheme != "" || r.Path == "" || strings.HasPrefix(ref, "/") {
+					return m
+				}
+				return []byte(`url("` + path.Clean(dir+"/"+ref) + `")`)
+			})
+		}
+
+		if media != "" {
+			inlined = append(inlined, "@media "+media+" {\n"+string(buf)+"\n}")
+		} else {
+			inlined = append(inlined, string(buf))
+		}
+		return marker, true
+	})
+	if len(inlined) == 0 {
+		return css
+	}
+
+	end := bytes.LastIndex(css, []byte(marker)) + len(marker)
+	for _, m := range cssImportRe.FindAllIndex(css, -1) {
+		if m[1] > end && !bytes.HasPrefix(css[m[0]:], []byte("/*")) {
+			end = m[1]
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(bytes.ReplaceAll(css[:end], []byte(marker), nil))
+	for _, x := range inlined {
+		b.WriteString("\n")
+		b.WriteString(x)
+	}
+	b.Write(css[end:])
+	return b.Bytes()
+}
+
+// transformNCX updates an EPUB2 NCX to match structural changes to the book.
+// Nav points, page targets, and nav targets pointing to files for which
+// removed returns true (src is relative to the NCX, without the fragment) are
+// removed.
+func transformNCX(w io.Writer, r io.Reader, removed func(src string) bool) error {
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(r); err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	transformNCXRemoveTargets(doc, removed)
+
+	doc.Indent(4)
+
+	if _, err := doc.WriteTo(w); err != nil {
+		return fmt.Errorf("render: %w", err)
+	}
+
+	return nil
+}
+
+func transformNCXRemoveTargets(doc *etree.Document, removed func(src string) bool) {
+	isRemoved := func(el *etree.Element) bool {
+		if content := el.SelectElement("content"); content != nil {
+			src := content.SelectAttrValue("src", "")
+			if i := strings.IndexByte(src, '#'); i != -1 {
+				src = src[:i]
+			}
+			return removed(src)
+		}
+		return false
+	}
+
+	var walk func(el *etree.Element)
+	walk = func(el *etree.Element) {
+		for _, c := range el.ChildElements() {
+			walk(c) // so the children are filtered before being moved up
+			switch c.Tag {
+			case "navPoint":
+				if isRemoved(c) {
+					// replace it with its children
+					i := c.Index()
+					for _, cc := range c.SelectElements("navPoint") {
+						c.RemoveChild(cc)
+						el.InsertChildAt(i, cc)
+						i++
+					}
+					el.RemoveChild(c)
+				}
+			case "pageTarget", "navTarget":
+				if isRemoved(c) {
+					el.RemoveChild(c)
+				}
+			}
+		}
+	}
+	if root := doc.Root(); root != nil {
+		walk(root)
+		transformNCXPlayOrder(root)
+	}
+}
+
+// transformNCXPlayOrder renumbers playOrder attributes to be consecutive while
+// keeping the existing order (including duplicates for the same target).
+func transformNCXPlayOrder(root *etree.Element) {
+	var attrs []*etree.Attr
+	var walk func(el *etree.Element)
+	walk = func(el *etree.Element) {
+		for _, c := range el.ChildElements() {
+			if a := c.SelectAttr("playOrder"); a != nil {
+				attrs = append(attrs, a)
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+
+	var orders []int
+	for _, a := range attrs {
+		if n, err := strconv.Atoi(strings.TrimSpace(a.Value)); err == nil {
+			orders = append(orders, n)
+		}
+	}
+	sort.Ints(orders)
+
+	renumber := map[int]int{}
+	for _, n := range orders {
+		if _, ok := renumber[n]; !ok {
+			renumber[n] = len(renumber) + 1
+		}
+	}
+	for _, a := range attrs {
+		if n, err := strconv.Atoi(strings.TrimSpace(a.Value)); err == nil {
+			a.Value = strconv.Itoa(renumber[n])
+		}
+	}
+}
+
+// generatedNavName is the name of the navigation document generated by Convert,
+// relative to the OPF package document.
+const generatedNavName = "kepubify-nav.xhtml"
+
+// generateNav generates a minimal EPUB3 navigation document from an EPUB2 NCX.
+// The navMap becomes the toc nav, and the pageList (if any) becomes a hidden
+// page-list nav. The href function gets the href for a content src (relative
+// to the NCX, with the fragment), or an empty string to leave the entry
+// unlinked.
+func generateNav(w io.Writer, r io.Reader, href func(src string) string) error {
+	ncx := etree.NewDocument()
+	if _, err := ncx.ReadFrom(r); err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	label := func(el *etree.Element) string {
+		if t := el.FindElement("navLabel/text"); t != nil {
+			return strings.Join(strings.Fields(t.Text()), " ")
+		}
+		return ""
+	}
+
+	entry := func(ol, el *etree.Element) *etree.Element {
+		li := ol.CreateElement("li")
+		var src string
+		if content := el.SelectElement("content"); content != nil {
+			src = href(content.SelectAttrValue("src", ""))
+		}
+		if src != "" {
+			a := li.CreateElement("a")
+			a.CreateAttr("href", src)
+			a.SetText(label(el))
+		} else {
+			li.CreateElement("span").SetText(label(el))
+		}
+		return li
+	}
+
+	var points func(ol, el *etree.Element)
+	points = func(ol, el *etree.Element) {
+		for _, c := range el.SelectElements("navPoint") {
+			li := entry(ol, c)
+			if len(c.SelectElements("navPoint")) != 0 {
+				points(li.CreateElement("ol"), c)
+			}
+		}
+	}
+
+	title := "Contents"
+	if t := ncx.FindElement("//docTitle/text"); t != nil {
+		if s := strings.Join(strings.Fields(t.Text()), " "); s != "" {
+			title = s
+		}
+	}
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="utf-8"`)
+	doc.CreateDirective("DOCTYPE html")
+
+	root := doc.CreateElement("html")
+	root.CreateAttr("xmlns", "http://www.w3.org/1999/xhtml")
+	root.CreateAttr("xmlns:epub", "http://www.idpf.org/2007/ops")
+	root.CreateElement("head").CreateElement("title").SetText(title)
+	body := root.CreateElement("body")
+
+	toc := body.CreateElement("nav")
+	toc.CreateAttr("epub:type", "toc")
+	toc.CreateAttr("id", "toc")
+	toc.CreateElement("h1").SetText(title)
+	if navMap := ncx.FindElement("//navMap"); navMap != nil {
+		points(toc.CreateElement("ol"), navMap)
+	}
+
+	if pageList := ncx.FindElement("//pageList"); pageList != nil {
+		if targets := pageList.SelectElements("pageTarget"); len(targets) != 0 {
+			nav := body.CreateElement("nav")
+			nav.CreateAttr("epub:type", "page-list")
+			nav.CreateAttr("hidden", "hidden")
+			ol := nav.CreateElement("ol")
+			for _, el := range targets {
+				entry(ol, el)
+			}
+		}
+	}
+
+	doc.Indent(4)
+
+	if _, err := doc.WriteTo(w); err != nil {
+		return fmt.Errorf("render: %w", err)
+	}
+
+	return nil
+}
+
+// pageListEntry is an entry in an EPUB3 page-list.
+type pageListEntry struct {
+	Href  string
+	Label string
+}
+
+// transformNav updates an EPUB3 navigation document. If it doesn't already
+// have a page-list, one is added with the provided entries (with hrefs relative
+// to the navigation document).
+func transformNav(w io.Writer, r io.Reader, pages []pageListEntry) error {
+	doc, err := html.ParseWithOptions(r,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return fmt.Errorf("parse html: %w", err)
+	}
+
+	transformNavPageList(doc, pages)
+
+	if err := html.RenderWithOptions(w, doc,
+		html.RenderOptionAllowXMLDeclarations(true),
+		html.RenderOptionPolyglot(true)); err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+	return nil
+}
+
+// transformContentDeadLinks calls dead with the href of each link, removing it
+// if remove is true and dead returns true.
+func transformContentDeadLinks(n *html.Node, dead func(href string) bool, remove bool) {
+	if n.Type == html.ElementNode && n.DataAtom == atom.A {
+		for i := 0; i < len(n.Attr); i++ {
+			if a := n.Attr[i]; a.Namespace == "" && a.Key == "href" && dead(a.Val) && remove {
+				n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+				i--
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		transformContentDeadLinks(c, dead, remove)
+	}
+}
+
+// contentIDs gets the ids of the elements under n, including the names of
+// legacy a elements, which can also be used as fragment identifiers.
+func contentIDs(n *html.Node, ids map[string]bool) {
+	if n.Type == html.ElementNode {
+		if id := attrValue(n, "id"); id != "" {
+			ids[id] = true
+		}
+		if n.DataAtom == atom.A {
+			if name := attrValue(n, "name"); name != "" {
+				ids[name] = true
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		contentIDs(c, ids)
+	}
+}
+
+func transformNavPageList(doc *html.Node, pages []pageListEntry) {
+	if len(pages) == 0 {
+		return
+	}
+
+	body := findAtom(doc, atom.Body)
+	if body == nil {
+		return
+	}
+
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, body)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode && cur.DataAtom == atom.Nav && includes(attrValue(cur, "epub:type"), "page-list") {
+			return // already has one
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+
+	ol := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Ol,
+		Data:     "ol",
+	}
+	for _, pg := range pages {
+		li := &html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.Li,
+			Data:     "li",
+		}
+		li.AppendChild(withText(&html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.A,
+			Data:     "a",
+			Attr:     []html.Attribute{{Key: "href", Val: pg.Href}},
+		}, pg.Label))
+		ol.AppendChild(li)
+	}
+
+	nav := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Nav,
+		Data:     "nav",
+		Attr: []html.Attribute{
+			{Key: "epub:type", Val: "page-list"},
+			{Key: "hidden", Val: "hidden"},
+		},
+	}
+	nav.AppendChild(ol)
+	body.AppendChild(nav)
+}
+
+// contentPageBreaks finds the page break markers (elements with an epub:type of
+// pagebreak or a role of doc-pagebreak) with an ID in a content document. The
+// hrefs of the returned entries are fragments. The label is taken from the
+// title or aria-label attributes, or the text, and markers without one are
+// skipped.
+func contentPageBreaks(doc *html.Node) []pageListEntry {
+	var pages []pageListEntry
+
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode && (includes(attrValue(cur, "epub:type"), "pagebreak") || includes(attrValue(cur, "role"), "doc-pagebreak")) {
+			if id := attrValue(cur, "id"); id != "" {
+				label := strings.TrimSpace(attrValue(cur, "title"))
+				if label == "" {
+					label = strings.TrimSpace(attrValue(cur, "aria-label"))
+				}
+				if label == "" {
+					label = strings.Join(strings.Fields(textContent(cur)), " ")
+				}
+				if label != "" {
+					pages = append(pages, pageListEntry{Href: "#" + id, Label: label})
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+
+	return pages
+}
+
+// TransformContent transforms an HTML4/HTML5/XHTML1.1 document for a KEPUB.
+//
+//  * [important] parses the XHTML with XHTML/XML/HTML4/HTML5-compatible rules
+//    Quite a few books have invalid XHTML, and this prevents the markup from
+//    being mangled any more than absolutely necessary. This also has the side
+//    effect of fixing bad markup when combined with the render step at the end.
+//    The intention is to match or exceed the kepub renderer's leniency. This
+//    lenient parsing is also why kepubify often works better with badly-formed
+//    HTML than Calibre. See the documentation in the x/net/html fork for more
+//    information about how this works.
+//
+//    The most important changes to default HTML5 parsing rules are to allow
+//    more tags to be self-closing, to ignore UTF-8 byte order marks, and to
+//    preserve XML instructions.
+//
+//  * [optional] remove base element
+//    Removes <base href> and rewrites relative links to be relative to the
+//    document itself (for relative bases), since the base element isn't
+//    handled well.
+//
+//  * [optional] fix mojibake
+//    Repairs common sequences caused by UTF-8 text being decoded as
+//    Windows-1252 (e.g. `â€™` instead of `’`) in text nodes. Only a fixed set
+//    of punctuation and accented Latin letters are replaced.
+//
+//  * [optional] normalize unicode
+//    Converts text to Unicode Normalization Form C (e.g., e followed by a
+//    combining acute accent to é) so search and sentence splitting work
+//    consistently.
+//
+//  * [optional] extract data URIs
+//    Replaces images embedded as data URIs with references to separate files
+//    (which are added by Convert) to reduce the size of the content document.
+//
+//  * [optional] content document titles
+//    Sets missing or empty titles to the text of the first heading, since some
+//    validators and readers expect a title.
+//
+//  * [optional] chapter markers
+//    Adds an anchor with an id to the top of the body, and ids to headings
+//    without one, to give navigation and reading position sync a consistent
+//    target.
+//
+//  * [optional] relative font sizes
+//    Converts absolute (px/pt) font sizes in inline styles to em so Kobo's font
+//    size setting still works.
+//
+//  * [optional] strip justification
+//    Removes text-align: justify from inline styles and style elements so the
+//    Kobo justification setting is used.
+//
+//  * [optional] check dead links
+//    Reports (and optionally removes) links to files or ids which don't exist
+//    in the book. This is only done by Convert, since it depends on the rest of
+//    the book.
+//
+//  * [optional] video poster fallback
+//    Replaces videos which were removed by the media type blocklist with their
+//    poster image so the page isn't left blank.
+//
+//  * [optional] full-bleed cover
+//    Replaces the contents of the cover page (if it consists of a single
+//    image) with an SVG wrapper which scales it to fill the screen. This is
+//    only done by Convert, since it depends on the rest of the book.
+//
+//  * [optional] superscript footnote references
+//    Wraps links to notes consisting only of a number directly after a word
+//    (e.g., from OCR) in a sup element.
+//
+//  * [optional] flatten redundant spans
+//    Some converters wrap nearly every word in a styled span, which results in
+//    an excessive number of koboSpans. Attribute-less spans are unwrapped, and
+//    adjacent spans with identical attributes are merged.
+//
+//  * [important] add Kobo style tweaks
+//    To match official KEPUBs. Can be disabled with ConverterOptionNoKoboStyles.
+//
+//  * [important] add Kobo div wrappers
+//    To match official KEPUBs. Kobo wraps the body with two div tags,
+//    `div#book-columns > div#book-inner`, to provide a target for applying
+//    pagination styles. Can be disabled with ConverterOptionNoKoboDivs.
+//
+//  * [important] add Kobo spans
+//    To match official KEPUBs. Kobo adds spans surrounding each fragment (see
+//    the regexp and matching logic) to provide better references to chunks of
+//    text. Highlighting, bookmarking, and other related features don't work
+//    without this. Can be disabled with ConverterOptionNoKoboSpans.
+//
+//  * [optional] add extra CSS
+//    For customization or to fix common issues.
+//
+//  * [optional] smarten punctuation
+//    A common tweak to improve badly-formatted books.
+//
+//  * [extra] content cleanup
+//    Removes Adept tags, extraneous MS Office tags, Unicode replacement chars,
+//    etc.
+//
+//  * [optional] remove other reading system hints
+//    Removes iBooks attributes and links to ADE page templates.
+//
+//  * [optional] remove empty elements
+//    Removes divs and spans without any attributes or content.
+//
+//  * [optional] add XML declaration
+//    For stricter XHTML parsers, adds an XML declaration if there isn't one.
+//
+//  * [important] renders the HTML as polyglot XHTML/HTML4/HTML5
+//    The HTML is rendered for maximum compatibility and to be as close to the
+//    original HTML as possible. See the documentation in the x/net/html fork
+//    for more information about how this works.
+//
+//    The most important aspects are: the use of &#160; for non-breaking spaces,
+//    always specifying xmlns on html/math/svg, always specifying a type on
+//    script and style, always specifying a value for boolean attributes, always
+//    adding a closing slash to void elements, never self-closing non-void
+//    elements, only using XML-defined named escapes `<>&`, only using
+//    HTML-style comments, ensuring table contents are well-formed, and
+//    preserving the XML declaration if in the original code.
+//
+//  * [optional] non-breaking space representation
+//    For readers which expect &#xA0; or a literal U+00A0 instead of &#160;.
+//
+//  * [optional] find/replace
+//    To allow users to apply quick one-off fixes to the generated HTML.
+//
+//  * [important] ensure charset is UTF-8
+//    EPUBs (and KEPUBs by extension) must be UTF-8/UTF-16.
+//
+//  * [optional] normalize charset declaration
+//    Replaces all meta[charset] and meta[http-equiv="content-type"] elements
+//    with a single meta[charset="UTF-8"] at the start of the head.
+//
+//  * [important] leave SVG content documents as-is
+//    EPUB3 allows SVG documents in the spine, and parsing them as HTML would
+//    mangle them. If the root element is svg, the document is copied without
+//    any other changes.
+//
+//  * [optional] content cache
+//    Identical content documents are only transformed once.
+//
+//  * [optional] size limit
+//    Documents larger than the limit return a *ContentTooLargeError rather
+//    than being parsed, since the whole tree needs to be kept in memory.
+//
+func (c *Converter) TransformContent(w io.Writer, r io.Reader) error {
+	return c.transformContentDocument(w, r, contentDocument{})
+}
+
+// contentDocument is information about a content document being transformed
+// by Convert, for transformations which depend on the rest of the book.
+type contentDocument struct {
+	Name       string                 // filename in the EPUB
+	CoverPage  bool                   // referenced as the cover by the guide
+	CoverImage string                 // filename of the cover image in the EPUB
+	DeadLink   func(href string) bool // checks links if not nil (see ConverterOptionDeadLinks)
+}
+
+// transformContentDocument is like TransformContent, but also applies the
+// transformations depending on cd.
+func (c *Converter) transformContentDocument(w io.Writer, r io.Reader, cd contentDocument) error {
+	if c.maxContentSize > 0 {
+		r = &contentSizeLimiter{r: r, n: c.maxContentSize, max: c.maxContentSize}
+	}
+	fn := func(w io.Writer, r io.Reader) error {
+		return c.transformContent(w, r, cd)
+	}
+	if c.contentCache != nil && cd.DeadLink == nil && c.replacementLog == nil && c.spans.Trace == nil { // dead links depend on the rest of the book, and logged messages need to be reported every time
+		variant := c.language
+		if c.fullBleedCover && cd.Name != "" {
+			variant += "\x00" + cd.Name
+		}
+		return c.contentCache.transform(w, r, variant, fn)
+	}
+	return fn(w, r)
+}
+
+// ContentTooLargeError is returned by TransformContent (and Convert) if a
+// content document is larger than the limit set by
+// ConverterOptionMaxContentSize.
+type ContentTooLargeError struct {
+	Max int64 // the limit in bytes
+}
+
+func (e *ContentTooLargeError) Error() string {
+	return fmt.Sprintf("content document is larger than %d bytes (split it into multiple documents, or increase or remove the limit)", e.Max)
+}
+
+// contentSizeLimiter returns a *ContentTooLargeError after reading more than
+// max bytes from r.
+type contentSizeLimiter struct {
+	r   io.Reader
+	n   int64 // remaining
+	max int64
+}
+
+func (l *contentSizeLimiter) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, &ContentTooLargeError{l.max}
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1] // read one extra byte to detect if it's too large
+	}
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return 0, &ContentTooLargeError{l.max}
+	}
+	return n, err
+}
+
+func (c *Converter) transformContent(w io.Writer, r io.Reader, cd contentDocument) error {
+	switch strings.ToLower(c.charset) {
+	case "utf-8", "":
+		// do nothing
+	case "auto":
+		cr, err := charset.NewReader(r, "")
+		if err != nil {
+			return fmt.Errorf("parse html: detect charset: %w", err)
+		}
+		r = cr
+	default:
+		enc, _ := charset.Lookup(c.charset)
+		if enc == nil {
+			return fmt.Errorf("parset html: invalid charset %q", c.charset)
+		}
+		r = enc.NewDecoder().Reader(r)
+	}
+
+	switch c.nbsp {
+	case "", "&#160;", "&#xA0;", "\u00a0":
+		// valid
+	default:
+		return fmt.Errorf("invalid non-breaking space representation %q", c.nbsp)
+	}
+
+	br := bufio.NewReaderSize(r, 4096)
+	if b, _ := br.Peek(4096); isSVGDocument(b) {
+		if _, err := br.WriteTo(w); err != nil {
+			return fmt.Errorf("copy svg: %w", err)
+		}
+		return nil
+	}
+	r = br
+
+	doc, err := html.ParseWithOptions(r,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return fmt.Errorf("parse html: %w", err)
+	}
+
+	transformContentCharsetUTF8(doc) // charset.NewReader always outputs UTF-8
+
+	lang := documentLanguage(doc, c.language)
+
+	if c.replacementLog != nil {
+		logReplacementChars(doc, cd.Name, c.replacementLog)
+	}
+
+	if c.charsetMeta {
+		transformContentCharsetMeta(doc)
+	}
+
+	if c.removeBase {
+		transformContentRemoveBase(doc)
+	}
+
+	if cd.DeadLink != nil {
+		transformContentDeadLinks(doc, cd.DeadLink, c.removeDeadLinks)
+	}
+
+	if c.cssImports {
+		transformContentStyleImports(doc)
+	}
+
+	if c.fixMojibake {
+		transformContentMojibake(doc)
+	}
+
+	if c.normalizeUnicode {
+		transformContentNormalizeUnicode(doc)
+	}
+
+	if c.dataURIs {
+		transformContentDataURIs(doc, c.dataURIMinSize)
+	}
+
+	if c.contentTitles {
+		transformContentTitle(doc)
+	}
+
+	if c.chapterMarkers {
+		transformContentChapterMarkers(doc)
+	}
+
+	if c.relativeFontSizes {
+		transformContentRelativeFontSizes(doc)
+	}
+
+	if c.stripJustify {
+		transformContentStripJustify(doc)
+	}
+
+	if c.normalizeInlineStyles {
+		transformContentNormalizeInlineStyles(doc)
+	}
+
+	if c.asciiArt {
+		transformContentASCIIArt(doc)
+	}
+
+	if c.mediaPosters && len(c.blockMediaTypes) != 0 {
+		transformContentMediaPosters(doc, c.isBlockedMediaType)
+	}
+
+	if c.fullBleedCover && (cd.CoverPage || cd.CoverImage != "") {
+		transformContentFullBleedCover(doc, func(src string) bool {
+			if cd.CoverPage {
+				return true
+			}
+			u, err := url.Parse(src)
+			return err == nil && u.Scheme == "" && u.Path != "" && path.Join(path.Dir(cd.Name), u.Path) == cd.CoverImage
+		})
+	}
+
+	if c.footnoteSup {
+		transformContentFootnoteSup(doc)
+	}
+
+	if c.flattenSpans {
+		transformContentFlattenSpans(doc)
+	}
+
+	if !c.noKoboStyles {
+		transformContentKoboStyles(doc)
+	}
+
+	if !c.noKoboDivs {
+		transformContentKoboDivs(doc)
+	}
+
+	if !c.noKoboSpans {
+		transformContentKoboSpansWithOptions(doc, c.spans)
+		if c.spans.ID != nil {
+			if err := checkKoboSpanIDs(doc); err != nil {
+				return fmt.Errorf("add spans: %w", err)
+			}
+		}
+	}
+
+	for i := range c.extraCSS {
+		transformContentAddStyle(doc, c.extraCSSClass[i], c.extraCSS[i])
+	}
+
+	if c.hyphenate {
+		transformContentLanguage(doc, lang) // required for hyphenation
+	}
+
+	if c.smartypants {
+		transformContentPunctuationWithOptions(doc, punctuationOptions{
+			Language:         lang,
+			NoEllipses:       c.noSmartEllipses,
+			NoSpacedEllipses: c.noSmartSpacedEllipses,
+		})
+	}
+
+	if !c.noClean {
+		transformContentCleanWithOptions(doc, c.keepReplacement)
+	}
+
+	if c.koboOnly {
+		transformContentKoboOnly(doc)
+	}
+
+	if c.removeEmpty {
+		transformContentRemoveEmpty(doc)
+	}
+
+	if c.xmlDeclaration {
+		transformContentXMLDeclaration(doc)
+	}
+
+	if len(c.find) != 0 {
+		wc := transformContentReplacements(w, c.find, c.replace)
+		w = wc
+		defer wc.Close()
+	}
+
+	if c.nbsp != "" && c.nbsp != "&#160;" {
+		// the renderer always escapes U+00A0 as &#160; (and a literal &#160;
+		// in the text would be escaped as &amp;#160;)
+		wc := transformContentReplacements(w, [][]byte{[]byte("&#160;")}, [][]byte{[]byte(c.nbsp)})
+		w = wc
+		defer wc.Close()
+	}
+
+	if err := renderProlog(w, doc); err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+
+	err = html.RenderWithOptions(w, doc,
+		html.RenderOptionAllowXMLDeclarations(true),
+		html.RenderOptionPolyglot(true))
+	if err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+
+	return nil
+}
+
+// renderProlog renders and removes the nodes before the root element of doc.
+// Like the XML declaration, other processing instructions (e.g., xml-model and
+// xml-stylesheet) are parsed as bogus comments, but unlike it, the renderer
+// doesn't render them as-is.
+func renderProlog(w io.Writer, doc *html.Node) error {
+	for c := doc.FirstChild; c != nil && c.Type != html.ElementNode; c = doc.FirstChild {
+		if c.Type == html.CommentNode && len(c.Data) > 1 && c.Data[0] == '?' && c.Data[len(c.Data)-1] == '?' {
+			if _, err := io.WriteString(w, "<"+c.Data+">"); err != nil {
+				return err
+			}
+		} else {
+			if err := html.RenderWithOptions(w, c,
+				html.RenderOptionAllowXMLDeclarations(true),
+				html.RenderOptionPolyglot(true)); err != nil {
+				return err
+			}
+		}
+		doc.RemoveChild(c)
+	}
+	return nil
+}
+
+func transformContentCharsetUTF8(doc *html.Node) {
+	// update the encoding in the XML declaration if it's there (and normalize
+	// the whitespace after ?xml since the renderer only recognizes "?xml ")
+	if c := xmlDeclaration(doc); c != nil {
+		c.Data = "?xml " + strings.TrimLeft(c.Data[4:], " \t\r\n")
+		c.Data = xmlDeclarationEncodingRe.ReplaceAllStringFunc(c.Data, func(m string) string {
+			sm := xmlDeclarationEncodingRe.FindStringSubmatch(m)
+			if q, enc := sm[2]+sm[4], sm[3]+sm[5]; !strings.EqualFold(enc, "utf-8") {
+				return sm[1] + q + "UTF-8" + q
+			}
+			return m
+		})
+	}
+
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, findAtom(doc, atom.Head))
+
+	// update the meta[charset] or meta[http-equiv="content-type"] if it's there
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			if cur.DataAtom == atom.Meta {
+				for i, a := range cur.Attr {
+					if a.Key == "charset" && strings.ToUpper(cur.Attr[i].Val) != "UTF-8" {
+						cur.Attr[i].Val = "UTF-8"
+						break
+					}
+					if a.Key == "http-equiv" && strings.ToLower(a.Val) == "content-type" {
+						for j, b := range cur.Attr {
+							if b.Key == "content" {
+								if t, p, err := mime.ParseMediaType(b.Val); err == nil {
+									if _, ok := p["charset"]; ok && strings.ToLower(p["charset"]) != "utf-8" {
+										p["charset"] = "utf-8"
+										cur.Attr[j].Val = mime.FormatMediaType(t, p)
+									}
+								}
+								break
+							}
+						}
+						break
+					}
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
+
+func transformContentCharsetMeta(doc *html.Node) {
+	head := findAtom(doc, atom.Head)
+	if head == nil {
+		return
+	}
+
+	var metas []*html.Node
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, head)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode && cur.DataAtom == atom.Meta {
+			for _, a := range cur.Attr {
+				if a.Key == "charset" || (a.Key == "http-equiv" && strings.ToLower(a.Val) == "content-type") {
+					metas = append(metas, cur)
+					break
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+
+	for _, n := range metas {
+		n.Parent.RemoveChild(n)
+	}
+	head.InsertBefore(&html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Meta,
+		Data:     "meta",
+		Attr: []html.Attribute{{
+			Key: "charset",
+			Val: "UTF-8",
+		}},
+	}, head.FirstChild)
+}
+
+func transformContentRemoveBase(doc *html.Node) {
+	var base *url.URL
+	var stack []*html.Node
+	var cur *html.Node
+
+	// remove base elements, keeping the first href (which is the one which applies)
+	stack = append(stack, doc)
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+		if cur.Type == html.ElementNode && cur.DataAtom == atom.Base {
+			if href := attrValue(cur, "href"); base == nil && href != "" {
+				if u, err := url.Parse(strings.TrimSpace(href)); err == nil {
+					base = u
+				}
+			}
+			cur.Parent.RemoveChild(cur)
+		}
+	}
+	if base == nil || base.IsAbs() || base.Host != "" {
+		return // remote bases would make links point outside the book, so they're just removed
+	}
+
+	// relative bases (the common case in EPUBs) can't be resolved with
+	// ResolveReference since the document URL is unknown, but they can be
+	// joined onto relative links to make them relative to the document
+	dir := base.Path
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+
+	stack = append(stack, doc)
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+		if cur.Type != html.ElementNode {
+			continue
+		}
+		for i, a := range cur.Attr {
+			switch a.Key {
+			case "href", "src", "poster", "data":
+			default:
+				continue
+			}
+			v := strings.TrimSpace(a.Val)
+			if v == "" || v[0] == '#' {
+				continue // keep links within the same document as-is
+			}
+			u, err := url.Parse(v)
+			if err != nil || u.IsAbs() || u.Host != "" || u.Path == "" {
+				continue
+			}
+			if !strings.HasPrefix(u.Path, "/") {
+				u.Path = path.Join(dir, u.Path)
+				cur.Attr[i].Val = u.String()
+			}
+		}
+	}
+}
+
+// transformContentStyleImports removes remote @import rules from style
+// elements, and replaces local ones with a link to the stylesheet before the
+// style element (since the path of the content document isn't known here).
+func transformContentStyleImports(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode && cur.DataAtom == atom.Style {
+			if c := cur.FirstChild; c != nil && c.Type == html.TextNode && c == cur.LastChild {
+				style := cur
+				c.Data = string(cssImports([]byte(c.Data), func(href, media string) (string, bool) {
+					if isRemoteURL(href) {
+						return "", true
+					}
+					link := &html.Node{
+						Type:     html.ElementNode,
+						DataAtom: atom.Link,
+						Data:     "link",
+						Attr: []html.Attribute{
+							{Key: "rel", Val: "stylesheet"},
+							{Key: "type", Val: "text/css"},
+							{Key: "href", Val: href},
+						},
+					}
+					if media != "" {
+						link.Attr = append(link.Attr, html.Attribute{Key: "media", Val: media})
+					}
+					style.Parent.InsertBefore(link, style)
+					return "", true
+				}))
+				if strings.TrimSpace(c.Data) == "" {
+					cur.Parent.RemoveChild(cur)
+				}
+			}
+			continue
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
+
+func transformContentNormalizeUnicode(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.TextNode:
+			cur.Data = norm.NFC.String(cur.Data)
+		case html.ElementNode:
+			switch cur.DataAtom {
+			case atom.Script, atom.Style:
+				continue
+			}
+			fallthrough
+		case html.DocumentNode:
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
+func transformContentMojibake(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.TextNode:
+			cur.Data = mojibakeReplacer.Replace(cur.Data)
+		case html.ElementNode:
+			switch cur.DataAtom {
+			case atom.Script, atom.Style:
+				continue
+			}
+			fallthrough
+		case html.DocumentNode:
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
+// mojibakeReplacer replaces UTF-8 sequences which were incorrectly decoded as
+// Windows-1252 (or ISO-8859-1 for bytes undefined in Windows-1252) with the
+// original characters.
+var mojibakeReplacer = func() *strings.Replacer {
+	cp1252 := [32]rune{
+		'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+		'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+	}
+	var oldnew []string
+	for _, r := range "‘’‚“”„–—…•†‡‰‹›€™" + "¡£§©«®°±¶·»¿" + "ÀÁÂÃÄÅÆÇÈÉÊËÌÍÎÏÑÒÓÔÕÖØÙÚÛÜÝßàáâãäåæçèéêëìíîïñòóôõöøùúûüýÿ" {
+		var b strings.Builder
+		for _, x := range []byte(string(r)) {
+			if x >= 0x80 && x < 0xA0 {
+				b.WriteRune(cp1252[x-0x80])
+			} else {
+				b.WriteRune(rune(x))
+			}
+		}
+		oldnew = append(oldnew, b.String(), string(r))
+	}
+	return strings.NewReplacer(oldnew...)
+}()
+
+func transformContentDataURIs(doc *html.Node, minSize int) {
+	contentDataURIs(doc, minSize, func(a *html.Attribute, f dataURIFile) {
+		a.Val = f.Name
+	})
+}
+
+// dataURIFile is an image extracted from a data URI.
+type dataURIFile struct {
+	Name      string // relative to the content document
+	MediaType string
+	Data      []byte
+}
+
+// dataURIExt maps the supported data URI media types to file extensions.
+var dataURIExt = map[string]string{
+	"image/gif":     ".gif",
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/svg+xml": ".svg",
+	"image/webp":    ".webp",
+}
+
+// contentDataURIs calls fn for each img src or SVG image href attribute under n
+// containing a data URI of a supported image type with at least minSize bytes
+// of data. The file name is based on a hash of the data, so identical images
+// are only extracted once.
+func contentDataURIs(n *html.Node, minSize int, fn func(a *html.Attribute, f dataURIFile)) {
+	if n.Type == html.ElementNode && ((n.DataAtom == atom.Img && n.Namespace == "") || (n.DataAtom == atom.Image && n.Namespace == "svg")) {
+		for i := range n.Attr {
+			a := &n.Attr[i]
+			if (n.DataAtom == atom.Img && a.Key != "src") || (n.DataAtom == atom.Image && a.Key != "href") {
+				continue
+			}
+			if mediaType, data, ok := parseDataURI(a.Val); ok && len(data) >= minSize {
+				if ext, ok := dataURIExt[mediaType]; ok {
+					sum := sha256.Sum256(data)
+					fn(a, dataURIFile{
+						Name:      "kepubify-data-" + hex.EncodeToString(sum[:8]) + ext,
+						MediaType: mediaType,
+						Data:      data,
+					})
+				}
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		contentDataURIs(c, minSize, fn)
+	}
+}
+
+// parseDataURI parses a RFC 2397 data URI, returning the lowercase media type
+// (without parameters) and the decoded data.
+func parseDataURI(uri string) (string, []byte, bool) {
+	if len(uri) < 5 || !strings.EqualFold(uri[:5], "data:") {
+		return "", nil, false
+	}
+	i := strings.IndexByte(uri, ',')
+	if i == -1 {
+		return "", nil, false
+	}
+	params, data := strings.Split(uri[5:i], ";"), uri[i+1:]
+
+	if params[len(params)-1] == "base64" {
+		b, err := base64.StdEncoding.DecodeString(strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, data))
+		if err != nil {
+			return "", nil, false
+		}
+		return strings.ToLower(strings.TrimSpace(params[0])), b, true
+	}
+
+	b, err := url.PathUnescape(data)
+	if err != nil {
+		return "", nil, false
+	}
+	return strings.ToLower(strings.TrimSpace(params[0])), []byte(b), true
+}
+
+func transformContentTitle(doc *html.Node) {
+	head := findAtom(doc, atom.Head)
+	if head == nil {
+		return
+	}
+
+	title := findAtom(head, atom.Title)
+	if title != nil && !isSpace(textContent(title)) {
+		return
+	}
+
+	body := findAtom(doc, atom.Body)
+	if body == nil {
+		return
+	}
+
+	var text string
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, body)
+
+	for len(stack) != 0 && text == "" {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			switch cur.DataAtom {
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				text = strings.Join(strings.Fields(textContent(cur)), " ")
+				continue
+			case atom.Script, atom.Style:
+				continue
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+	if text == "" {
+		return
+	}
+
+	if title == nil {
+		title = &html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.Title,
+			Data:     "title",
+		}
+		head.InsertBefore(title, head.FirstChild)
+	}
+	for title.FirstChild != nil {
+		title.RemoveChild(title.FirstChild)
+	}
+	withText(title, text)
+}
+
+func transformContentChapterMarkers(doc *html.Node) {
+	body := findAtom(doc, atom.Body)
+	if body == nil {
+		return
+	}
+
+	ids := map[string]bool{}
+	var headings []*html.Node
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			if id := attrValue(cur, "id"); id != "" {
+				ids[id] = true
+			} else {
+				switch cur.DataAtom {
+				case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+					headings = append(headings, cur)
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+
+	if !ids["kepubify-top"] {
+		body.InsertBefore(&html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.A,
+			Data:     "a",
+			Attr: []html.Attribute{{
+				Key: "id",
+				Val: "kepubify-top",
+			}},
+		}, body.FirstChild)
+	}
+
+	n := 0
+	for _, h := range headings {
+		var id string
+		for id == "" || ids[id] {
+			n++
+			id = "kepubify-heading-" + strconv.Itoa(n)
+		}
+		ids[id] = true
+		h.Attr = append(h.Attr, html.Attribute{Key: "id", Val: id})
+	}
+}
+
+func transformContentRelativeFontSizes(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, findAtom(doc, atom.Body))
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			editInlineStyle(cur, func(prop, val string) (string, bool) {
+				if prop == "font-size" {
+					return relativeFontSize(val), true
+				}
+				return val, true
+			})
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
+
+// relativeFontSize converts a px or pt CSS font-size value to em (assuming the
+// default 16px/12pt), or returns it as-is.
+func relativeFontSize(val string) string {
+	num, imp := val, ""
+	if i := strings.IndexByte(num, '!'); i != -1 {
+		num, imp = strings.TrimSpace(num[:i]), " "+strings.TrimSpace(num[i:])
+	}
+	var base float64
+	switch lnum := strings.ToLower(num); {
+	case strings.HasSuffix(lnum, "px"):
+		base = 16
+	case strings.HasSuffix(lnum, "pt"):
+		base = 12
+	default:
+		return val
+	}
+	v, err := strconv.ParseFloat(num[:len(num)-2], 64)
+	if err != nil || v < 0 {
+		return val
+	}
+	return strconv.FormatFloat(math.Round(v/base*1000)/1000, 'f', -1, 64) + "em" + imp
+}
+
+var justifyRe = regexp.MustCompile(`(?i)text-align\s*:\s*justify\s*(?:!\s*important\s*)?(?:;|(\}))`)
+
+func transformContentStripJustify(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.ElementNode:
+			editInlineStyle(cur, func(prop, val string) (string, bool) {
+				if prop == "text-align" {
+					if v := strings.ToLower(val); v == "justify" || strings.HasPrefix(v, "justify ") || strings.HasPrefix(v, "justify!") {
+						return val, false
+					}
+				}
+				return val, true
+			})
+			if cur.DataAtom == atom.Style {
+				for c := cur.FirstChild; c != nil; c = c.NextSibling {
+					if c.Type == html.TextNode {
+						c.Data = justifyRe.ReplaceAllString(c.Data, "$1")
+					}
+				}
+				continue
+			}
+			fallthrough
+		case html.DocumentNode:
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
+func transformContentNormalizeInlineStyles(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.ElementNode:
+			switch cur.DataAtom {
+			case atom.Script, atom.Style, atom.Svg, atom.Math:
+				continue
+			}
+			var caseFn func(string) string
+			editInlineStyle(cur, func(prop, val string) (string, bool) {
+				switch prop {
+				case "letter-spacing", "word-spacing":
+					return val, false // breaks justification and hyphenation
+				case "text-transform":
+					switch strings.ToLower(strings.TrimSpace(strings.TrimSuffix(val, "!important"))) {
+					case "uppercase":
+						caseFn = strings.ToUpper
+					case "lowercase":
+						caseFn = strings.ToLower
+					default:
+						return val, true
+					}
+					return val, false // applied to the text instead
+				}
+				return val, true
+			})
+			if caseFn != nil {
+				mapTextTransform(cur, caseFn)
+			}
+			fallthrough
+		case html.DocumentNode:
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
+// mapTextTransform is like mapText, but skips descendants with their own
+// text-transform (including none and capitalize), which override it.
+func mapTextTransform(n *html.Node, fn func(string) string) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			if c.DataAtom == atom.Script || c.DataAtom == atom.Style {
+				continue
+			}
+			var own bool
+			editInlineStyle(c, func(prop, val string) (string, bool) {
+				own = own || prop == "text-transform"
+				return val, true
+			})
+			if own {
+				continue
+			}
+			mapTextTransform(c, fn)
+			continue
+		}
+		mapText(c, fn)
+	}
+}
+
+func transformContentASCIIArt(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.ElementNode:
+			switch cur.DataAtom {
+			case atom.Script, atom.Style, atom.Pre, atom.Svg, atom.Math:
+				continue
+			case atom.P, atom.Div:
+				if isASCIIArt(cur) {
+					cur.Data, cur.DataAtom = "pre", atom.Pre
+					for c := cur.FirstChild; c != nil; c = c.NextSibling {
+						if c.Type == html.ElementNode {
+							c.Type, c.Data, c.DataAtom = html.TextNode, "\n", 0
+							// the br replaces the source line break, if any
+							if n := c.NextSibling; n != nil && n.Type == html.TextNode {
+								n.Data = strings.TrimPrefix(strings.TrimPrefix(n.Data, "\r"), "\n")
+							}
+						}
+					}
+					mergeText(cur)
+					continue
+				}
+			}
+			fallthrough
+		case html.DocumentNode:
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
+// isASCIIArt checks if n only contains text separated into three or more
+// non-empty lines by br elements, where at least half of the non-space
+// characters are symbols or punctuation and at least one line is aligned using
+// a run of spaces.
+func isASCIIArt(n *html.Node) bool {
+	var lines []string
+	var line strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.TextNode:
+			line.WriteString(c.Data)
+		case c.Type == html.ElementNode && c.DataAtom == atom.Br && c.FirstChild == nil:
+			lines = append(lines, line.String())
+			line.Reset()
+		default:
+			return false
+		}
+	}
+	lines = append(lines, line.String())
+
+	var nonEmpty, symbols, other int
+	var aligned bool
+	for _, l := range lines {
+		l = strings.Trim(strings.ReplaceAll(l, "\u00a0", " "), "\r\n")
+		if isSpace(l) {
+			continue
+		}
+		nonEmpty++
+		if strings.Contains(strings.TrimSpace(l), "  ") || strings.HasPrefix(l, "  ") {
+			aligned = true
+		}
+		for _, r := range l {
+			switch {
+			case unicode.IsSpace(r):
+			case unicode.IsPunct(r), unicode.IsSymbol(r):
+				symbols++
+			default:
+				other++
+			}
+		}
+	}
+	return nonEmpty >= 3 && aligned && symbols >= other
+}
+
+func transformContentMediaPosters(doc *html.Node, blocked func(mediaType string) bool) {
+	var videos []*html.Node
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, findAtom(doc, atom.Body))
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur == nil || cur.Type != html.ElementNode {
+			continue
+		}
+		if cur.DataAtom == atom.Video {
+			videos = append(videos, cur)
+			continue
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+
+	for _, video := range videos {
+		poster := attrValue(video, "poster")
+		if poster == "" || !videoBlocked(video, blocked) {
+			continue
+		}
+
+		img := &html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.Img,
+			Data:     "img",
+			Attr:     []html.Attribute{{Key: "src", Val: poster}},
+		}
+		alt := attrValue(video, "title")
+		if alt == "" {
+			alt = attrValue(video, "aria-label")
+		}
+		img.Attr = append(img.Attr, html.Attribute{Key: "alt", Val: alt})
+		for _, a := range video.Attr {
+			switch a.Key {
+			case "id", "class", "style", "width", "height":
+				img.Attr = append(img.Attr, a)
+			}
+		}
+
+		video.Parent.InsertBefore(img, video)
+		video.Parent.RemoveChild(video)
+	}
+}
+
+// videoBlocked checks if all sources of a video element have a blocked media
+// type. If a source doesn't have a type attribute, it is guessed from the file
+// extension.
+func videoBlocked(video *html.Node, blocked func(mediaType string) bool) bool {
+	var srcs [][2]string
+	if src := attrValue(video, "src"); src != "" {
+		srcs = append(srcs, [2]string{src, attrValue(video, "type")})
+	}
+	for c := video.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Source {
+			if src := attrValue(c, "src"); src != "" {
+				srcs = append(srcs, [2]string{src, attrValue(c, "type")})
+			}
+		}
+	}
+	if len(srcs) == 0 {
+		return false
+	}
+	for _, src := range srcs {
+		mediaType := src[1]
+		if mediaType == "" {
+			ext := strings.ToLower(path.Ext(strings.SplitN(strings.SplitN(src[0], "#", 2)[0], "?", 2)[0]))
+			if mediaType = mime.TypeByExtension(ext); mediaType == "" && ext != "" {
+				mediaType = "video/" + ext[1:]
+			}
+		}
+		if !blocked(mediaType) {
+			return false
+		}
 	}
+	return true
+}
 
-	transformContentCharsetUTF8(doc) // charset.NewReader always outputs UTF-8
+// transformContentFullBleedCover wraps the image on a page consisting only of a
+// single image in an SVG if isCover returns true for its src.
+func transformContentFullBleedCover(doc *html.Node, isCover func(src string) bool) {
+	body := findAtom(doc, atom.Body)
 
-	transformContentKoboStyles(doc) // mandatory
-	transformContentKoboDivs(doc)   // mandatory
-	transformContentKoboSpans(doc)  // mandatory
+	// only pages which contain nothing but a single (possibly wrapped) image
+	var img *html.Node
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, body)
 
-	for i := range c.extraCSS {
-		transformContentAddStyle(doc, c.extraCSSClass[i], c.extraCSS[i])
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.TextNode:
+			if !isSpace(cur.Data) {
+				return
+			}
+		case html.ElementNode:
+			switch cur.DataAtom {
+			case atom.Img:
+				if img != nil {
+					return
+				}
+				img = cur
+			case atom.Body, atom.Div, atom.P, atom.Span:
+				for c := cur.LastChild; c != nil; c = c.PrevSibling {
+					stack = append(stack, c)
+				}
+			default:
+				return
+			}
+		}
 	}
 
-	if c.smartypants {
-		transformContentPunctuation(doc)
+	if img == nil {
+		return
+	}
+	src := attrValue(img, "src")
+	if src == "" || !isCover(src) {
+		return
 	}
 
-	transformContentClean(doc)
-
-	if len(c.find) != 0 {
-		wc := transformContentReplacements(w, c.find, c.replace)
-		w = wc
-		defer wc.Close()
+	// based on the SVG cover wrapper used by Calibre, but without requiring
+	// the image dimensions (if we don't have them, the image is scaled to the
+	// viewport instead)
+	svg := &html.Node{
+		Type:      html.ElementNode,
+		DataAtom:  atom.Svg,
+		Data:      "svg",
+		Namespace: "svg",
+		Attr: []html.Attribute{
+			{Key: "xmlns", Val: "http://www.w3.org/2000/svg"},
+			{Namespace: "xmlns", Key: "xlink", Val: "http://www.w3.org/1999/xlink"},
+			{Key: "version", Val: "1.1"},
+			{Key: "width", Val: "100%"},
+			{Key: "height", Val: "100%"},
+			{Key: "preserveAspectRatio", Val: "xMidYMid meet"},
+		},
+	}
+	image := &html.Node{
+		Type:      html.ElementNode,
+		Data:      "image",
+		Namespace: "svg",
 	}
+	width, err1 := strconv.ParseUint(attrValue(img, "width"), 10, 32)
+	height, err2 := strconv.ParseUint(attrValue(img, "height"), 10, 32)
+	if err1 == nil && err2 == nil && width != 0 && height != 0 {
+		svg.Attr = append(svg.Attr, html.Attribute{Key: "viewBox", Val: fmt.Sprintf("0 0 %d %d", width, height)})
+		image.Attr = append(image.Attr,
+			html.Attribute{Key: "width", Val: strconv.FormatUint(width, 10)},
+			html.Attribute{Key: "height", Val: strconv.FormatUint(height, 10)})
+	} else {
+		image.Attr = append(image.Attr,
+			html.Attribute{Key: "width", Val: "100%"},
+			html.Attribute{Key: "height", Val: "100%"},
+			html.Attribute{Key: "preserveAspectRatio", Val: "xMidYMid meet"})
+	}
+	image.Attr = append(image.Attr, html.Attribute{Namespace: "xlink", Key: "href", Val: src})
+	if alt := attrValue(img, "alt"); alt != "" {
+		svg.AppendChild(withText(&html.Node{
+			Type:      html.ElementNode,
+			Data:      "title",
+			Namespace: "svg",
+		}, alt))
+	}
+	svg.AppendChild(image)
 
-	err = html.RenderWithOptions(w, doc,
-		html.RenderOptionAllowXMLDeclarations(true),
-		html.RenderOptionPolyglot(true))
-	if err != nil {
-		return fmt.Errorf("render html: %w", err)
+	for body.FirstChild != nil {
+		body.RemoveChild(body.FirstChild)
 	}
+	body.AppendChild(svg)
 
-	return nil
+	transformContentAddStyle(doc, "kepubify-fullbleedcover", `html, body, div#book-columns, div#book-inner { margin: 0; padding: 0; width: 100%; height: 100%; } svg { display: block; }`)
 }
 
-func transformContentCharsetUTF8(doc *html.Node) {
+var footnoteRefRe = regexp.MustCompile(`^\[?[0-9]{1,3}\]?$`)
+
+func transformContentFootnoteSup(doc *html.Node) {
 	var stack []*html.Node
 	var cur *html.Node
-	stack = append(stack, findAtom(doc, atom.Head))
+	stack = append(stack, findAtom(doc, atom.Body))
 
-	// update the meta[charset] or meta[http-equiv="content-type"] if it's there
 	for len(stack) != 0 {
 		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
-		if cur.Type == html.ElementNode {
-			if cur.DataAtom == atom.Meta {
-				for i, a := range cur.Attr {
-					if a.Key == "charset" && strings.ToUpper(cur.Attr[i].Val) != "UTF-8" {
-						cur.Attr[i].Val = "UTF-8"
-						break
-					}
-					if a.Key == "http-equiv" && strings.ToLower(a.Val) == "content-type" {
-						for j, b := range cur.Attr {
-							if b.Key == "content" {
-								if t, p, err := mime.ParseMediaType(b.Val); err == nil {
-									if _, ok := p["charset"]; ok && strings.ToLower(p["charset"]) != "utf-8" {
-										p["charset"] = "utf-8"
-										cur.Attr[j].Val = mime.FormatMediaType(t, p)
-									}
-								}
-								break
-							}
-						}
-						break
-					}
+		if cur.Type != html.ElementNode {
+			continue
+		}
+		switch cur.DataAtom {
+		case atom.Sup, atom.Sub, atom.Script, atom.Style, atom.Pre, atom.Svg, atom.Math:
+			continue // already formatted, or shouldn't be touched
+		case atom.A:
+			if isFootnoteRef(cur) {
+				sup := &html.Node{
+					Type:     html.ElementNode,
+					DataAtom: atom.Sup,
+					Data:     "sup",
 				}
+				cur.Parent.InsertBefore(sup, cur)
+				cur.Parent.RemoveChild(cur)
+				sup.AppendChild(cur)
+				continue
 			}
 		}
 		for c := cur.LastChild; c != nil; c = c.PrevSibling {
@@ -253,6 +2174,91 @@ func transformContentCharsetUTF8(doc *html.Node) {
 	}
 }
 
+// isFootnoteRef checks if n is a link to a note with a number as the text
+// directly after a word (or explicitly marked as a note reference).
+func isFootnoteRef(n *html.Node) bool {
+	if !strings.Contains(attrValue(n, "href"), "#") {
+		return false
+	}
+	if n.FirstChild == nil || n.FirstChild != n.LastChild || n.FirstChild.Type != html.TextNode || !footnoteRefRe.MatchString(n.FirstChild.Data) {
+		return false
+	}
+	for _, a := range n.Attr {
+		if a.Key == "epub:type" || (a.Namespace == "epub" && a.Key == "type") {
+			if includes(a.Val, "noteref") {
+				return true
+			}
+		}
+	}
+	if p := n.PrevSibling; p != nil && p.Type == html.TextNode && p.Data != "" {
+		r, _ := utf8.DecodeLastRuneInString(p.Data)
+		return unicode.IsLetter(r) || unicode.IsPunct(r)
+	}
+	return false
+}
+
+func transformContentFlattenSpans(doc *html.Node) {
+	flattenSpans(findAtom(doc, atom.Body))
+}
+
+// flattenSpans unwraps attribute-less spans and merges adjacent spans (ignoring
+// whitespace between them) with identical attributes in n.
+func flattenSpans(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			switch c.DataAtom {
+			case atom.Script, atom.Style, atom.Pre, atom.Svg, atom.Math:
+				continue // don't touch elements which should keep text as-is
+			}
+			if preservesSpace(c) {
+				continue
+			}
+			flattenSpans(c)
+		}
+	}
+	for c := n.FirstChild; c != nil; {
+		if !matchPlainSpan(c) {
+			c = c.NextSibling
+			continue
+		}
+		if len(c.Attr) == 0 {
+			next, first := c.NextSibling, c.FirstChild
+			for c.FirstChild != nil {
+				child := c.FirstChild
+				c.RemoveChild(child)
+				n.InsertBefore(child, c)
+			}
+			n.RemoveChild(c)
+			if c = first; c == nil {
+				c = next
+			}
+			continue
+		}
+		for {
+			ws, m := c.NextSibling, c.NextSibling
+			if m != nil && m.Type == html.TextNode && isSpace(m.Data) {
+				m = m.NextSibling
+			}
+			if m == nil || !matchPlainSpan(m) || !matchAttrs(c, m) {
+				break
+			}
+			if ws != m {
+				n.RemoveChild(ws)
+				c.AppendChild(ws)
+			}
+			for m.FirstChild != nil {
+				child := m.FirstChild
+				m.RemoveChild(child)
+				c.AppendChild(child)
+			}
+			n.RemoveChild(m)
+		}
+		mergeText(c)
+		c = c.NextSibling
+	}
+	mergeText(n)
+}
+
 func transformContentKoboStyles(doc *html.Node) {
 	// behavior based on Kobo (checked with 3 books) as of 2020-01-12
 	// original looks like the following at the end of the head element:
@@ -297,14 +2303,110 @@ func transformContentKoboDivs(doc *html.Node) {
 	}
 }
 
+// koboSpanOptions customizes the koboSpans added by
+// transformContentKoboSpansWithOptions. The zero value matches Kobo's behaviour.
+type koboSpanOptions struct {
+	// ParagraphBase and SegmentBase are the counter values before the first
+	// paragraph and before the first segment of each paragraph (i.e. one less
+	// than the first id number).
+	ParagraphBase int
+	SegmentBase   int
+
+	// WrapSpans puts the koboSpan outside existing spans containing a single
+	// sentence rather than inside them.
+	WrapSpans bool
+
+	// ListItemParagraphs starts a new paragraph for each list item rather than
+	// for each list.
+	ListItemParagraphs bool
+
+	// LineBreakParagraphs starts a new paragraph after each br and hr element
+	// (e.g., for each line of a poem).
+	LineBreakParagraphs bool
+
+	// InlineSentences allows a koboSpan to contain inline elements so
+	// sentences crossing their edges aren't split into multiple spans.
+	InlineSentences bool
+
+	// Words wraps each whitespace-delimited word in a koboSpan rather than
+	// each sentence, leaving the whitespace between them as text. WrapSpans
+	// and InlineSentences are ignored.
+	Words bool
+
+	// Abbreviations, if set, are words ending with a period (e.g., "Dr.")
+	// which don't end a sentence when followed by whitespace. They are matched
+	// case-insensitively at word boundaries.
+	Abbreviations []string
+
+	// Attrs are extra attributes to add to each koboSpan.
+	Attrs []koboSpanAttr
+
+	// ID, if set, generates the koboSpan ids (which are kobo.PARA.SEG by
+	// default) from the paragraph and segment numbers, and the zero-based index
+	// of the span in the document.
+	ID func(para, seg, idx int) string
+
+	// Trace, if set, is called with a log message for each node visited, each
+	// set of sentences split, and each span added.
+	Trace func(format string, a ...interface{})
+}
+
+// koboSpanAttr is an extra attribute added to koboSpans, with the value
+// generated from the paragraph and segment numbers, and the zero-based index of
+// the span in the document.
+type koboSpanAttr struct {
+	Key string
+	Val func(para, seg, idx int) string
+}
+
 func transformContentKoboSpans(doc *html.Node) {
+	transformContentKoboSpansWithOptions(doc, koboSpanOptions{})
+}
+
+// transformContentKoboSpansWithOptions adds koboSpans to the text and images
+// in the body of doc. The ids are kobo.PARA.SEG, where:
+//
+//   - PARA starts at ParagraphBase+1 and is incremented before the first span
+//     inside each p, ol, ul, table, h1-h6, figcaption, dt, and dd element, and
+//     for each image. Text after the end of a block element (but still in its
+//     parent) continues the last paragraph. If the body starts with text or
+//     inline elements, they are treated as an implicit first paragraph (other
+//     content before the first paragraph element is in paragraph
+//     ParagraphBase).
+//   - SEG is reset to SegmentBase whenever PARA is incremented, and is
+//     incremented before each span (i.e., the first span in a paragraph is
+//     always SegmentBase+1). Each sentence in a text node gets its own segment,
+//     so a sentence split by inline markup has multiple segments.
+func transformContentKoboSpansWithOptions(doc *html.Node, opt koboSpanOptions) {
 	// behavior matches Kobo (checked with 3 books) as of 2020-01-12
 	if findClass(findAtom(doc, atom.Body), "koboSpan") != nil {
 		return // already has kobo spans
 	}
 
-	var para, seg int
-	var incParaNext bool
+	para, seg := opt.ParagraphBase, opt.SegmentBase
+	incParaNext := startsWithInlineText(findAtom(doc, atom.Body)) // implicit paragraph
+
+	trace := opt.Trace
+	if trace == nil {
+		trace = func(string, ...interface{}) {}
+	}
+
+	var idx int
+	newKoboSpan := func() *html.Node {
+		s := koboSpan(para, seg)
+		if opt.ID != nil {
+			for i := range s.Attr {
+				if s.Attr[i].Key == "id" {
+					s.Attr[i].Val = opt.ID(para, seg, idx)
+				}
+			}
+		}
+		for _, a := range opt.Attrs {
+			s.Attr = append(s.Attr, html.Attribute{Key: a.Key, Val: a.Val(para, seg, idx)})
+		}
+		idx++
+		return s
+	}
 
 	var stack []*html.Node
 	var cur *html.Node
@@ -316,14 +2418,60 @@ func transformContentKoboSpans(doc *html.Node) {
 		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
 		switch cur.Type {
 		case html.TextNode:
-			sentences = splitSentences(cur.Data, sentences[:0])
+			sentences = mergeAbbreviations(cur.Data, splitSentences(cur.Data, sentences[:0]), opt.Abbreviations)
+			trace("text under <%s> (para=%d seg=%d): sentences %q", cur.Parent.Data, para, seg, sentences)
+
+			// if enabled, wrap each word instead
+			if opt.Words {
+				for _, sentence := range sentences {
+					for _, word := range splitWords(sentence) {
+						if isSpace(word) {
+							cur.Parent.InsertBefore(&html.Node{
+								Type: html.TextNode,
+								Data: word,
+							}, cur)
+							continue
+						}
+						if incParaNext {
+							para++
+							seg = opt.SegmentBase
+							incParaNext = false
+						}
+
+						seg++
+						s := withText(newKoboSpan(), word)
+						cur.Parent.InsertBefore(s, cur)
+						trace("span %s (word): %q", attrValue(s, "id"), word)
+					}
+				}
+				cur.Parent.RemoveChild(cur)
+				continue
+			}
+
+			// if enabled, wrap the parent span instead if it only contains a
+			// single sentence
+			if p := cur.Parent; opt.WrapSpans && len(sentences) == 1 && !isSpace(sentences[0]) && p.DataAtom == atom.Span && p.FirstChild == cur && p.LastChild == cur {
+				if incParaNext {
+					para++
+					seg = opt.SegmentBase
+					incParaNext = false
+				}
+
+				seg++
+				s := newKoboSpan()
+				p.Parent.InsertBefore(s, p)
+				p.Parent.RemoveChild(p)
+				s.AppendChild(p)
+				trace("span %s (outside <span>): %q", attrValue(s, "id"), sentences[0])
+				continue
+			}
 
 			// wrap each sentence in a span (don't wrap whitespace unless it is
 			// directly under a P tag [TODO: are there any other cases we wrap
 			// whitespace? ... I need to find a kepub like this]) and add it
 			// back to the parent.
 			for _, sentence := range sentences {
-				if isSpace(sentence) && cur.Parent.DataAtom != atom.P {
+				if isSpace(sentence) && (cur.Parent.DataAtom != atom.P || isTrailingSpace(cur)) {
 					cur.Parent.InsertBefore(&html.Node{
 						Type: html.TextNode,
 						Data: sentence,
@@ -331,12 +2479,14 @@ func transformContentKoboSpans(doc *html.Node) {
 				} else {
 					if incParaNext {
 						para++
-						seg = 0
+						seg = opt.SegmentBase
 						incParaNext = false
 					}
 
 					seg++
-					cur.Parent.InsertBefore(withText(koboSpan(para, seg), sentence), cur)
+					s := withText(newKoboSpan(), sentence)
+					cur.Parent.InsertBefore(s, cur)
+					trace("span %s: %q", attrValue(s, "id"), sentence)
 				}
 			}
 
@@ -344,16 +2494,20 @@ func transformContentKoboSpans(doc *html.Node) {
 			cur.Parent.RemoveChild(cur)
 
 		case html.ElementNode:
+			trace("element <%s> (para=%d seg=%d)", cur.Data, para, seg)
+			if preservesSpace(cur) {
+				continue // like pre
+			}
 			switch cur.DataAtom {
 			case atom.Img:
 				// increment the paragraph immediately
 				para++
-				seg = 0
+				seg = opt.SegmentBase
 				incParaNext = false
 
 				// add a span around the image
 				seg++
-				s := koboSpan(para, seg)
+				s := newKoboSpan()
 				s.AppendChild(&html.Node{
 					Type:      cur.Type,
 					DataAtom:  cur.DataAtom,
@@ -364,17 +2518,53 @@ func transformContentKoboSpans(doc *html.Node) {
 				})
 				cur.Parent.InsertBefore(s, cur)
 				cur.Parent.RemoveChild(cur)
+				trace("span %s: <img>", attrValue(s, "id"))
 
 				fallthrough
-			case atom.Script, atom.Style, atom.Pre, atom.Audio, atom.Video, atom.Svg, atom.Math:
-				continue // don't add spans to elements which should keep text as-is
-			case atom.P, atom.Ol, atom.Ul, atom.Table, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			case atom.Script, atom.Style, atom.Pre, atom.Audio, atom.Video, atom.Svg, atom.Math, atom.Rt, atom.Rp:
+				continue // don't add spans to elements which should keep text as-is, or to ruby annotations (it breaks the layout)
+			case atom.P, atom.Ol, atom.Ul, atom.Table, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Figcaption, atom.Dt, atom.Dd:
 				incParaNext = true // increment it only if it will have spans in it
 				fallthrough
 			default:
+				if opt.ListItemParagraphs && cur.DataAtom == atom.Li {
+					incParaNext = true
+				}
+				if opt.LineBreakParagraphs && (cur.DataAtom == atom.Br || cur.DataAtom == atom.Hr) {
+					incParaNext = true
+				}
 				if cur.Data == "math" || cur.Data == "svg" {
 					continue
 				}
+				if opt.InlineSentences && !opt.Words {
+					if groups, ok := inlineSentences(cur, opt.Abbreviations); ok {
+						for _, g := range groups {
+							var text string
+							for _, n := range g {
+								text += textContent(n)
+							}
+							if text == "" || (isSpace(text) && cur.DataAtom != atom.P) {
+								continue
+							}
+
+							if incParaNext {
+								para++
+								seg = opt.SegmentBase
+								incParaNext = false
+							}
+
+							seg++
+							s := newKoboSpan()
+							cur.InsertBefore(s, g[0])
+							for _, n := range g {
+								cur.RemoveChild(n)
+								s.AppendChild(n)
+							}
+							trace("span %s (across inline elements): %q", attrValue(s, "id"), text)
+						}
+						continue
+					}
+				}
 				// add the next nodes to the stack (in reverse order, since
 				// we're doing a depth-first traversal from top to bottom).
 				for c := cur.LastChild; c != nil; c = c.PrevSibling {
@@ -385,6 +2575,165 @@ func transformContentKoboSpans(doc *html.Node) {
 	}
 }
 
+// inlineSentences splits the children of n into groups of nodes for each
+// sentence, where sentences may contain entire inline elements, splitting text
+// nodes as required. If n doesn't contain any inline elements, contains
+// anything other than text, comments, and inline elements containing only text
+// and other inline elements, or has a sentence boundary inside an inline
+// element, n is not modified and false is returned. Sentences are not split
+// after abbrs (see mergeAbbreviations).
+func inlineSentences(n *html.Node, abbrs []string) ([][]*html.Node, bool) {
+	var hasInline bool
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			b.WriteString(c.Data)
+		case html.CommentNode:
+			// zero-length
+		case html.ElementNode:
+			if !isInlineText(c) {
+				return nil, false
+			}
+			hasInline = true
+			b.WriteString(textContent(c))
+		default:
+			return nil, false
+		}
+	}
+	if !hasInline {
+		return nil, false
+	}
+
+	// the offsets where each sentence (other than the first) starts
+	var bounds []int
+	var off int
+	str := b.String()
+	for _, sentence := range mergeAbbreviations(str, splitSentences(str, nil), abbrs) {
+		if off != 0 {
+			bounds = append(bounds, off)
+		}
+		off += len(sentence)
+	}
+
+	// make sure there aren't any boundaries inside inline elements
+	off = 0
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			off += len(c.Data)
+		case html.ElementNode:
+			end := off + len(textContent(c))
+			for _, x := range bounds {
+				if x > off && x < end {
+					return nil, false
+				}
+			}
+			off = end
+		}
+	}
+
+	// split the text nodes and group the nodes
+	groups := [][]*html.Node{nil}
+	off = 0
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		for len(bounds) != 0 && bounds[0] == off {
+			if len(groups[len(groups)-1]) != 0 {
+				groups = append(groups, nil)
+			}
+			bounds = bounds[1:]
+		}
+		switch c.Type {
+		case html.TextNode:
+			if len(bounds) != 0 && bounds[0] < off+len(c.Data) {
+				// split the rest into a new node which will be handled next
+				i := bounds[0] - off
+				n.InsertBefore(&html.Node{
+					Type: html.TextNode,
+					Data: c.Data[i:],
+				}, c.NextSibling)
+				c.Data = c.Data[:i]
+			}
+			off += len(c.Data)
+		case html.ElementNode:
+			off += len(textContent(c))
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], c)
+	}
+	if len(groups[len(groups)-1]) == 0 {
+		groups = groups[:len(groups)-1]
+	}
+	return groups, true
+}
+
+// startsWithInlineText checks if the first non-whitespace child of n is a text
+// node or an inline element containing only text.
+func startsWithInlineText(n *html.Node) bool {
+	if n == nil {
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.CommentNode:
+		case c.Type == html.TextNode && isSpace(c.Data):
+		case c.Type == html.TextNode:
+			return true
+		default:
+			return isInlineText(c)
+		}
+	}
+	return false
+}
+
+// isInlineText checks if n is an inline element containing only text and other
+// inline elements.
+func isInlineText(n *html.Node) bool {
+	if n.Type != html.ElementNode || preservesSpace(n) {
+		return false
+	}
+	switch n.DataAtom {
+	case atom.A, atom.Abbr, atom.B, atom.Bdi, atom.Bdo, atom.Cite, atom.Code, atom.Data, atom.Dfn, atom.Em, atom.I, atom.Kbd, atom.Mark, atom.Q, atom.S, atom.Samp, atom.Small, atom.Span, atom.Strong, atom.Sub, atom.Sup, atom.Time, atom.U, atom.Var:
+	default:
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode, html.CommentNode:
+		case html.ElementNode:
+			if !isInlineText(c) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isTrailingSpace checks if n is whitespace after a br element, followed only
+// by whitespace, br elements, and comments in its parent (i.e., it won't be
+// visible). Other whitespace-only text in a paragraph is still wrapped to match
+// Kobo.
+func isTrailingSpace(n *html.Node) bool {
+	p := n.PrevSibling
+	for p != nil && p.Type == html.CommentNode {
+		p = p.PrevSibling
+	}
+	if p == nil || p.Type != html.ElementNode || p.DataAtom != atom.Br {
+		return false
+	}
+	for c := n; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.TextNode && isSpace(c.Data):
+		case c.Type == html.CommentNode:
+		case c.Type == html.ElementNode && c.DataAtom == atom.Br:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // splitSentences splits the string into sentences using the rules for creating
 // koboSpans. To make this zero-allocation, pass a zero-length slice for
 // splitSentences to take ownership of. To re-use the slice, pass the returned
@@ -398,7 +2747,9 @@ func transformContentKoboSpans(doc *html.Node) {
 func splitSentences(str string, sentences []string) []string {
 	const (
 		InputPunct   = iota // sentence-terminating punctuation
+		InputPunctCJ        // CJK sentence-terminating punctuation (which isn't followed by whitespace)
 		InputExtra          // additional punctuation (one is optionionally consumed after punct if present)
+		InputCloseCJ        // CJK closing brackets (any number are consumed after CJK punct)
 		InputSpace          // whitespace
 		InputAny            // any valid rune not previously matched
 		InputInvalid        // an invalid byte
@@ -414,6 +2765,7 @@ func splitSentences(str string, sentences []string) []string {
 		StateAfterPunct             // after the sentence-terminating rune
 		StateAfterPunctExtra        // after the optional additional punctuation rune
 		StateAfterSpace             // the trailing whitespace after the sentence
+		StateAfterPunctCJ           // after the CJK sentence-terminating rune(s) and closing brackets
 	)
 
 	if sentences == nil {
@@ -432,10 +2784,14 @@ func splitSentences(str string, sentences []string) []string {
 			default:
 				input = InputInvalid
 			}
-		case '.', '!', '?':
+		case '.', '!', '?', '।', '॥': // includes the Devanagari danda and double danda
 			input = InputPunct
+		case '。', '！', '？', '、': // includes the ideographic comma
+			input = InputPunctCJ
 		case '\'', '"', '”', '’', '“', '…':
 			input = InputExtra
+		case '」', '』', '）', '〕', '】', '〉', '》':
+			input = InputCloseCJ
 		case '\t', '\n', '\f', '\r', ' ': // \s only matches only ASCII whitespace
 			input = InputSpace
 		default:
@@ -448,7 +2804,9 @@ func splitSentences(str string, sentences []string) []string {
 			switch input {
 			case InputPunct:
 				output, state = OutputNone, StateAfterPunct
-			case InputExtra:
+			case InputPunctCJ:
+				output, state = OutputNone, StateAfterPunctCJ
+			case InputExtra, InputCloseCJ:
 				output, state = OutputNone, StateDefault
 			case InputSpace:
 				output, state = OutputNone, StateDefault
@@ -465,11 +2823,13 @@ func splitSentences(str string, sentences []string) []string {
 			switch input {
 			case InputPunct:
 				output, state = OutputNone, StateAfterPunct
+			case InputPunctCJ:
+				output, state = OutputNone, StateAfterPunctCJ
 			case InputExtra:
 				output, state = OutputNone, StateAfterPunctExtra
 			case InputSpace:
 				output, state = OutputNone, StateAfterSpace
-			case InputAny:
+			case InputAny, InputCloseCJ:
 				output, state = OutputNone, StateDefault
 			case InputInvalid:
 				output, state = OutputNone, StateDefault
@@ -482,11 +2842,13 @@ func splitSentences(str string, sentences []string) []string {
 			switch input {
 			case InputPunct:
 				output, state = OutputNone, StateAfterPunct
+			case InputPunctCJ:
+				output, state = OutputNone, StateAfterPunctCJ
 			case InputExtra:
 				output, state = OutputNone, StateDefault
 			case InputSpace:
 				output, state = OutputNone, StateAfterSpace
-			case InputAny:
+			case InputAny, InputCloseCJ:
 				output, state = OutputNone, StateDefault
 			case InputInvalid:
 				output, state = OutputNone, StateDefault
@@ -499,10 +2861,29 @@ func splitSentences(str string, sentences []string) []string {
 			switch input {
 			case InputPunct:
 				output, state = OutputNext, StateAfterPunct
+			case InputPunctCJ:
+				output, state = OutputNext, StateAfterPunctCJ
 			case InputExtra:
 				output, state = OutputNext, StateDefault
 			case InputSpace:
 				output, state = OutputNone, StateAfterSpace
+			case InputAny, InputCloseCJ:
+				output, state = OutputNext, StateDefault
+			case InputInvalid:
+				output, state = OutputNext, StateDefault
+			case InputEOS:
+				output, state = OutputRest, -1
+			default:
+				panic("unhandled input")
+			}
+		case StateAfterPunctCJ:
+			switch input {
+			case InputPunct:
+				output, state = OutputNext, StateAfterPunct
+			case InputPunctCJ, InputExtra, InputCloseCJ:
+				output, state = OutputNone, StateAfterPunctCJ
+			case InputSpace:
+				output, state = OutputNone, StateAfterSpace
 			case InputAny:
 				output, state = OutputNext, StateDefault
 			case InputInvalid:
@@ -533,8 +2914,67 @@ func splitSentences(str string, sentences []string) []string {
 			panic("unhandled output")
 		}
 	}
-
-	return sentences
+
+	return sentences
+}
+
+// defaultAbbreviations are the abbreviations used by
+// ConverterOptionAbbreviations if none are specified.
+var defaultAbbreviations = []string{"Mr.", "Mrs.", "Dr.", "vs.", "etc.", "e.g.", "i.e."}
+
+// mergeAbbreviations joins sentences split by splitSentences from str where the
+// previous one ends with one of abbrs (ignoring trailing whitespace). The
+// sentences slice is re-used for the result, so it doesn't allocate.
+func mergeAbbreviations(str string, sentences []string, abbrs []string) []string {
+	if len(abbrs) == 0 || len(sentences) < 2 {
+		return sentences
+	}
+	merged := sentences[:0]
+	var start, end int
+	for i, sentence := range sentences {
+		end += len(sentence)
+		if i != len(sentences)-1 && endsWithAbbreviation(sentence, abbrs) {
+			continue
+		}
+		merged = append(merged, str[start:end])
+		start = end
+	}
+	return merged
+}
+
+// endsWithAbbreviation checks if s, ignoring trailing whitespace, ends with one
+// of abbrs, which isn't preceded by a letter or digit.
+func endsWithAbbreviation(s string, abbrs []string) bool {
+	s = strings.TrimRight(s, "\t\n\f\r ")
+	for _, abbr := range abbrs {
+		if abbr == "" || len(s) < len(abbr) || !strings.EqualFold(s[len(s)-len(abbr):], abbr) {
+			continue
+		}
+		if r, _ := utf8.DecodeLastRuneInString(s[:len(s)-len(abbr)]); !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitWords splits s into words and the whitespace between them.
+func splitWords(s string) []string {
+	var words []string
+	var start int
+	var space bool
+	for i, r := range s {
+		if sp := unicode.IsSpace(r); i != 0 && sp != space {
+			words = append(words, s[start:i])
+			start = i
+			space = sp
+		} else if i == 0 {
+			space = sp
+		}
+	}
+	if start < len(s) {
+		words = append(words, s[start:])
+	}
+	return words
 }
 
 func koboSpan(para, seg int) *html.Node {
@@ -549,8 +2989,40 @@ func koboSpan(para, seg int) *html.Node {
 	}
 }
 
+// checkKoboSpanIDs ensures the koboSpan ids in doc are unique.
+func checkKoboSpanIDs(doc *html.Node) error {
+	seen := map[string]bool{}
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode && matchAttr(cur, "class", "koboSpan") {
+			for _, a := range cur.Attr {
+				if a.Key == "id" {
+					if seen[a.Val] {
+						return fmt.Errorf("duplicate koboSpan id %q", a.Val)
+					}
+					seen[a.Val] = true
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+	return nil
+}
+
 func transformContentAddStyle(doc *html.Node, class, css string) {
-	findAtom(doc, atom.Head).AppendChild(withText(&html.Node{
+	head := findAtom(doc, atom.Head)
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Style && (matchAttr(c, "class", class) || matchAttr(c, "id", class)) && c.FirstChild != nil && c.FirstChild.Data == css {
+			return // already added (i.e., the book was already converted)
+		}
+	}
+	head.AppendChild(withText(&html.Node{
 		Type:     html.ElementNode,
 		DataAtom: atom.Style,
 		Data:     "style",
@@ -561,17 +3033,67 @@ func transformContentAddStyle(doc *html.Node, class, css string) {
 	}, css))
 }
 
+// documentLanguage gets the language of doc from the lang or xml:lang
+// attribute on the root element, falling back to def.
+func documentLanguage(doc *html.Node, def string) string {
+	if n := findAtom(doc, atom.Html); n != nil {
+		for _, a := range n.Attr {
+			if (a.Key == "lang" || a.Key == "xml:lang" || (a.Namespace == "xml" && a.Key == "lang")) && strings.TrimSpace(a.Val) != "" {
+				return strings.TrimSpace(a.Val)
+			}
+		}
+	}
+	return def
+}
+
+// transformContentLanguage sets the lang and xml:lang attributes on the root
+// element if it doesn't already specify a language.
+func transformContentLanguage(doc *html.Node, lang string) {
+	n := findAtom(doc, atom.Html)
+	if n == nil || lang == "" || documentLanguage(doc, "") != "" {
+		return
+	}
+	n.Attr = append(n.Attr,
+		html.Attribute{Key: "lang", Val: lang},
+		html.Attribute{Key: "xml:lang", Val: lang})
+}
+
 func transformContentPunctuation(doc *html.Node) {
+	transformContentPunctuationWithOptions(doc, punctuationOptions{})
+}
+
+// punctuationOptions customizes transformContentPunctuationWithOptions.
+type punctuationOptions struct {
+	// Language is the BCP 47 language tag used to choose the quote style.
+	Language string
+
+	// NoEllipses leaves three dots (...) and spaced dots (. . .) as-is
+	// rather than converting them to an ellipsis.
+	NoEllipses bool
+
+	// NoSpacedEllipses leaves spaced dots (. . .) as-is.
+	NoSpacedEllipses bool
+}
+
+// spacedEllipsisRe matches spaced dots which smartypants converts into an
+// ellipsis.
+var spacedEllipsisRe = regexp.MustCompile(`\.(?: \.)+`)
+
+func transformContentPunctuationWithOptions(doc *html.Node, opt punctuationOptions) {
 	var stack []*html.Node
 	var cur *html.Node
 	stack = append(stack, findAtom(doc, atom.Body))
 
+	// convert the quotes first since smartypants only sees a single text node
+	// at a time
+	smartenQuotes(stack[0], &quoteState{style: quoteStyleFor(opt.Language)})
+
 	for len(stack) != 0 {
 		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
 		switch cur.Type {
 		case html.ElementNode:
-			switch cur.DataAtom {
-			case atom.Pre, atom.Code, atom.Style, atom.Script:
+			switch {
+			case cur.DataAtom == atom.Pre, cur.DataAtom == atom.Code, cur.DataAtom == atom.Style, cur.DataAtom == atom.Script, cur.DataAtom == atom.Svg, cur.DataAtom == atom.Math, preservesSpace(cur):
 				continue
 			default:
 				for c := cur.LastChild; c != nil; c = c.PrevSibling {
@@ -580,21 +3102,244 @@ func transformContentPunctuation(doc *html.Node) {
 			}
 		case html.TextNode:
 			if !isSpace(cur.Data) {
+				// smartypants only handles runs of up to three hyphens (and
+				// splits longer ones), so replace the longer runs first
+				data := dashRunRe.ReplaceAllStringFunc(cur.Data, func(run string) string {
+					return strings.Repeat("\u2014", len(run)/2)
+				})
+				// hide the dots from smartypants (which can't be configured
+				// to leave them alone) if ellipses are disabled (note: the
+				// parser never leaves NUL bytes in the text)
+				switch {
+				case opt.NoEllipses:
+					data = strings.ReplaceAll(data, ".", "\x00")
+				case opt.NoSpacedEllipses:
+					data = spacedEllipsisRe.ReplaceAllStringFunc(data, func(dots string) string {
+						return strings.ReplaceAll(dots, ".", "\x00")
+					})
+				}
 				buf := bytes.NewBuffer(nil)
-				if _, err := smartypants.New(buf, smartypants.LatexDashes).Write([]byte(cur.Data)); err != nil {
+				if _, err := smartypants.New(buf, smartypants.LatexDashes).Write([]byte(data)); err != nil {
 					panic(err) // smartypants should never error on its own
 				}
 				// (*smartypants.writer).write calls smartypants.attrEscape on
 				// the passed data (which has been unescaped by the parser),
 				// which escapes the HTML entities, so we need to unescape it
 				// after it has been processed.
-				cur.Data = html.UnescapeString(buf.String())
+				cur.Data = strings.ReplaceAll(html.UnescapeString(buf.String()), "\x00", ".")
+			}
+		}
+	}
+}
+
+// dashRunRe matches runs of hyphens longer than an em dash (---). They are
+// replaced with one em dash for every two hyphens (e.g., ---- is a 2-em dash).
+var dashRunRe = regexp.MustCompile(`-{4,}`)
+
+// quoteState tracks the quotes in a block of text for smartenQuotes.
+type quoteState struct {
+	prev   rune        // the previous character, or 0 at the start of the block
+	double bool        // whether a double quote is open
+	single bool        // whether a single quote is open
+	style  *quoteStyle // if not nil, the quotes to use instead of English ones
+}
+
+// quoteStyle is the opening and closing double and single quotes for a
+// language.
+type quoteStyle struct {
+	OpenDouble, CloseDouble rune
+	OpenSingle, CloseSingle rune
+}
+
+// quoteStyles are the quotes for languages which don't use English ones, by
+// primary language subtag.
+var quoteStyles = map[string]quoteStyle{
+	"cs": {'„', '“', '‚', '‘'},
+	"da": {'»', '«', '›', '‹'},
+	"de": {'„', '“', '‚', '‘'},
+	"fi": {'”', '”', '’', '’'},
+	"fr": {'«', '»', '‹', '›'},
+	"ja": {'「', '」', '『', '』'},
+	"nl": {'„', '”', '‚', '’'},
+	"pl": {'„', '”', '«', '»'},
+	"ru": {'«', '»', '„', '“'},
+	"sv": {'”', '”', '’', '’'},
+	"uk": {'«', '»', '„', '“'},
+}
+
+// quoteStyleFor gets the quoteStyle for the BCP 47 language tag lang, or nil
+// for English quotes.
+func quoteStyleFor(lang string) *quoteStyle {
+	if i := strings.IndexAny(lang, "-_"); i != -1 {
+		lang = lang[:i]
+	}
+	if qs, ok := quoteStyles[strings.ToLower(lang)]; ok {
+		return &qs
+	}
+	return nil
+}
+
+// smartenQuotes replaces straight quotes in the text under n with curly ones.
+// The previous character and the open quotes (including existing curly ones)
+// are tracked across text nodes, so quotes are paired correctly when split by
+// inline elements or mixed with curly quotes. The state is reset at the edges
+// of block-level elements.
+func smartenQuotes(n *html.Node, s *quoteState) {
+	switch n.Type {
+	case html.TextNode:
+		n.Data = s.smarten(n.Data)
+		return
+	case html.ElementNode:
+		if preservesSpace(n) {
+			return
+		}
+		switch n.DataAtom {
+		case atom.Pre, atom.Code, atom.Style, atom.Script, atom.Svg, atom.Math:
+			return
+		case atom.P, atom.Div, atom.Br, atom.Hr, atom.Li, atom.Dt, atom.Dd, atom.Tr, atom.Td, atom.Th, atom.Blockquote, atom.Figcaption, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			*s = quoteState{style: s.style}
+			defer func() { *s = quoteState{style: s.style} }()
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		smartenQuotes(c, s)
+	}
+}
+
+func (s *quoteState) smarten(text string) string {
+	if !strings.ContainsAny(text, "\"'“”‘’") {
+		if r, _ := utf8.DecodeLastRuneInString(text); r != utf8.RuneError {
+			s.prev = r
+		}
+		return text
+	}
+
+	rs := []rune(text)
+	for i, r := range rs {
+		var next rune
+		if i+1 < len(rs) {
+			next = rs[i+1]
+		}
+
+		opening := s.prev == 0 || unicode.IsSpace(s.prev) || strings.ContainsRune("([{“‘–—", s.prev)
+		closing := next == 0 || unicode.IsSpace(next) || strings.ContainsRune(".,;:!?)]}…–—", next)
+
+		switch r {
+		case '"':
+			if opening || (!closing && !s.double) {
+				rs[i] = '“'
+			} else {
+				rs[i] = '”'
+			}
+		case '\'':
+			switch {
+			case unicode.IsLetter(s.prev) || unicode.IsDigit(s.prev):
+				rs[i] = '’' // apostrophe or closing quote
+			case opening && unicode.IsDigit(next):
+				rs[i] = '’' // abbreviated year
+			case opening || (!closing && !s.single):
+				rs[i] = '‘'
+			default:
+				rs[i] = '’'
+			}
+		}
+
+		switch rs[i] {
+		case '“':
+			s.double = true
+		case '”':
+			s.double = false
+		case '‘':
+			s.single = true
+		case '’':
+			if !unicode.IsLetter(next) {
+				s.single = false // not an apostrophe
+			}
+		}
+		s.prev = rs[i]
+
+		if s.style != nil && r != rs[i] {
+			switch rs[i] {
+			case '“':
+				rs[i] = s.style.OpenDouble
+			case '”':
+				rs[i] = s.style.CloseDouble
+			case '‘':
+				rs[i] = s.style.OpenSingle
+			case '’':
+				if !unicode.IsLetter(next) && !unicode.IsDigit(next) {
+					rs[i] = s.style.CloseSingle // not an apostrophe
+				}
+			}
+		}
+	}
+	return string(rs)
+}
+
+// logReplacementChars calls log with the rune offset (from the start of the
+// text in doc) and the surrounding text in the same text node of each
+// replacement character. If fn isn't empty, it is included in the message.
+func logReplacementChars(doc *html.Node, fn string, log func(format string, a ...interface{})) {
+	const context = 20
+
+	var off int
+	walkAllText(doc, func(s string) {
+		text := []rune(s)
+		for i, r := range text {
+			if r != '\uFFFD' {
+				continue
+			}
+			start, end := i-context, i+context+1
+			if start < 0 {
+				start = 0
+			}
+			if end > len(text) {
+				end = len(text)
 			}
+			if fn != "" {
+				log("replacement character in %q at offset %d: %q", fn, off+i, string(text[start:end]))
+			} else {
+				log("replacement character at offset %d: %q", off+i, string(text[start:end]))
+			}
+		}
+		off += len(text)
+	})
+}
+
+// mapText replaces the data of each TextNode under n (other than in script and
+// style elements) with fn(data).
+func mapText(n *html.Node, fn func(string) string) {
+	switch n.Type {
+	case html.TextNode:
+		n.Data = fn(n.Data)
+		return
+	case html.ElementNode:
+		switch n.DataAtom {
+		case atom.Script, atom.Style:
+			return
 		}
 	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		mapText(c, fn)
+	}
+}
+
+// walkAllText calls visit with the data of every TextNode under n in document
+// order.
+func walkAllText(n *html.Node, visit func(text string)) {
+	if n.Type == html.TextNode {
+		visit(n.Data)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkAllText(c, visit)
+	}
 }
 
 func transformContentClean(doc *html.Node) {
+	transformContentCleanWithOptions(doc, false)
+}
+
+func transformContentCleanWithOptions(doc *html.Node, keepReplacement bool) {
 	var stack []*html.Node
 	var cur *html.Node
 	stack = append(stack, doc)
@@ -603,7 +3348,7 @@ func transformContentClean(doc *html.Node) {
 		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
 		switch cur.Type {
 		case html.TextNode:
-			if strings.ContainsRune(cur.Data, '�') {
+			if !keepReplacement && strings.ContainsRune(cur.Data, '�') {
 				cur.Data = strings.ReplaceAll(cur.Data, "�", "")
 			}
 		case html.ElementNode:
@@ -629,6 +3374,82 @@ func transformContentClean(doc *html.Node) {
 	}
 }
 
+// transformContentKoboOnly removes iBooks attributes (e.g., ibooks:version)
+// and links to ADE page templates.
+func transformContentKoboOnly(doc *html.Node) {
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, doc)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			if cur.DataAtom == atom.Link && (attrValue(cur, "type") == "application/vnd.adobe-page-template+xml" || strings.EqualFold(path.Ext(attrValue(cur, "href")), ".xpgt")) {
+				cur.Parent.RemoveChild(cur)
+				continue
+			}
+			attr := cur.Attr[:0]
+			for _, a := range cur.Attr {
+				if a.Namespace == "ibooks" || strings.HasPrefix(a.Key, "ibooks:") || a.Key == "xmlns:ibooks" {
+					continue
+				}
+				attr = append(attr, a)
+			}
+			cur.Attr = attr
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
+
+func transformContentRemoveEmpty(doc *html.Node) {
+	removeEmpty(findAtom(doc, atom.Body))
+}
+
+// removeEmpty recursively removes div and span elements without any attributes
+// or children (including ones which only became empty after removing their
+// children).
+func removeEmpty(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode {
+			removeEmpty(c)
+			if (c.DataAtom == atom.Div || c.DataAtom == atom.Span) && len(c.Attr) == 0 && c.FirstChild == nil {
+				n.RemoveChild(c)
+			}
+		}
+		c = next
+	}
+}
+
+func transformContentXMLDeclaration(doc *html.Node) {
+	if xmlDeclaration(doc) != nil {
+		return
+	}
+	doc.InsertBefore(&html.Node{
+		Type: html.CommentNode,
+		Data: `?xml version="1.0" encoding="utf-8"?`,
+	}, doc.FirstChild)
+}
+
+// xmlDeclarationEncodingRe matches the encoding in an XML declaration, with the
+// quote and value in the second and third submatches (or the fourth and fifth
+// if single-quoted).
+var xmlDeclarationEncodingRe = regexp.MustCompile(`(\sencoding\s*=\s*)(?:(")([^"]*)"|(')([^']*)')`)
+
+// xmlDeclaration finds the XML declaration in the document, if any. It is
+// parsed as a bogus comment, and is rendered as-is when
+// RenderOptionAllowXMLDeclarations is enabled.
+func xmlDeclaration(doc *html.Node) *html.Node {
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.CommentNode && len(c.Data) > 4 && c.Data[:4] == "?xml" && strings.ContainsRune(" \t\r\n?", rune(c.Data[4])) {
+			return c
+		}
+	}
+	return nil
+}
+
 func transformContentReplacements(w io.Writer, find, replace [][]byte) io.WriteCloser {
 	var t []transform.Transformer
 	if len(find) != len(replace) {
@@ -825,6 +3646,124 @@ func transformDummyTitlepageAdd(opf *bytes.Buffer, opfF string) (string, io.Read
 	return fn, strings.NewReader(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml" lang="en"><head><title></title></head><body><p style="text-align: center; margin: 4em 0; font-size: .7em; font-style: italic;">Page intentionally left blank by kepubify.</p></body></html>`), nil
 }
 
+// transformImage downscales a JPEG or PNG image to fit within max (preserving
+// the aspect ratio), and re-encodes it in the same format. If the image already
+// fits, if it isn't a JPEG or PNG, or if it has more than maxImagePixels pixels
+// (to protect against decompression bombs), nothing is written and false is
+// returned.
+//
+// The image is resampled using an area average, which is slower than the
+// filters used by covergen, but doesn't add any dependencies and gives
+// acceptable results for downscaling.
+func transformImage(w io.Writer, r io.Reader, max image.Point) (bool, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return false, nil // not something we can (or need to) resize
+	}
+
+	sz := fitImageSize(image.Pt(cfg.Width, cfg.Height), max)
+	if sz.X == cfg.Width && sz.Y == cfg.Height {
+		return false, nil
+	}
+
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return false, nil // too large to safely decode
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return false, fmt.Errorf("decode %s: %w", format, err)
+	}
+	img = scaleImage(img, sz)
+
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	case "png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(w, img)
+	}
+	if err != nil {
+		return false, fmt.Errorf("encode %s: %w", format, err)
+	}
+	return true, nil
+}
+
+// maxImagePixels is the maximum number of pixels in an image transformImage
+// will decode (about 256 MB as RGBA).
+const maxImagePixels = 64 << 20
+
+// fitImageSize scales sz down to fit within max, preserving the aspect ratio.
+// If sz already fits or max is empty, it is returned as-is.
+func fitImageSize(sz, max image.Point) image.Point {
+	if max.X <= 0 || max.Y <= 0 || (sz.X <= max.X && sz.Y <= max.Y) {
+		return sz
+	}
+	if sz.X*max.Y > sz.Y*max.X {
+		return image.Pt(max.X, int(math.Max(1, math.Round(float64(sz.Y)*float64(max.X)/float64(sz.X)))))
+	}
+	return image.Pt(int(math.Max(1, math.Round(float64(sz.X)*float64(max.Y)/float64(sz.Y)))), max.Y)
+}
+
+// scaleImage downscales img to sz by averaging the source pixels covered by
+// each destination pixel. Grayscale images stay grayscale.
+func scaleImage(img image.Image, sz image.Point) image.Image {
+	b := img.Bounds()
+
+	var dst draw.Image
+	if img.ColorModel() == color.GrayModel {
+		dst = image.NewGray(image.Rect(0, 0, sz.X, sz.Y))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, sz.X, sz.Y))
+	}
+
+	for y := 0; y < sz.Y; y++ {
+		y0 := b.Min.Y + y*b.Dy()/sz.Y
+		y1 := b.Min.Y + (y+1)*b.Dy()/sz.Y
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < sz.X; x++ {
+			x0 := b.Min.X + x*b.Dx()/sz.X
+			x1 := b.Min.X + (x+1)*b.Dx()/sz.X
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// isSVGDocument checks if the root element of the (possibly truncated) XML
+// document is an svg element.
+func isSVGDocument(b []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			return false
+		}
+		if el, ok := t.(xml.StartElement); ok {
+			return strings.EqualFold(el.Name.Local, "svg")
+		}
+	}
+}
+
 // withText adds text to a node and returns it.
 func withText(node *html.Node, text string) *html.Node {
 	if node.Type != html.ElementNode {
@@ -850,6 +3789,64 @@ func matchAttr(n *html.Node, key, value string) bool {
 	return false
 }
 
+// attrValue gets the value of an attribute on an ElementNode, ignoring
+// namespaces, or an empty string if it doesn't exist.
+func attrValue(n *html.Node, key string) string {
+	if n != nil && n.Type == html.ElementNode {
+		for _, a := range n.Attr {
+			if a.Key == key {
+				return a.Val
+			}
+		}
+	}
+	return ""
+}
+
+// preservesSpace checks if an ElementNode has xml:space="preserve", which means
+// it should be handled like a pre element.
+func preservesSpace(n *html.Node) bool {
+	if n.Type == html.ElementNode {
+		for _, a := range n.Attr {
+			if (a.Key == "xml:space" || (a.Namespace == "xml" && a.Key == "space")) && a.Val == "preserve" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkText calls visit with the text of each TextNode under n (including n
+// itself) in document order, skipping the contents of script, style, and pre
+// elements. A newline is also visited before and after each block-level
+// element so text in adjacent blocks isn't joined.
+func walkText(n *html.Node, visit func(text string)) {
+	switch n.Type {
+	case html.TextNode:
+		visit(n.Data)
+		return
+	case html.ElementNode:
+		switch n.DataAtom {
+		case atom.Script, atom.Style, atom.Pre:
+			return
+		case atom.P, atom.Div, atom.Br, atom.Hr, atom.Li, atom.Dt, atom.Dd, atom.Tr, atom.Td, atom.Th, atom.Blockquote, atom.Figcaption, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			visit("\n")
+			defer visit("\n")
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkText(c, visit)
+	}
+}
+
+// textContent gets the text under n (see walkText).
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	walkText(n, func(text string) {
+		b.WriteString(text)
+	})
+	return b.String()
+}
+
 // findAtom finds the first occurrence of an ElementNode matching the Atom.
 func findAtom(n *html.Node, a atom.Atom) *html.Node {
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
@@ -880,6 +3877,98 @@ func findClass(n *html.Node, t string) *html.Node {
 	return nil
 }
 
+// editInlineStyle calls fn for each declaration in the style attribute of n
+// with the lowercase property name and the trimmed value, replacing the value
+// with the one returned, or removing the declaration if fn returns false. The
+// attribute is only re-written if something changed, and is removed if it is
+// empty afterwards.
+func editInlineStyle(n *html.Node, fn func(prop, val string) (string, bool)) {
+	for i, a := range n.Attr {
+		if a.Namespace != "" || a.Key != "style" {
+			continue
+		}
+
+		var changed bool
+		decls := strings.Split(a.Val, ";")
+		out := decls[:0]
+		for _, d := range decls {
+			c := strings.IndexByte(d, ':')
+			if c == -1 {
+				out = append(out, d)
+				continue
+			}
+			val := strings.TrimSpace(d[c+1:])
+			nval, keep := fn(strings.ToLower(strings.TrimSpace(d[:c])), val)
+			if !keep {
+				changed = true
+				continue
+			}
+			if nval != val {
+				changed = true
+				v := d[c+1:]
+				d = d[:c+1] + v[:len(v)-len(strings.TrimLeft(v, " \t\r\n\f"))] + nval
+			}
+			out = append(out, d)
+		}
+		if !changed {
+			return
+		}
+
+		if style := strings.TrimLeft(strings.Join(out, ";"), " \t\r\n\f;"); isSpace(strings.ReplaceAll(style, ";", "")) {
+			n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+		} else {
+			n.Attr[i].Val = style
+		}
+		return
+	}
+}
+
+// matchPlainSpan checks if a node is a span which isn't a koboSpan and doesn't
+// have an id.
+func matchPlainSpan(n *html.Node) bool {
+	if n.Type != html.ElementNode || n.DataAtom != atom.Span {
+		return false
+	}
+	for _, a := range n.Attr {
+		if a.Key == "id" || (a.Key == "class" && includes(a.Val, "koboSpan")) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAttrs checks if two nodes have the same attributes, ignoring order.
+func matchAttrs(a, b *html.Node) bool {
+	if len(a.Attr) != len(b.Attr) {
+		return false
+	}
+	for _, x := range a.Attr {
+		var found bool
+		for _, y := range b.Attr {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeText joins adjacent text nodes which are direct children of n.
+func mergeText(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		if next := c.NextSibling; c.Type == html.TextNode && next != nil && next.Type == html.TextNode {
+			c.Data += next.Data
+			n.RemoveChild(next)
+			continue
+		}
+		c = c.NextSibling
+	}
+}
+
 // matchEmpty checks if a node only has comments or whitespace as direct children.
 func matchEmpty(n *html.Node) bool {
 	for child := n.FirstChild; child != nil; child = child.NextSibling {
@@ -2,11 +2,16 @@ package kepub
 
 import (
 	"bytes"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"path"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"testing/fstest"
@@ -14,6 +19,7 @@ import (
 	"github.com/beevik/etree"
 
 	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
 )
 
 func TestTransformContent(t *testing.T) {
@@ -94,6 +100,377 @@ func TestTransformContent(t *testing.T) {
 	}
 }
 
+func TestTransformContentSVG(t *testing.T) {
+	for _, tc := range []struct {
+		What string
+		In   string
+		SVG  bool
+	}{
+		{"svg with xml declaration and doctype", `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd">` + "\n" + `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" viewBox="0 0 100 100"><text x="10" y="50">Sentence 1. Sentence 2.</text></svg>`, true},
+		{"svg with comment and namespace prefix", `<!-- cover --><svg:svg xmlns:svg="http://www.w3.org/2000/svg"><svg:image href="cover.png"/></svg:svg>`, true},
+		{"xhtml with svg body", `<?xml version="1.0" encoding="UTF-8"?><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body><svg xmlns="http://www.w3.org/2000/svg"></svg></body></html>`, false},
+		{"html", `<!DOCTYPE html><p>Sentence 1.</p>`, false},
+		{"text", `Sentence 1.`, false},
+	} {
+		if a := isSVGDocument([]byte(tc.In)); a != tc.SVG {
+			t.Errorf("case %q: expected svg=%t, got %t", tc.What, tc.SVG, a)
+		}
+		if tc.SVG {
+			buf := bytes.NewBuffer(nil)
+			if err := new(Converter).TransformContent(buf, strings.NewReader(tc.In)); err != nil {
+				t.Errorf("case %q: transform: unexpected error: %v", tc.What, err)
+			} else if buf.String() != tc.In {
+				t.Errorf("case %q: expected svg to be unchanged, got %q", tc.What, buf.String())
+			}
+		}
+	}
+}
+
+func TestTransformContentXMLDeclaration(t *testing.T) {
+	for _, tc := range []struct {
+		What    string
+		Charset string
+		In      string
+		Out     string
+	}{
+		{"missing declaration", "", `<!DOCTYPE html><html><head><title></title></head><body></body></html>`, `<?xml version="1.0" encoding="utf-8"?><!DOCTYPE html>`},
+		{"existing declaration", "", `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<!DOCTYPE html><html><head><title></title></head><body></body></html>`, `<?xml version="1.0" encoding="UTF-8"?><!DOCTYPE html>`},
+		{"single quotes", "", `<?xml version='1.0' encoding='utf-8'?><!DOCTYPE html><html><head><title></title></head><body></body></html>`, `<?xml version='1.0' encoding='utf-8'?><!DOCTYPE html>`},
+		{"other whitespace", "", "<?xml\tversion=\"1.0\"\n  encoding = \"UTF-8\" standalone=\"no\" ?><!DOCTYPE html><html><head><title></title></head><body></body></html>", "<?xml version=\"1.0\"\n  encoding = \"UTF-8\" standalone=\"no\" ?><!DOCTYPE html>"},
+		{"without encoding", "", `<?xml version="1.0"?><!DOCTYPE html><html><head><title></title></head><body></body></html>`, `<?xml version="1.0"?><!DOCTYPE html>`},
+		{"custom encoding", "iso-8859-1", `<?xml version="1.0" encoding="ISO-8859-1"?><!DOCTYPE html><html><head><title></title></head><body></body></html>`, `<?xml version="1.0" encoding="UTF-8"?><!DOCTYPE html>`},
+		{"custom encoding with single quotes", "iso-8859-1", `<?xml version='1.0' encoding='ISO-8859-1'?><!DOCTYPE html><html><head><title></title></head><body></body></html>`, `<?xml version='1.0' encoding='UTF-8'?><!DOCTYPE html>`},
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := (&Converter{xmlDeclaration: true, charset: tc.Charset}).TransformContent(buf, strings.NewReader(tc.In)); err != nil {
+			t.Errorf("case %q: transform: unexpected error: %v", tc.What, err)
+		} else if !strings.HasPrefix(buf.String(), tc.Out) {
+			t.Errorf("case %q: expected output to start with %q, got %q", tc.What, tc.Out, buf.String())
+		} else if n := strings.Count(buf.String(), "<?xml"); n != 1 {
+			t.Errorf("case %q: expected one xml declaration, got %d", tc.What, n)
+		}
+	}
+}
+
+func TestTransformContentProcessingInstructions(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := (&Converter{}).TransformContent(buf, strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<?xml-model href="http://www.idpf.org/epub/30/schema/epub-nav-30.rnc" type="application/relax-ng-compact-syntax"?>
+<!DOCTYPE html>
+<?xml-stylesheet type="text/css" href="style.css"?>
+<!-- comment -->
+<html><head><title></title></head><body><p>Test.</p></body></html>`)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	if exp := `<?xml version="1.0" encoding="UTF-8"?><?xml-model href="http://www.idpf.org/epub/30/schema/epub-nav-30.rnc" type="application/relax-ng-compact-syntax"?><!DOCTYPE html><?xml-stylesheet type="text/css" href="style.css"?><!-- comment --><html xmlns="http://www.w3.org/1999/xhtml"><head>`; !strings.HasPrefix(buf.String(), exp) {
+		t.Errorf("expected output to start with %q, got %q", exp, buf.String())
+	}
+}
+
+func TestTransformContentNonBreakingSpace(t *testing.T) {
+	for _, repr := range []string{"", "&#160;", "&#xA0;", "\u00a0"} {
+		exp := repr
+		if exp == "" {
+			exp = "&#160;"
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := (&Converter{nbsp: repr}).TransformContent(buf, strings.NewReader(`<!DOCTYPE html><html><head><title></title></head><body><p>One&nbsp;two &#160; three`+"\u00a0"+`four &amp;#160;</p></body></html>`)); err != nil {
+			t.Errorf("repr %q: transform: unexpected error: %v", repr, err)
+		} else if out := buf.String(); !strings.Contains(out, `One`+exp+`two `+exp+` three`+exp+`four &amp;#160;`) {
+			t.Errorf("repr %q: expected all non-breaking spaces to be %q, got %q", repr, exp, out)
+		} else {
+			d := xml.NewDecoder(strings.NewReader(out))
+			for {
+				if _, err := d.Token(); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Errorf("repr %q: expected output to be well-formed XML, got error: %v", repr, err)
+					break
+				}
+			}
+		}
+	}
+	for _, repr := range []string{"&amp;", "&nbsp;"} {
+		if err := (&Converter{nbsp: repr}).TransformContent(io.Discard, strings.NewReader(`<p>&nbsp;</p>`)); err == nil {
+			t.Errorf("repr %q: expected error for invalid representation", repr)
+		}
+	}
+}
+
+func TestTransformContentLowercase(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := new(Converter).TransformContent(buf, strings.NewReader(`<!DOCTYPE html><HTML><HEAD><TITLE></TITLE><LINK REL="stylesheet" HREF="style.css"/></HEAD><BODY CLASS="Body"><DIV ID="Main"><P CLASS="X" STYLE="Color: Red">One. <A HREF="Ch2.xhtml#Note">Two.</A><BR/><IMG SRC="Image.PNG" ALT="Alt"/></P><SVG XMLNS="http://www.w3.org/2000/svg" VIEWBOX="0 0 10 10"><FOREIGNOBJECT/></SVG></DIV></BODY></HTML>`)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	out := buf.String()
+	for _, exp := range []string{
+		`<html `, `<head>`, `<title></title>`, `<link rel="stylesheet" href="style.css"/>`,
+		`<body class="Body">`, `<div id="Main">`, `<p class="X" style="Color: Red">`,
+		`<a href="Ch2.xhtml#Note">`, `<br/>`, `<img src="Image.PNG" alt="Alt"/>`,
+		`viewBox="0 0 10 10"`, `<foreignObject>`, // svg names keep their canonical case
+	} {
+		if !strings.Contains(out, exp) {
+			t.Errorf("expected output to contain %q, got %q", exp, out)
+		}
+	}
+	if m := regexp.MustCompile(`</?[A-Z]|\s[A-Z]+=`).FindString(out); m != "" {
+		t.Errorf("expected output to have lowercase element and attribute names, found %q in %q", m, out)
+	}
+}
+
+func TestTransformContentPre(t *testing.T) {
+	// note: the leading newline is significant since the parser drops the first
+	// one, and the quotes are escaped since the renderer always escapes them
+	pre := "\n\n    leading spaces\n\n\n\tTabbed -- &#34;quoted&#34; &#39;text&#39;...   \n  <b>bold</b>  &lt;tag&gt; \n\n"
+	buf := bytes.NewBuffer(nil)
+	if err := (&Converter{
+		smartypants:  true,
+		flattenSpans: true,
+		stripJustify: true,
+		removeEmpty:  true,
+	}).TransformContent(buf, strings.NewReader(`<!DOCTYPE html><html><head><title></title></head><body><p>Text.</p><pre>`+pre+`</pre><p>Text.</p></body></html>`)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	if exp := "<pre>" + pre + "</pre>"; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected pre contents to be preserved exactly as %q, got %q", exp, buf.String())
+	}
+}
+
+func TestTransformContentLists(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := (&Converter{
+		smartypants:  true,
+		flattenSpans: true,
+		removeEmpty:  true,
+		spans:        koboSpanOptions{ListItemParagraphs: true, InlineSentences: true},
+	}).TransformContent(buf, strings.NewReader(`<!DOCTYPE html><html><head><title></title></head><body><ol start="5" reversed=""><li>Five.</li><li value="8">Eight.</li><li><span>Seven.</span></li></ol><ul><li value="2">Bullet.</li></ul></body></html>`)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	for _, exp := range []string{
+		`<ol start="5" reversed="">`,
+		`<li value="8"><span class="koboSpan" id="kobo.2.1">Eight.</span></li>`,
+		`<li value="2">`,
+	} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected list numbering to be preserved as %q, got %q", exp, buf.String())
+		}
+	}
+}
+
+func TestTransformContentKoboDivsSingleChild(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<!DOCTYPE html><html><head><title></title></head><body><p>Test</p></body></html>`))
+	if err != nil {
+		panic(err)
+	}
+	transformContentKoboDivs(doc)
+
+	// check the pointers too, since the renderer only follows the children
+	body := findAtom(doc, atom.Body)
+	columns := body.FirstChild
+	if columns == nil || columns != body.LastChild || columns.Parent != body || !matchAttr(columns, "id", "book-columns") {
+		t.Fatalf("expected body to only contain div#book-columns")
+	}
+	inner := columns.FirstChild
+	if inner == nil || inner != columns.LastChild || inner.Parent != columns || !matchAttr(inner, "id", "book-inner") {
+		t.Fatalf("expected div#book-columns to only contain div#book-inner")
+	}
+	p := inner.FirstChild
+	if p == nil || p != inner.LastChild || p.Parent != inner || p.DataAtom != atom.P || p.PrevSibling != nil || p.NextSibling != nil {
+		t.Fatalf("expected div#book-inner to only contain the paragraph")
+	}
+}
+
+func TestTransformContentIdempotent(t *testing.T) {
+	c := NewConverterWithOptions(
+		ConverterOptionAddCSS(`p { color: black; }`),
+		ConverterOptionAddCSS(`p { margin: 0; }`),
+		ConverterOptionHyphenate(true),
+		ConverterOptionSmartypants(),
+		ConverterOptionChapterMarkers(),
+		ConverterOptionContentTitles(),
+		ConverterOptionXMLDeclaration(),
+	)
+
+	first := bytes.NewBuffer(nil)
+	if err := c.TransformContent(first, strings.NewReader(`<!DOCTYPE html><html><head><title></title></head><body><h1>Title</h1><p>"One" -- two. Three.</p><p><img src="a.png"/></p></body></html>`)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+
+	second := bytes.NewBuffer(nil)
+	if err := c.TransformContent(second, bytes.NewReader(first.Bytes())); err != nil {
+		t.Fatalf("transform again: unexpected error: %v", err)
+	}
+
+	if first.String() != second.String() {
+		t.Errorf("expected transforming an already transformed document to be a no-op:\n%s\n---\n%s", first, second)
+	}
+}
+
+func TestTransformContentKoboSpansWords(t *testing.T) {
+	const in = `<!DOCTYPE html><html><head><title></title></head><body><p>The quick brown fox. Jumps over the <i>lazy</i> dog!</p></body></html>`
+	for _, tc := range []struct {
+		What  string
+		Words bool
+		Spans int
+	}{
+		{"sentences", false, 4},
+		{"words", true, 9},
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := (&Converter{spans: koboSpanOptions{Words: tc.Words}}).TransformContent(buf, strings.NewReader(in)); err != nil {
+			t.Fatalf("%s: transform: unexpected error: %v", tc.What, err)
+		}
+		if n := strings.Count(buf.String(), `class="koboSpan"`); n != tc.Spans {
+			t.Errorf("%s: expected %d spans, got %d", tc.What, tc.Spans, n)
+		}
+		if exp := fmt.Sprintf(`id="kobo.1.%d"`, tc.Spans); !strings.Contains(buf.String(), exp) {
+			t.Errorf("%s: expected the last span to be %s", tc.What, exp)
+		}
+	}
+}
+
+func TestTransformContentEPUBType(t *testing.T) {
+	const in = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title></title></head><body>
+<section epub:type="chapter"><p>Text.<a epub:type="noteref" href="#fn1">1</a><span epub:type="pagebreak" id="page5" title="5"/></p></section>
+<aside epub:type="footnote" id="fn1"><p>Note.</p></aside>
+<nav epub:type="landmarks"><ol><li><a epub:type="bodymatter" href="#">Start</a></li></ol></nav>
+</body></html>`
+
+	buf := bytes.NewBuffer(nil)
+	if err := NewConverter().TransformContent(buf, strings.NewReader(in)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	for _, x := range []string{
+		`xmlns:epub="http://www.idpf.org/2007/ops"`,
+		`<section epub:type="chapter">`,
+		`<a epub:type="noteref" href="#fn1">`,
+		`<span epub:type="pagebreak" id="page5" title="5"></span>`,
+		`<aside epub:type="footnote" id="fn1">`,
+		`<nav epub:type="landmarks">`,
+		`<a epub:type="bodymatter" href="#">`,
+	} {
+		if !strings.Contains(buf.String(), x) {
+			t.Errorf("expected output to contain %q, got %q", x, buf.String())
+		}
+	}
+}
+
+func TestTransformContentReplacementChars(t *testing.T) {
+	const in = "<!DOCTYPE html><html><head><title>T\uFFFDtle</title></head><body><p>Caf\uFFFD au lait.</p><p>A very long paragraph with a bad \uFFFD in the middle of it.</p></body></html>"
+
+	for _, keep := range []bool{false, true} {
+		var logged []string
+		buf := bytes.NewBuffer(nil)
+		if err := NewConverterWithOptions(ConverterOptionLogReplacementChars(func(format string, a ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, a...))
+		}, keep)).TransformContent(buf, strings.NewReader(in)); err != nil {
+			t.Fatalf("keep=%t: transform: unexpected error: %v", keep, err)
+		}
+		if exp := []string{
+			"replacement character at offset 1: \"T\uFFFDtle\"",
+			"replacement character at offset 8: \"Caf\uFFFD au lait.\"",
+			"replacement character at offset 51: \"aragraph with a bad \uFFFD in the middle of it\"",
+		}; !reflect.DeepEqual(logged, exp) {
+			t.Errorf("keep=%t: expected log %q, got %q", keep, exp, logged)
+		}
+		if n := strings.Count(buf.String(), "\uFFFD"); keep && n != 3 {
+			t.Errorf("keep=%t: expected replacement characters to be kept, got %d", keep, n)
+		} else if !keep && n != 0 {
+			t.Errorf("keep=%t: expected replacement characters to be removed, got %d", keep, n)
+		}
+	}
+}
+
+func TestTransformContentMaxSize(t *testing.T) {
+	doc := `<!DOCTYPE html><html><head><title></title></head><body>` + strings.Repeat("<p>Sentence one. Sentence two.</p>\n", 1<<12) + `</body></html>`
+
+	for _, tc := range []struct {
+		Max   int64
+		Error bool
+	}{
+		{0, false},
+		{int64(len(doc)), false},
+		{int64(len(doc)) - 1, true},
+		{1024, true},
+	} {
+		for _, cache := range []bool{false, true} {
+			opts := []ConverterOption{ConverterOptionMaxContentSize(tc.Max)}
+			if cache {
+				opts = append(opts, ConverterOptionContentCache(0))
+			}
+			err := NewConverterWithOptions(opts...).TransformContent(io.Discard, strings.NewReader(doc))
+			var tl *ContentTooLargeError
+			if tc.Error != errors.As(err, &tl) {
+				t.Errorf("max=%d cache=%t: expected too large error=%t, got %v", tc.Max, cache, tc.Error, err)
+			} else if tc.Error && tl.Max != tc.Max {
+				t.Errorf("max=%d cache=%t: incorrect max in error: %d", tc.Max, cache, tl.Max)
+			} else if !tc.Error && err != nil {
+				t.Errorf("max=%d cache=%t: unexpected error: %v", tc.Max, cache, err)
+			}
+		}
+	}
+}
+
+func TestTransformContentSpanID(t *testing.T) {
+	const in = `<!DOCTYPE html><html><head><title></title></head><body><p>One. Two.</p><p>Three.</p></body></html>`
+
+	buf, trace := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	if err := NewConverterWithOptions(ConverterOptionSpanID(func(para, seg, idx int) string {
+		return "p" + strconv.Itoa(para) + "s" + strconv.Itoa(seg)
+	}), ConverterOptionTraceSpans(log.New(trace, "", 0).Printf)).TransformContent(buf, strings.NewReader(in)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	for _, id := range []string{"p1s1", "p1s2", "p2s1"} {
+		if !strings.Contains(buf.String(), `id="`+id+`"`) {
+			t.Errorf("expected span with id %q in %q", id, buf.String())
+		}
+		if !strings.Contains(trace.String(), "span "+id+":") {
+			t.Errorf("expected span with id %q in trace %q", id, trace.String())
+		}
+	}
+	if strings.Contains(trace.String(), "span kobo.") {
+		t.Errorf("expected trace not to contain default ids: %q", trace.String())
+	}
+
+	if err := NewConverterWithOptions(ConverterOptionSpanID(func(para, seg, idx int) string {
+		return "p" + strconv.Itoa(para)
+	})).TransformContent(io.Discard, strings.NewReader(in)); err == nil || !strings.Contains(err.Error(), `duplicate koboSpan id "p1"`) {
+		t.Errorf("expected duplicate id error, got %v", err)
+	}
+}
+
+func TestTransformContentDisabled(t *testing.T) {
+	in := `<!DOCTYPE html><html><head><title></title><meta name="Adept.resource" value="x"/></head><body><p>One. Two.</p></body></html>`
+
+	buf := bytes.NewBuffer(nil)
+	if err := NewConverterWithOptions(
+		ConverterOptionNoKoboStyles(),
+		ConverterOptionNoKoboDivs(),
+		ConverterOptionNoKoboSpans(),
+		ConverterOptionNoCleanup(),
+	).TransformContent(buf, strings.NewReader(in)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	if exp := `<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title><meta name="Adept.resource" value="x"/></head><body><p>One. Two.</p></body></html>`; buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+
+	buf.Reset()
+	if err := NewConverterWithOptions(
+		ConverterOptionNoKoboDivs(),
+	).TransformContent(buf, strings.NewReader(in)); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	if exp := `<body><p><span class="koboSpan" id="kobo.1.1">One. </span><span class="koboSpan" id="kobo.1.2">Two.</span></p></body>`; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected only the kobo divs to be disabled, got %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "kobostylehacks") || strings.Contains(buf.String(), "Adept") {
+		t.Errorf("expected only the kobo divs to be disabled, got %q", buf.String())
+	}
+}
+
 func TestTransformContentParts(t *testing.T) {
 	t.Run("Charset", func(t *testing.T) {
 		transformContentCase{
@@ -130,200 +507,1077 @@ func TestTransformContentParts(t *testing.T) {
 		}.Run(t)
 	})
 
-	t.Run("KoboStyles", func(t *testing.T) {
+	t.Run("CharsetMeta", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentKoboStyles,
-			What:     "add kobo style hacks",
+			Func:     transformContentCharsetMeta,
+			What:     "charset meta element",
 			Fragment: false,
-			Contains: true,
-			In:       `<!DOCTYPE html><head><title>Kepubify Test Case</title><meta charset="utf-8"/></head><body></body></html>`,
-			Out:      `kobostylehacks`,
+			In:       `<!DOCTYPE html><html><head><title>Kepubify Test Case</title><meta charset="utf-8"/></head><body></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><meta charset="UTF-8"/><title>Kepubify Test Case</title></head><body></body></html>`,
+		}.Run(t)
+		transformContentCase{
+			Func:     transformContentCharsetMeta,
+			What:     "http-equiv content-type charset meta element",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title>Kepubify Test Case</title><meta http-equiv="Content-Type" content="text/html; charset=utf-8"/></head><body></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><meta charset="UTF-8"/><title>Kepubify Test Case</title></head><body></body></html>`,
+		}.Run(t)
+		transformContentCase{
+			Func:     transformContentCharsetMeta,
+			What:     "both forms",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><meta http-equiv="content-type" content="text/html; charset=UTF-8"/><title>Kepubify Test Case</title><meta charset="UTF-8"/><meta name="viewport" content="width=device-width"/></head><body></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><meta charset="UTF-8"/><title>Kepubify Test Case</title><meta name="viewport" content="width=device-width"/></head><body></body></html>`,
+		}.Run(t)
+		transformContentCase{
+			Func:     transformContentCharsetMeta,
+			What:     "missing",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title>Kepubify Test Case</title></head><body></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><meta charset="UTF-8"/><title>Kepubify Test Case</title></head><body></body></html>`,
 		}.Run(t)
 	})
 
-	t.Run("KoboDivs", func(t *testing.T) {
+	t.Run("StyleImports", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentKoboDivs,
-			What:     "no content",
+			Func:     transformContentStyleImports,
+			What:     "replace local imports with links and remove remote ones",
+			Fragment: false,
+			In:       `<html><head><style>@import url("https://example.com/a.css");@import "../css/b.css" print;@import url(c.css); p { margin: 0 }</style><style>/* @import "e.css"; */</style><style>@import '//example.com/d.css';</style></head><body></body></html>`,
+			Out:      `<html><head><link rel="stylesheet" type="text/css" href="../css/b.css" media="print"/><link rel="stylesheet" type="text/css" href="c.css"/><style> p { margin: 0 }</style><style>/* @import "e.css"; */</style></head><body></body></html>`,
+		}.Run(t)
+	})
+
+	t.Run("RemoveBase", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentRemoveBase,
+			What:     "remove relative base and rewrite links",
 			Fragment: true,
-			In:       ``,
-			Out:      `<div id="book-columns"><div id="book-inner"></div></div>`,
+			In:       `<base href="../images/"/><p><a href="ch2.xhtml#x">a</a><img src="cover.jpg"/><a href="#top">b</a><a href="https://example.com/">c</a><a href="../a%20b.xhtml?q=1">d</a></p>`,
+			Out:      `<p><a href="../images/ch2.xhtml#x">a</a><img src="../images/cover.jpg"/><a href="#top">b</a><a href="https://example.com/">c</a><a href="../a%20b.xhtml?q=1">d</a></p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboDivs,
-			What:     "already has divs",
+			Func:     transformContentRemoveBase,
+			What:     "remove base with a filename",
 			Fragment: true,
-			In:       `<div id="book-columns"><div id="book-inner"></div></div>`,
-			Out:      `<div id="book-columns"><div id="book-inner"></div></div>`,
+			In:       `<base href="../Text/chapter.xhtml"/><p><a href="notes.xhtml">a</a></p>`,
+			Out:      `<p><a href="../Text/notes.xhtml">a</a></p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboDivs,
-			What:     "single text node",
+			Func:     transformContentRemoveBase,
+			What:     "remove remote base without rewriting links",
 			Fragment: true,
-			In:       `test`,
-			Out:      `<div id="book-columns"><div id="book-inner">test</div></div>`,
+			In:       `<base href="http://example.com/book/"/><p><a href="ch2.xhtml#x">a</a><img src="../images/cover.jpg"/><a href="//example.com/x">b</a></p>`,
+			Out:      `<p><a href="ch2.xhtml#x">a</a><img src="../images/cover.jpg"/><a href="//example.com/x">b</a></p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboDivs,
-			What:     "multiple elements and children",
+			Func:     transformContentRemoveBase,
+			What:     "no base",
 			Fragment: true,
-			In:       `<p>Test 1</p><p>Test <b>2</b></p><p>Test 3</p>`,
-			Out:      `<div id="book-columns"><div id="book-inner"><p>Test 1</p><p>Test <b>2</b></p><p>Test 3</p></div></div>`,
+			In:       `<p><a href="notes.xhtml">a</a></p>`,
+			Out:      `<p><a href="notes.xhtml">a</a></p>`,
 		}.Run(t)
 	})
 
-	t.Run("KoboSpans", func(t *testing.T) {
+	t.Run("NormalizeUnicode", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "no content",
+			Func:     transformContentNormalizeUnicode,
+			What:     "compose decomposed text but not attributes or scripts",
 			Fragment: true,
-			In:       ``,
-			Out:      ``,
+			In:       "<p title=\"cafe\u0301\">cafe\u0301 <i>nai\u0308ve</i> \u1100\u1161</p><script>var s = \"e\u0301\"</script>",
+			Out:      "<p title=\"cafe\u0301\">caf\u00e9 <i>na\u00efve</i> \uac00</p><script>var s = \"e\u0301\"</script>",
 		}.Run(t)
+	})
 
+	t.Run("Mojibake", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "already has spans",
+			Func:     transformContentMojibake,
+			What:     "fix common mojibake in text",
 			Fragment: true,
-			In:       `<p><span class="koboSpan" id="kobo.1.1">Test</span></p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Test</span></p>`,
+			In:       `<p>Itâ€™s â€œquotedâ€` + "\u009d" + ` â€” cafÃ© â€¦ Â© â‚¬5 <i>naÃ¯ve</i></p>`,
+			Out:      `<p>It’s “quoted” — café … © €5 <i>naïve</i></p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "increment segment counter from 1 for every sentence",
+			Func:     transformContentMojibake,
+			What:     "don't touch attributes, scripts, or valid text",
 			Fragment: true,
-			In:       `<p>Sentence 1. Sentence 2. Sentence 3.</p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2. </span><span class="koboSpan" id="kobo.1.3">Sentence 3.</span></p>`,
+			In:       `<p title="â€™">It’s “fine” — café. Ã alone is fine.</p><script>var a = "â€™";</script>`,
+			Out:      `<p title="â€™">It’s “fine” — café. Ã alone is fine.</p><script>var a = "â€™";</script>`,
 		}.Run(t)
+	})
 
+	t.Run("DataURIs", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "increment paragraph counter from 1 and reset segment counter for every p, ul, ol, or table",
+			Func: func(doc *html.Node) {
+				transformContentDataURIs(doc, 8)
+			},
+			What:     "extract data URIs",
 			Fragment: true,
-			In:       `<p>Sentence 1. Sentence 2.</p><p>Sentence 3.</p><ul><li>Sentence 4</li><li>Sentence 5</li></ul><ol><li>Sentence 6</li><li>Sentence 7</li></ol><table><tbody><tr><td>Test</td></tr><tr><td>Test</td></tr></tbody></table>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2.</span></p><p><span class="koboSpan" id="kobo.2.1">Sentence 3.</span></p><ul><li><span class="koboSpan" id="kobo.3.1">Sentence 4</span></li><li><span class="koboSpan" id="kobo.3.2">Sentence 5</span></li></ul><ol><li><span class="koboSpan" id="kobo.4.1">Sentence 6</span></li><li><span class="koboSpan" id="kobo.4.2">Sentence 7</span></li></ol><table><tbody><tr><td><span class="koboSpan" id="kobo.5.1">Test</span></td></tr><tr><td><span class="koboSpan" id="kobo.5.2">Test</span></td></tr></tbody></table>`,
+			In:       `<p><img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" alt=""/><img src="data:image/gif;base64,R0lG"/><img src="data:text/plain,Some%20text."/><img src="image.gif"/></p><svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><image xlink:href="data:image/gif;base64,R0lGODlh AQABAAAAACw="></image></svg>`,
+			Out:      `<p><img src="kepubify-data-2f41918f848b5fb0.gif" alt=""/><img src="data:image/gif;base64,R0lG"/><img src="data:text/plain,Some%20text."/><img src="image.gif"/></p><svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><image xlink:href="kepubify-data-2f41918f848b5fb0.gif"></image></svg>`,
 		}.Run(t)
+	})
 
+	t.Run("Title", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "merge stray text at the end of lines into the next sentence (between regexp matches)",
+			Func:     transformContentTitle,
+			What:     "empty title from first heading",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title> </title></head><body><div><p>Not a heading.</p><h2>Chapter <em>One</em></h2></div><h1>Part One</h1></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><title>Chapter One</title></head><body><div><p>Not a heading.</p><h2>Chapter <em>One</em></h2></div><h1>Part One</h1></body></html>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentTitle,
+			What:     "missing title from first heading",
+			Fragment: false,
+			In: `<!DOCTYPE html><html><head><meta charset="utf-8"/></head><body><h1>  Part
+			One </h1></body></html>`,
+			Out: `<!DOCTYPE html><html><head><title>Part One</title><meta charset="utf-8"/></head><body><h1>  Part
+			One </h1></body></html>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentTitle,
+			What:     "existing title",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title>Title</title></head><body><h1>Heading</h1></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><title>Title</title></head><body><h1>Heading</h1></body></html>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentTitle,
+			What:     "no heading",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title></title></head><body><p>Text.</p></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><title></title></head><body><p>Text.</p></body></html>`,
+		}.Run(t)
+	})
+
+	t.Run("ChapterMarkers", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentChapterMarkers,
+			What:     "top anchor and missing heading ids",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title></title></head><body><h1>Part One</h1><p id="kepubify-heading-1">Text.</p><h2 id="ch1">Chapter One</h2><div><h2>Chapter Two</h2></div></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><title></title></head><body><a id="kepubify-top"></a><h1 id="kepubify-heading-2">Part One</h1><p id="kepubify-heading-1">Text.</p><h2 id="ch1">Chapter One</h2><div><h2 id="kepubify-heading-3">Chapter Two</h2></div></body></html>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentChapterMarkers,
+			What:     "existing markers",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title></title></head><body><a id="kepubify-top"></a><h1 id="kepubify-heading-1">Part One</h1></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><title></title></head><body><a id="kepubify-top"></a><h1 id="kepubify-heading-1">Part One</h1></body></html>`,
+		}.Run(t)
+	})
+
+	t.Run("RelativeFontSizes", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentRelativeFontSizes,
+			What:     "convert px and pt font sizes to em",
 			Fragment: true,
-			In:       `<p>Sentence 1. Sentence 2. Stray text` + "\n" + `Another sentence.</p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2. </span><span class="koboSpan" id="kobo.1.3">Stray text` + "\n" + `Another sentence.</span></p>`,
+			In:       `<p style="font-size:14px">a</p><p style="font-size: 12pt !important; color: red">b</p><span style="FONT-SIZE:1.2em;font-size:9PX">c</span>`,
+			Out:      `<p style="font-size:0.875em">a</p><p style="font-size: 1em !important; color: red">b</p><span style="FONT-SIZE:1.2em;font-size:0.563em">c</span>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "don't lose stray text not part of a sentence (after the last regexp match)",
+			Func:     transformContentRelativeFontSizes,
+			What:     "don't touch relative or keyword sizes or other properties",
 			Fragment: true,
-			In:       `<p>Sentence 1. Sentence 2. Stray text</p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2. </span><span class="koboSpan" id="kobo.1.3">Stray text</span></p>`,
+			In:       `<p style="color:red;font-size:large">a</p><p style="font-size: 80%; line-height: 14px">b</p><p style="font-size: calc(10px + 1em)">c</p>`,
+			Out:      `<p style="color:red;font-size:large">a</p><p style="font-size: 80%; line-height: 14px">b</p><p style="font-size: calc(10px + 1em)">c</p>`,
+		}.Run(t)
+	})
+
+	t.Run("NormalizeInlineStyles", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentNormalizeInlineStyles,
+			What:     "remove spacing and apply text transforms",
+			Fragment: true,
+			In:       `<h2 style="letter-spacing: 0.2em; text-transform: uppercase; color: red">Chapter <span style="text-transform:lowercase">ONE</span> <em>Title</em></h2><p style="word-spacing: 1em">Text.</p><p style="text-transform: capitalize">some text</p>`,
+			Out:      `<h2 style="color: red">CHAPTER <span>one</span> <em>TITLE</em></h2><p>Text.</p><p style="text-transform: capitalize">some text</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentNormalizeInlineStyles,
+			What:     "don't override descendants with their own text transform",
+			Fragment: true,
+			In:       `<h2 style="text-transform: uppercase">Buy an <span style="text-transform: none">iPhone</span> <b style="text-transform: capitalize">or a mac</b></h2>`,
+			Out:      `<h2>BUY AN <span style="text-transform: none">iPhone</span> <b style="text-transform: capitalize">or a mac</b></h2>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentNormalizeInlineStyles,
+			What:     "important text transforms",
+			Fragment: true,
+			In:       `<p style="text-transform: uppercase !important; letter-spacing: 1px !important">Loud</p><p style="text-transform: LOWERCASE!important">QUIET</p>`,
+			Out:      `<p>LOUD</p><p>quiet</p>`,
+		}.Run(t)
+	})
+
+	t.Run("ASCIIArt", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentASCIIArt,
+			What:     "figlet block",
+			Fragment: true,
+			In:       "<p class=\"art\"> _   _ _ <br/>| | | (_)<br/>| |_| | |<br/>|  _  | |<br/>|_| |_|_|</p>",
+			Out:      "<pre class=\"art\"> _   _ _ \n| | | (_)\n| |_| | |\n|  _  | |\n|_| |_|_|</pre>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentASCIIArt,
+			What:     "pretty-printed with a line break after each br",
+			Fragment: true,
+			In:       "<p>+---+<br/>\n|   |<br/>\r\n+---+</p>",
+			Out:      "<pre>+---+\n|   |\n+---+</pre>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentASCIIArt,
+			What:     "poetry with line breaks",
+			Fragment: true,
+			In:       "<p>Roses are red,<br/>  violets are blue,<br/>sugar is sweet,<br/>  and so are you.</p>",
+			Out:      "<p>Roses are red,<br/>  violets are blue,<br/>sugar is sweet,<br/>  and so are you.</p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentASCIIArt,
+			What:     "too few lines",
+			Fragment: true,
+			In:       "<p>+---+<br/>|   |</p>",
+			Out:      "<p>+---+<br/>|   |</p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentASCIIArt,
+			What:     "contains other elements",
+			Fragment: true,
+			In:       "<p>+---+<br/>| <b>a</b> |<br/>+---+</p>",
+			Out:      "<p>+---+<br/>| <b>a</b> |<br/>+---+</p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentASCIIArt(doc)
+				transformContentKoboSpans(doc)
+			},
+			What:     "not spanned after conversion",
+			Fragment: true,
+			In:       "<div><p>Text</p><p>+---+<br/>|   |<br/>+---+</p></div>",
+			Out:      `<div><p><span class="koboSpan" id="kobo.1.1">Text</span></p><pre>+---+` + "\n|   |\n" + `+---+</pre></div>`,
 		}.Run(t)
+	})
+
+	t.Run("StripJustify", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentStripJustify,
+			What:     "strip inline text-align: justify",
+			Fragment: true,
+			In:       `<p style="text-align:justify">a</p><p style="color: red; TEXT-ALIGN: Justify !important; margin: 0">b</p><p style="text-align: center">c</p><div style="text-align: justify;">d</div>`,
+			Out:      `<p>a</p><p style="color: red; margin: 0">b</p><p style="text-align: center">c</p><div>d</div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentStripJustify,
+			What:     "strip text-align: justify from style elements",
+			Fragment: true,
+			In:       `<style>p { text-indent: 1em; text-align: justify; } .x { text-align:justify } .y { text-align: left; }</style>`,
+			Out:      `<style>p { text-indent: 1em;  } .x { } .y { text-align: left; }</style>`,
+		}.Run(t)
+	})
+
+	t.Run("MediaPosters", func(t *testing.T) {
+		blockMP4 := func(doc *html.Node) {
+			transformContentMediaPosters(doc, (&Converter{blockMediaTypes: []string{"video/mp4"}}).isBlockedMediaType)
+		}
+
+		transformContentCase{
+			Func:     blockMP4,
+			What:     "replace stripped video with poster",
+			Fragment: true,
+			In:       `<p>Before.</p><video id="v1" class="x" src="../video/clip.mp4" poster="../images/clip.jpg" title="A clip" controls="controls">Fallback text.</video><p>After.</p>`,
+			Out:      `<p>Before.</p><img src="../images/clip.jpg" alt="A clip" id="v1" class="x"/><p>After.</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     blockMP4,
+			What:     "replace stripped video with poster and source elements",
+			Fragment: true,
+			In:       `<div><video poster="clip.jpg"><source src="clip.mp4" type="video/mp4"/><source src="clip-hd.MP4?x=1"/></video></div>`,
+			Out:      `<div><img src="clip.jpg" alt=""/></div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     blockMP4,
+			What:     "don't replace video with a source which wasn't stripped",
+			Fragment: true,
+			In:       `<video poster="clip.jpg"><source src="clip.mp4" type="video/mp4"/><source src="clip.webm" type="video/webm"/></video>`,
+			Out:      `<video poster="clip.jpg"><source src="clip.mp4" type="video/mp4"/><source src="clip.webm" type="video/webm"/></video>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     blockMP4,
+			What:     "don't replace video without a poster",
+			Fragment: true,
+			In:       `<video src="clip.mp4"></video>`,
+			Out:      `<video src="clip.mp4"></video>`,
+		}.Run(t)
+	})
+
+	t.Run("FullBleedCover", func(t *testing.T) {
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentFullBleedCover(doc, func(src string) bool { return true })
+			},
+			What:     "wrap a single image with dimensions in an svg",
+			Fragment: true,
+			In:       `<div class="cover"> <img src="../cover.png" alt="Cover" width="300" height="600"/> </div>`,
+			Out:      `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%" height="100%" preserveAspectRatio="xMidYMid meet" viewBox="0 0 300 600"><title>Cover</title><image width="300" height="600" xlink:href="../cover.png"></image></svg>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentFullBleedCover(doc, func(src string) bool { return true })
+			},
+			What:     "wrap a single image without dimensions in an svg",
+			Fragment: true,
+			In:       `<p><img src="cover.jpg" style="height: 100%"/></p>`,
+			Out:      `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%" height="100%" preserveAspectRatio="xMidYMid meet"><image width="100%" height="100%" preserveAspectRatio="xMidYMid meet" xlink:href="cover.jpg"></image></svg>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentFullBleedCover(doc, func(src string) bool { return true })
+			},
+			What:     "don't touch pages with text, multiple images, or links",
+			Fragment: true,
+			In:       `<p><img src="a.jpg"/>Caption.</p><div><img src="b.jpg"/><img src="c.jpg"/></div><a href="#"><img src="d.jpg"/></a>`,
+			Out:      `<p><img src="a.jpg"/>Caption.</p><div><img src="b.jpg"/><img src="c.jpg"/></div><a href="#"><img src="d.jpg"/></a>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentFullBleedCover(doc, func(src string) bool { return src == "cover.jpg" })
+			},
+			What:     "don't touch images other than the cover",
+			Fragment: true,
+			In:       `<div><img src="map.jpg" alt="Map"/></div>`,
+			Out:      `<div><img src="map.jpg" alt="Map"/></div>`,
+		}.Run(t)
+	})
+
+	t.Run("FootnoteSup", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentFootnoteSup,
+			What:     "wrap footnote references in sup",
+			Fragment: true,
+			In:       `<p>A word<a href="notes.xhtml#n1">1</a> and another.<a href="#n2">[2]</a> And a <a epub:type="noteref" href="#n3">3</a>.</p>`,
+			Out:      `<p>A word<sup><a href="notes.xhtml#n1">1</a></sup> and another.<sup><a href="#n2">[2]</a></sup> And a <sup><a epub:type="noteref" href="#n3">3</a></sup>.</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentFootnoteSup,
+			What:     "don't wrap other links",
+			Fragment: true,
+			In:       `<p>See page <a href="#p12">12</a>, chapter<a href="ch2.xhtml">2</a>, word<sup><a href="#n1">1</a></sup>, or word<a href="#n4">note</a>.</p>`,
+			Out:      `<p>See page <a href="#p12">12</a>, chapter<a href="ch2.xhtml">2</a>, word<sup><a href="#n1">1</a></sup>, or word<a href="#n4">note</a>.</p>`,
+		}.Run(t)
+	})
+
+	t.Run("FlattenSpans", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentFlattenSpans,
+			What:     "merge word-level spans with identical attributes",
+			Fragment: true,
+			In:       `<p><span class="w" style="font-style: italic">Hello</span> <span style="font-style: italic" class="w">world.</span> <span>Plain</span> <span class="x">text</span><span class="x">.</span></p>`,
+			Out:      `<p><span class="w" style="font-style: italic">Hello world.</span> Plain <span class="x">text.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentFlattenSpans,
+			What:     "unwrap nested attribute-less spans",
+			Fragment: true,
+			In:       `<p><span><span>Nested</span> <span><b>spans</b></span></span>.</p>`,
+			Out:      `<p>Nested <b>spans</b>.</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentFlattenSpans,
+			What:     "don't merge spans separated by text, spans with ids, or koboSpans",
+			Fragment: true,
+			In:       `<p><span class="w">One</span>, <span class="w">two</span> <span class="w" id="a">three</span><span class="w" id="b">four</span><span class="koboSpan" id="kobo.1.1">five</span><span class="koboSpan" id="kobo.1.2">six</span></p><pre><span>pre</span></pre>`,
+			Out:      `<p><span class="w">One</span>, <span class="w">two</span> <span class="w" id="a">three</span><span class="w" id="b">four</span><span class="koboSpan" id="kobo.1.1">five</span><span class="koboSpan" id="kobo.1.2">six</span></p><pre><span>pre</span></pre>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentFlattenSpans(doc)
+				transformContentKoboSpans(doc)
+			},
+			What:     "fewer koboSpans after flattening",
+			Fragment: true,
+			In:       `<p><span class="w">Hello</span> <span class="w">world.</span> <span>Plain</span> <span class="x">text</span></p>`,
+			Out:      `<p><span class="w"><span class="koboSpan" id="kobo.1.1">Hello world.</span></span><span class="koboSpan" id="kobo.1.2"> Plain </span><span class="x"><span class="koboSpan" id="kobo.1.3">text</span></span></p>`,
+		}.Run(t)
+	})
+
+	t.Run("KoboStyles", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentKoboStyles,
+			What:     "add kobo style hacks",
+			Fragment: false,
+			Contains: true,
+			In:       `<!DOCTYPE html><head><title>Kepubify Test Case</title><meta charset="utf-8"/></head><body></body></html>`,
+			Out:      `kobostylehacks`,
+		}.Run(t)
+	})
+
+	t.Run("KoboDivs", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentKoboDivs,
+			What:     "no content",
+			Fragment: true,
+			In:       ``,
+			Out:      `<div id="book-columns"><div id="book-inner"></div></div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboDivs,
+			What:     "already has divs",
+			Fragment: true,
+			In:       `<div id="book-columns"><div id="book-inner"></div></div>`,
+			Out:      `<div id="book-columns"><div id="book-inner"></div></div>`,
+		}.Run(t)
+
+		// note: like Kobo, the divs are always added, even if divs are used as
+		//       paragraphs
+		transformContentCase{
+			Func:     transformContentKoboDivs,
+			What:     "more divs than paragraphs",
+			Fragment: true,
+			In:       `<div class="p">One.</div><div class="p">Two.</div><div class="p">Three.</div><p>Four.</p>`,
+			Out:      `<div id="book-columns"><div id="book-inner"><div class="p">One.</div><div class="p">Two.</div><div class="p">Three.</div><p>Four.</p></div></div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboDivs,
+			What:     "single text node",
+			Fragment: true,
+			In:       `test`,
+			Out:      `<div id="book-columns"><div id="book-inner">test</div></div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboDivs,
+			What:     "single element",
+			Fragment: true,
+			In:       `<p>Test</p>`,
+			Out:      `<div id="book-columns"><div id="book-inner"><p>Test</p></div></div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboDivs,
+			What:     "multiple elements and children",
+			Fragment: true,
+			In:       `<p>Test 1</p><p>Test <b>2</b></p><p>Test 3</p>`,
+			Out:      `<div id="book-columns"><div id="book-inner"><p>Test 1</p><p>Test <b>2</b></p><p>Test 3</p></div></div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboDivs,
+			What:     "single wrapper div with nested divs",
+			Fragment: true,
+			In:       `<div class="chapter"><div class="title"><div><h1>Title</h1></div></div><p>Test 1</p><div class="section"><p>Test 2</p></div></div>`,
+			Out:      `<div id="book-columns"><div id="book-inner"><div class="chapter"><div class="title"><div><h1>Title</h1></div></div><p>Test 1</p><div class="section"><p>Test 2</p></div></div></div></div>`,
+		}.Run(t)
+	})
+
+	t.Run("KoboSpans", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "no content",
+			Fragment: true,
+			In:       ``,
+			Out:      ``,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "already has spans",
+			Fragment: true,
+			In:       `<p><span class="koboSpan" id="kobo.1.1">Test</span></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Test</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "increment segment counter from 1 for every sentence",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2. Sentence 3.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2. </span><span class="koboSpan" id="kobo.1.3">Sentence 3.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "increment paragraph counter from 1 and reset segment counter for every p, ul, ol, or table",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2.</p><p>Sentence 3.</p><ul><li>Sentence 4</li><li>Sentence 5</li></ul><ol><li>Sentence 6</li><li>Sentence 7</li></ol><table><tbody><tr><td>Test</td></tr><tr><td>Test</td></tr></tbody></table>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2.</span></p><p><span class="koboSpan" id="kobo.2.1">Sentence 3.</span></p><ul><li><span class="koboSpan" id="kobo.3.1">Sentence 4</span></li><li><span class="koboSpan" id="kobo.3.2">Sentence 5</span></li></ul><ol><li><span class="koboSpan" id="kobo.4.1">Sentence 6</span></li><li><span class="koboSpan" id="kobo.4.2">Sentence 7</span></li></ol><table><tbody><tr><td><span class="koboSpan" id="kobo.5.1">Test</span></td></tr><tr><td><span class="koboSpan" id="kobo.5.2">Test</span></td></tr></tbody></table>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "merge stray text at the end of lines into the next sentence (between regexp matches)",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2. Stray text` + "\n" + `Another sentence.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2. </span><span class="koboSpan" id="kobo.1.3">Stray text` + "\n" + `Another sentence.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't lose stray text not part of a sentence (after the last regexp match)",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2. Stray text</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2. </span><span class="koboSpan" id="kobo.1.3">Stray text</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "preserve but don't wrap extra whitespace outside of P elements", // TODO: are there any other cases where we need to still wrap whitespace to match Kobo's behaviour?
+			Fragment: true,
+			In:       `<p>This is a test.` + "\n" + `    This is another sentence on the next line.<span> </span>Another sentence.</p>` + "\n" + "    <p>Another paragraph.</p><p> </p><p></p>",
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">This is a test.` + "\n" + `    </span><span class="koboSpan" id="kobo.1.2">This is another sentence on the next line.</span><span> </span><span class="koboSpan" id="kobo.1.3">Another sentence.</span></p>` + "\n" + `    <p><span class="koboSpan" id="kobo.2.1">Another paragraph.</span></p><p><span class="koboSpan" id="kobo.3.1"> </span></p><p></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "preserve and split segments on formatting and links",
+			Fragment: true,
+			In:       `<p>Sentence<b> 1. </b>Sentence <span>2. Se</span>nten<a href="test.html">ce 3. Another word</a></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence</span><b><span class="koboSpan" id="kobo.1.2"> 1. </span></b><span class="koboSpan" id="kobo.1.3">Sentence </span><span><span class="koboSpan" id="kobo.1.4">2. </span><span class="koboSpan" id="kobo.1.5">Se</span></span><span class="koboSpan" id="kobo.1.6">nten</span><a href="test.html"><span class="koboSpan" id="kobo.1.7">ce 3. </span><span class="koboSpan" id="kobo.1.8">Another word</span></a></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "preserve and split segments on nested formatting and links",
+			Fragment: true,
+			In:       `<p>Sentence<b> 1. Sente<i>nce <span>2. Se</span>nt</i>en<a href="test.html">ce 3. Another word</a></b></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence</span><b><span class="koboSpan" id="kobo.1.2"> 1. </span><span class="koboSpan" id="kobo.1.3">Sente</span><i><span class="koboSpan" id="kobo.1.4">nce </span><span><span class="koboSpan" id="kobo.1.5">2. </span><span class="koboSpan" id="kobo.1.6">Se</span></span><span class="koboSpan" id="kobo.1.7">nt</span></i><span class="koboSpan" id="kobo.1.8">en</span><a href="test.html"><span class="koboSpan" id="kobo.1.9">ce 3. </span><span class="koboSpan" id="kobo.1.10">Another word</span></a></b></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "nested lists/paragraphs should not reset numbering once out of scope (i.e. <p [para1]>[span1.1]<ul [para2]><li>[span2.1]</li></ul>[span2.2]</p>)", // TODO: verify against an actual kepub (I'll have to find a free non-fiction one or one with a nested TOC)
+			Fragment: true,
+			In:       `<p>Sentence.<ul><li>Another sentence.</li><li>Another sentence.<ul><li>Another sentence.</li><li>Another sentence.</li></ul></li><li>Another sentence.</li></ul> Another sentence.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence.</span></p><ul><li><span class="koboSpan" id="kobo.2.1">Another sentence.</span></li><li><span class="koboSpan" id="kobo.2.2">Another sentence.</span><ul><li><span class="koboSpan" id="kobo.3.1">Another sentence.</span></li><li><span class="koboSpan" id="kobo.3.2">Another sentence.</span></li></ul></li><li><span class="koboSpan" id="kobo.3.3">Another sentence.</span></li></ul><span class="koboSpan" id="kobo.3.4"> Another sentence.</span><p></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't touch the contents of script, style, pre, audio, video tags",
+			Fragment: true,
+			In:       `<p>Touch this.</p><script>not this</script><style>or this</style><pre>or this</pre><audio>or this</audio><video>or this</video><p>Touch this.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Touch this.</span></p><script>not this</script><style>or this</style><pre>or this</pre><audio>or this</audio><video>or this</video><p><span class="koboSpan" id="kobo.2.1">Touch this.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "treat an img as a new paragraph and add a span around it",
+			Fragment: true,
+			In:       `<p>One.</p><img src="test"><p>Three.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">One.</span></p><span class="koboSpan" id="kobo.2.1"><img src="test"/></span><p><span class="koboSpan" id="kobo.3.1">Three.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "treat inline content directly in the body as the first paragraph",
+			Fragment: true,
+			In:       `Some <em>inline</em> text. More text.<p>Next.</p>`,
+			Out:      `<span class="koboSpan" id="kobo.1.1">Some </span><em><span class="koboSpan" id="kobo.1.2">inline</span></em><span class="koboSpan" id="kobo.1.3"> text. </span><span class="koboSpan" id="kobo.1.4">More text.</span><p><span class="koboSpan" id="kobo.2.1">Next.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't add an implicit paragraph for text in a div before the first paragraph",
+			Fragment: true,
+			In:       `<div>Title</div><p>Next.</p>`,
+			Out:      `<div><span class="koboSpan" id="kobo.0.1">Title</span></div><p><span class="koboSpan" id="kobo.1.1">Next.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "treat a figcaption after multiple images as a single new paragraph",
+			Fragment: true,
+			In:       "<figure>\n<img src=\"a.jpg\"/>\n<img src=\"b.jpg\"/>\n<figcaption>Caption one. Caption two.</figcaption>\n</figure><p>After.</p>",
+			Out:      "<figure>\n<span class=\"koboSpan\" id=\"kobo.1.1\"><img src=\"a.jpg\"/></span>\n<span class=\"koboSpan\" id=\"kobo.2.1\"><img src=\"b.jpg\"/></span>\n<figcaption><span class=\"koboSpan\" id=\"kobo.3.1\">Caption one. </span><span class=\"koboSpan\" id=\"kobo.3.2\">Caption two.</span></figcaption>\n</figure><p><span class=\"koboSpan\" id=\"kobo.4.1\">After.</span></p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "treat each term and definition in a definition list as a new paragraph",
+			Fragment: true,
+			In:       "<dl>\n<dt>Term one</dt>\n<dd>Definition one. More.</dd>\n<dt>Term <em>two</em></dt>\n<dd>Definition two.</dd>\n</dl><p>After.</p>",
+			Out:      "<dl>\n<dt><span class=\"koboSpan\" id=\"kobo.1.1\">Term one</span></dt>\n<dd><span class=\"koboSpan\" id=\"kobo.2.1\">Definition one. </span><span class=\"koboSpan\" id=\"kobo.2.2\">More.</span></dd>\n<dt><span class=\"koboSpan\" id=\"kobo.3.1\">Term </span><em><span class=\"koboSpan\" id=\"kobo.3.2\">two</span></em></dt>\n<dd><span class=\"koboSpan\" id=\"kobo.4.1\">Definition two.</span></dd>\n</dl><p><span class=\"koboSpan\" id=\"kobo.5.1\">After.</span></p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't increment paragraph counter if no spans were added",
+			Fragment: true,
+			In:       `<p>One.</p><p> </p><p><!-- comment --></p><p>Two.</p><p><b>Three.</b></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">One.</span></p><p><span class="koboSpan" id="kobo.2.1"> </span></p><p><!-- comment --></p><p><span class="koboSpan" id="kobo.3.1">Two.</span></p><p><b><span class="koboSpan" id="kobo.4.1">Three.</span></b></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't add spans to svg and math elements",
+			Fragment: true,
+			In:       `<svg xmlns="http://www.w3.org/2000/svg"><g><text font-size="24" y="20" x="0">kepubify</text></g></svg><math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>=</mo><mfrac><mrow><mo>-</mo><mi>b</mi><mo>±</mo><msqrt><msup><mi>b</mi><mn>2</mn></msup><mo>-</mo><mn>4</mn><mi>a</mi><mi>c</mi></msqrt></mrow><mrow><mn>2</mn><mi>a</mi></mrow></mfrac></math>`,
+			Out:      `<svg xmlns="http://www.w3.org/2000/svg"><g><text font-size="24" y="20" x="0">kepubify</text></g></svg><math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>=</mo><mfrac><mrow><mo>-</mo><mi>b</mi><mo>±</mo><msqrt><msup><mi>b</mi><mn>2</mn></msup><mo>-</mo><mn>4</mn><mi>a</mi><mi>c</mi></msqrt></mrow><mrow><mn>2</mn><mi>a</mi></mrow></mfrac></math>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't add spans to script and style elements or inline math",
+			Fragment: true,
+			In:       `<style>p.a { color: red; } p.b { color: blue; }</style><p>Solve <math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>+</mo><mn>1</mn></math> first. <script>var a = "One. Two.";</script>Then stop.</p>`,
+			Out:      `<style>p.a { color: red; } p.b { color: blue; }</style><p><span class="koboSpan" id="kobo.1.1">Solve </span><math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>+</mo><mn>1</mn></math><span class="koboSpan" id="kobo.1.2"> first. </span><script>var a = "One. Two.";</script><span class="koboSpan" id="kobo.1.3">Then stop.</span></p>`,
+		}.Run(t)
+
+		// The following cases were found after using kobotest on a bunch of files (the previous cases are also based on kepubs, but I did them manually and didn't keep track):
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "also increment paragraph counter on heading tags and don't split sentences after colons or if there isn't any spaces after a period", // 69b8ba8c-1799-4e0d-ba3a-ce366410335e (Janurary 2020): Arthur Conan Doyle - The Complete Sherlock Holmes.kepub/OEBPS/bookwire/bookwire_advertisement1.xhtml
+			Fragment: true,
+			In:       `<div class="img_container"><p class="ad_image"><img src="bookwire_ad_cover1.jpg" alt="image"/></p></div>` + "\n" + `    <h2 class="subheadline">The Christmas Collection: All Of Your Favourite Classic Christmas Stories, Novels, Poems, Carols in One Ebook</h2>` + "\n" + `    <p class="subheadline2"></p>` + "\n" + `    <p class="metadata">Carr, Annie Roe</p>`,
+			Out:      `<div class="img_container"><p class="ad_image"><span class="koboSpan" id="kobo.1.1"><img src="bookwire_ad_cover1.jpg" alt="image"/></span></p></div>` + "\n" + `    <h2 class="subheadline"><span class="koboSpan" id="kobo.2.1">The Christmas Collection: All Of Your Favourite Classic Christmas Stories, Novels, Poems, Carols in One Ebook</span></h2>` + "\n" + `    <p class="subheadline2"></p>` + "\n" + `    <p class="metadata"><span class="koboSpan" id="kobo.3.1">Carr, Annie Roe</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "preserve ins and del elements and add spans inside them",
+			Fragment: true,
+			In:       `<p>The <del datetime="2020-01-12">old</del><ins datetime="2020-01-12">new</ins> text. <ins>Another sentence. And another.</ins></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">The </span><del datetime="2020-01-12"><span class="koboSpan" id="kobo.1.2">old</span></del><ins datetime="2020-01-12"><span class="koboSpan" id="kobo.1.3">new</span></ins><span class="koboSpan" id="kobo.1.4"> text. </span><ins><span class="koboSpan" id="kobo.1.5">Another sentence. </span><span class="koboSpan" id="kobo.1.6">And another.</span></ins></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't consume segment numbers for whitespace between block elements",
+			Fragment: true,
+			In:       "\n  <div>\n    <p>One.</p>\n    \n    <p>Two. Three.</p>\n    <blockquote>\n      <p>Four.</p>\n    </blockquote>\n  </div>\n",
+			Out:      "\n  <div>\n    <p><span class=\"koboSpan\" id=\"kobo.1.1\">One.</span></p>\n    \n    <p><span class=\"koboSpan\" id=\"kobo.2.1\">Two. </span><span class=\"koboSpan\" id=\"kobo.2.2\">Three.</span></p>\n    <blockquote>\n      <p><span class=\"koboSpan\" id=\"kobo.3.1\">Four.</span></p>\n    </blockquote>\n  </div>\n",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't wrap trailing whitespace and line breaks in paragraphs",
+			Fragment: true,
+			In:       "<p>One. Two.<br/></p><p>Three. <br/>  </p><p>Four.<br/>  <br/>\n</p><p>Five. <br/> Six.</p>",
+			Out:      "<p><span class=\"koboSpan\" id=\"kobo.1.1\">One. </span><span class=\"koboSpan\" id=\"kobo.1.2\">Two.</span><br/></p><p><span class=\"koboSpan\" id=\"kobo.2.1\">Three. </span><br/>  </p><p><span class=\"koboSpan\" id=\"kobo.3.1\">Four.</span><br/>  <br/>\n</p><p><span class=\"koboSpan\" id=\"kobo.4.1\">Five. </span><br/><span class=\"koboSpan\" id=\"kobo.4.2\"> Six.</span></p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "line breaks in a paragraph",
+			Fragment: true,
+			In:       `<p>line one<br/>line two</p><p>Next.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">line one</span><br/><span class="koboSpan" id="kobo.1.2">line two</span></p><p><span class="koboSpan" id="kobo.2.1">Next.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{LineBreakParagraphs: true})
+			},
+			What:     "line breaks in a paragraph with line break paragraphs",
+			Fragment: true,
+			In:       `<p>line one<br/>line two<br/><br/>line three</p><hr/><p>Next.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">line one</span><br/><span class="koboSpan" id="kobo.2.1">line two</span><br/><br/><span class="koboSpan" id="kobo.3.1">line three</span></p><hr/><p><span class="koboSpan" id="kobo.4.1">Next.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't add spans to ruby annotations",
+			Fragment: true,
+			In:       `<p><ruby>漢<rt>かん</rt></ruby>字。<ruby>字<rp>(</rp><rt>じ</rt><rp>)</rp></ruby></p>`,
+			Out:      `<p><ruby><span class="koboSpan" id="kobo.1.1">漢</span><rt>かん</rt></ruby><span class="koboSpan" id="kobo.1.2">字。</span><ruby><span class="koboSpan" id="kobo.1.3">字</span><rp>(</rp><rt>じ</rt><rp>)</rp></ruby></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{Abbreviations: defaultAbbreviations})
+			},
+			What:     "abbreviations",
+			Fragment: true,
+			In:       `<p>Mr. and Mrs. Smith met Dr. Jones. Cats vs. dogs, etc. are common pets, e.g. these. It costs 3.14 dollars, i.e. not much.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Mr. and Mrs. Smith met Dr. Jones. </span><span class="koboSpan" id="kobo.1.2">Cats vs. dogs, etc. are common pets, e.g. these. </span><span class="koboSpan" id="kobo.1.3">It costs 3.14 dollars, i.e. not much.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{Abbreviations: defaultAbbreviations, InlineSentences: true})
+			},
+			What:     "abbreviations with inline sentences",
+			Fragment: true,
+			In:       `<p>Ask <em>Dr.</em> Who. Then leave.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Ask <em>Dr.</em> Who. </span><span class="koboSpan" id="kobo.1.2">Then leave.</span></p>`,
+		}.Run(t)
+
+		// note: this is the same numbering as official KEPUBs
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "segment numbering",
+			Fragment: true,
+			In:       `<h1>Chapter One</h1><p>First sentence. <em>Second one.</em> Third? Yes!</p><div>Loose text.<p>Inner.</p>Tail.</div><p><img src="a.png"/> Caption.</p>`,
+			Out:      `<h1><span class="koboSpan" id="kobo.1.1">Chapter One</span></h1><p><span class="koboSpan" id="kobo.2.1">First sentence. </span><em><span class="koboSpan" id="kobo.2.2">Second one.</span></em><span class="koboSpan" id="kobo.2.3"> Third? </span><span class="koboSpan" id="kobo.2.4">Yes!</span></p><div><span class="koboSpan" id="kobo.2.5">Loose text.</span><p><span class="koboSpan" id="kobo.3.1">Inner.</span></p><span class="koboSpan" id="kobo.3.2">Tail.</span></div><p><span class="koboSpan" id="kobo.4.1"><img src="a.png"/></span><span class="koboSpan" id="kobo.4.2"> Caption.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{ParagraphBase: 0, SegmentBase: -1})
+			},
+			What:     "custom segment start",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2.</p><img src="test"><p>Sentence 3.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.0">Sentence 1. </span><span class="koboSpan" id="kobo.1.1">Sentence 2.</span></p><span class="koboSpan" id="kobo.2.0"><img src="test"/></span><p><span class="koboSpan" id="kobo.3.0">Sentence 3.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{ParagraphBase: 9, SegmentBase: 4})
+			},
+			What:     "custom paragraph and segment start",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2.</p><p>Sentence 3.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.10.5">Sentence 1. </span><span class="koboSpan" id="kobo.10.6">Sentence 2.</span></p><p><span class="koboSpan" id="kobo.11.5">Sentence 3.</span></p>`,
+		}.Run(t)
+
+		// note: like Kobo, each text node gets its own segment, so a sentence
+		//       split by inline markup has multiple segments (but they're
+		//       still consecutive and in the same paragraph).
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "single sentence with trailing inline emphasis",
+			Fragment: true,
+			In:       `<p>Hello <em>world</em>.</p><p>Next.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Hello </span><em><span class="koboSpan" id="kobo.1.2">world</span></em><span class="koboSpan" id="kobo.1.3">.</span></p><p><span class="koboSpan" id="kobo.2.1">Next.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "single sentence entirely in inline emphasis",
+			Fragment: true,
+			In:       `<p><em>Hello world.</em></p><p>Next.</p>`,
+			Out:      `<p><em><span class="koboSpan" id="kobo.1.1">Hello world.</span></em></p><p><span class="koboSpan" id="kobo.2.1">Next.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "sentence after inline emphasis",
+			Fragment: true,
+			In:       `<p>Hello <em>world</em>. Second.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Hello </span><em><span class="koboSpan" id="kobo.1.2">world</span></em><span class="koboSpan" id="kobo.1.3">. </span><span class="koboSpan" id="kobo.1.4">Second.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "preserve dir attributes and bidi elements in mixed-direction text",
+			Fragment: true,
+			In:       `<p dir="auto">שלום world. <span dir="ltr">Hello.</span> <bdi>مرحبا.</bdi></p><p dir="rtl">עברית.</p>`,
+			Out:      `<p dir="auto"><span class="koboSpan" id="kobo.1.1">שלום world. </span><span dir="ltr"><span class="koboSpan" id="kobo.1.2">Hello.</span></span><span class="koboSpan" id="kobo.1.3"> </span><bdi><span class="koboSpan" id="kobo.1.4">مرحبا.</span></bdi></p><p dir="rtl"><span class="koboSpan" id="kobo.2.1">עברית.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "nested ordered lists",
+			Fragment: true,
+			In:       `<ol><li>One.</li><li>Two.<ol><li>Two A.</li><li>Two B.</li></ol></li><li>Three.</li></ol>`,
+			Out:      `<ol><li><span class="koboSpan" id="kobo.1.1">One.</span></li><li><span class="koboSpan" id="kobo.1.2">Two.</span><ol><li><span class="koboSpan" id="kobo.2.1">Two A.</span></li><li><span class="koboSpan" id="kobo.2.2">Two B.</span></li></ol></li><li><span class="koboSpan" id="kobo.2.3">Three.</span></li></ol>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{ListItemParagraphs: true})
+			},
+			What:     "nested ordered lists with list item paragraphs",
+			Fragment: true,
+			In:       `<ol><li>One.</li><li>Two.<ol><li>Two A.</li><li>Two B.</li></ol></li><li>Three. Sentence 2.</li></ol><p>After.</p>`,
+			Out:      `<ol><li><span class="koboSpan" id="kobo.1.1">One.</span></li><li><span class="koboSpan" id="kobo.2.1">Two.</span><ol><li><span class="koboSpan" id="kobo.3.1">Two A.</span></li><li><span class="koboSpan" id="kobo.4.1">Two B.</span></li></ol></li><li><span class="koboSpan" id="kobo.5.1">Three. </span><span class="koboSpan" id="kobo.5.2">Sentence 2.</span></li></ol><p><span class="koboSpan" id="kobo.6.1">After.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "sentence crossing an inline element edge",
+			Fragment: true,
+			In:       `<p>He said <em>hello</em>. Then left.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">He said </span><em><span class="koboSpan" id="kobo.1.2">hello</span></em><span class="koboSpan" id="kobo.1.3">. </span><span class="koboSpan" id="kobo.1.4">Then left.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{InlineSentences: true})
+			},
+			What:     "sentence crossing an inline element edge with inline sentences",
+			Fragment: true,
+			In:       `<p>He said <em>hello</em>. Then left. <a href="#"><b>Bold</b> link</a> text.<!-- comment --></p><p>See <a href="#">this.</a> <i>Another</i> one.</p><div>Text <span>span</span>.</div>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">He said <em>hello</em>. </span><span class="koboSpan" id="kobo.1.2">Then left. </span><span class="koboSpan" id="kobo.1.3"><a href="#"><b>Bold</b> link</a> text.<!-- comment --></span></p><p><span class="koboSpan" id="kobo.2.1">See <a href="#">this.</a> </span><span class="koboSpan" id="kobo.2.2"><i>Another</i> one.</span></p><div><span class="koboSpan" id="kobo.2.3">Text <span>span</span>.</span></div>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{InlineSentences: true})
+			},
+			What:     "sentence boundary inside an inline element with inline sentences",
+			Fragment: true,
+			In:       `<p>One <em>two. Three</em> four.</p><p>Five <img src="x"/> six.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">One </span><em><span class="koboSpan" id="kobo.1.2">two. </span><span class="koboSpan" id="kobo.1.3">Three</span></em><span class="koboSpan" id="kobo.1.4"> four.</span></p><p><span class="koboSpan" id="kobo.2.1">Five </span><span class="koboSpan" id="kobo.3.1"><img src="x"/></span><span class="koboSpan" id="kobo.3.2"> six.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "semantic inline elements",
+			Fragment: true,
+			In:       `<p>Inline <small>small</small> <mark>mark</mark> <abbr title="abbreviation">abbr</abbr> <cite>cite</cite> <kbd>kbd</kbd> <samp>samp</samp> <var>var</var>.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Inline </span><small><span class="koboSpan" id="kobo.1.2">small</span></small><span class="koboSpan" id="kobo.1.3"> </span><mark><span class="koboSpan" id="kobo.1.4">mark</span></mark><span class="koboSpan" id="kobo.1.5"> </span><abbr title="abbreviation"><span class="koboSpan" id="kobo.1.6">abbr</span></abbr><span class="koboSpan" id="kobo.1.7"> </span><cite><span class="koboSpan" id="kobo.1.8">cite</span></cite><span class="koboSpan" id="kobo.1.9"> </span><kbd><span class="koboSpan" id="kobo.1.10">kbd</span></kbd><span class="koboSpan" id="kobo.1.11"> </span><samp><span class="koboSpan" id="kobo.1.12">samp</span></samp><span class="koboSpan" id="kobo.1.13"> </span><var><span class="koboSpan" id="kobo.1.14">var</span></var><span class="koboSpan" id="kobo.1.15">.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "custom elements",
+			Fragment: true,
+			In:       `<p>One. <my-widget data-x="1">Two. Three.</my-widget></p><my-widget>Four.</my-widget><x-card><p>Five.</p></x-card>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">One. </span><my-widget data-x="1"><span class="koboSpan" id="kobo.1.2">Two. </span><span class="koboSpan" id="kobo.1.3">Three.</span></my-widget></p><my-widget><span class="koboSpan" id="kobo.1.4">Four.</span></my-widget><x-card><p><span class="koboSpan" id="kobo.2.1">Five.</span></p></x-card>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "count malformed nested paragraphs once",
+			Fragment: true,
+			In:       `<p>Outer <p>Inner.</p> tail.</p><div><p><div><p>Nested.</p></div></p></div><p><span><p>In span.</p></span></p><ol><li><p><p>List.</p></p></li></ol>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Outer </span></p><p><span class="koboSpan" id="kobo.2.1">Inner.</span></p><span class="koboSpan" id="kobo.2.2"> tail.</span><p></p><div><p></p><div><p><span class="koboSpan" id="kobo.3.1">Nested.</span></p></div><p></p></div><p><span></span></p><p><span class="koboSpan" id="kobo.4.1">In span.</span></p><p></p><ol><li><p></p><p><span class="koboSpan" id="kobo.5.1">List.</span></p><p></p></li></ol>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "split Japanese text at ideographic full stops and commas",
+			Fragment: true,
+			In:       `<p>吾輩は猫である。名前はまだ無い。どこで生れたか、とんと見当がつかぬ。</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">吾輩は猫である。</span><span class="koboSpan" id="kobo.1.2">名前はまだ無い。</span><span class="koboSpan" id="kobo.1.3">どこで生れたか、</span><span class="koboSpan" id="kobo.1.4">とんと見当がつかぬ。</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "skip elements with xml:space=preserve like pre",
+			Fragment: true,
+			In:       "<p>Before.</p><div xml:space=\"preserve\">  Line one.  Line two.\n\n    <em>Indented.</em>  \n</div><p>After.</p>",
+			Out:      "<p><span class=\"koboSpan\" id=\"kobo.1.1\">Before.</span></p><div xml:space=\"preserve\">  Line one.  Line two.\n\n    <em>Indented.</em>  \n</div><p><span class=\"koboSpan\" id=\"kobo.2.1\">After.</span></p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "koboSpans inside existing spans",
+			Fragment: true,
+			In:       `<p><span class="x">Sentence 1.</span> <span class="y">Sentence 2. Sentence 3.</span></p>`,
+			Out:      `<p><span class="x"><span class="koboSpan" id="kobo.1.1">Sentence 1.</span></span><span class="koboSpan" id="kobo.1.2"> </span><span class="y"><span class="koboSpan" id="kobo.1.3">Sentence 2. </span><span class="koboSpan" id="kobo.1.4">Sentence 3.</span></span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{Words: true})
+			},
+			What:     "words",
+			Fragment: true,
+			In:       `<p>Sentence  one. <b>Bold</b> two.</p><pre>Not  wrapped.</pre><p> Three.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence</span>  <span class="koboSpan" id="kobo.1.2">one.</span> <b><span class="koboSpan" id="kobo.1.3">Bold</span></b> <span class="koboSpan" id="kobo.1.4">two.</span></p><pre>Not  wrapped.</pre><p> <span class="koboSpan" id="kobo.2.1">Three.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{Attrs: []koboSpanAttr{
+					{"data-sentence-index", func(para, seg, idx int) string { return strconv.Itoa(idx) }},
+					{"data-para", func(para, seg, idx int) string { return strconv.Itoa(para) }},
+				}})
+			},
+			What:     "extra attributes",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2.</p><img src="test"><p>Sentence 3.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1" data-sentence-index="0" data-para="1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2" data-sentence-index="1" data-para="1">Sentence 2.</span></p><span class="koboSpan" id="kobo.2.1" data-sentence-index="2" data-para="2"><img src="test"/></span><p><span class="koboSpan" id="kobo.3.1" data-sentence-index="3" data-para="3">Sentence 3.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{ID: func(para, seg, idx int) string {
+					return fmt.Sprintf("s%d-%d-%d", para, seg, idx)
+				}})
+			},
+			What:     "custom ids",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2.</p><img src="test"><p>Sentence 3.</p>`,
+			Out:      `<p><span class="koboSpan" id="s1-1-0">Sentence 1. </span><span class="koboSpan" id="s1-2-1">Sentence 2.</span></p><span class="koboSpan" id="s2-1-2"><img src="test"/></span><p><span class="koboSpan" id="s3-1-3">Sentence 3.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{WrapSpans: true})
+			},
+			What:     "koboSpans outside existing spans with a single sentence",
+			Fragment: true,
+			In:       `<p><span class="x">Sentence 1.</span> <span class="y">Sentence 2. Sentence 3.</span><span><b>Sentence 4.</b></span></p><span class="z">Sentence 5.</span>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1"><span class="x">Sentence 1.</span></span><span class="koboSpan" id="kobo.1.2"> </span><span class="y"><span class="koboSpan" id="kobo.1.3">Sentence 2. </span><span class="koboSpan" id="kobo.1.4">Sentence 3.</span></span><span><b><span class="koboSpan" id="kobo.1.5">Sentence 4.</span></b></span></p><span class="koboSpan" id="kobo.1.6"><span class="z">Sentence 5.</span></span>`,
+		}.Run(t)
+
+		var trace bytes.Buffer
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentKoboSpansWithOptions(doc, koboSpanOptions{Trace: log.New(&trace, "", 0).Printf})
+			},
+			What:     "trace output doesn't affect spans",
+			Fragment: true,
+			In:       `<p>Sentence 1. Sentence 2.</p><img src="test">`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence 1. </span><span class="koboSpan" id="kobo.1.2">Sentence 2.</span></p><span class="koboSpan" id="kobo.2.1"><img src="test"/></span>`,
+		}.Run(t)
+		for _, exp := range []string{
+			"element <p> (para=0 seg=0)\n",
+			"text under <p> (para=0 seg=0): sentences [\"Sentence 1. \" \"Sentence 2.\"]\n",
+			"span kobo.1.1: \"Sentence 1. \"\n",
+			"span kobo.1.2: \"Sentence 2.\"\n",
+			"element <img> (para=1 seg=2)\n",
+			"span kobo.2.1: <img>\n",
+		} {
+			if !strings.Contains(trace.String(), exp) {
+				t.Errorf("expected trace to contain %q, got:\n%s", exp, trace.String())
+			}
+		}
+	})
+
+	t.Run("AddStyle", func(t *testing.T) {
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentAddStyle(doc, "kepubify-test", "div > div { color: black; }") },
+			What:     "add style to head",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><head><title>Kepubify Test</title></head><body></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><title>Kepubify Test</title><style type="text/css" class="kepubify-test">div > div { color: black; }</style></head><body></body></html>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentAddStyle(doc, "kepubify-test", "p::before { content: \"<&>\"; }")
+			},
+			What:     "add style to document without a head",
+			Fragment: false,
+			In:       `<!DOCTYPE html><html><body><p>Text</p></body></html>`,
+			Out:      `<!DOCTYPE html><html><head><style type="text/css" class="kepubify-test">p::before { content: "<&>"; }</style></head><body><p>Text</p></body></html>`,
+		}.Run(t)
+	})
 
+	t.Run("SmartyPants", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "preserve but don't wrap extra whitespace outside of P elements", // TODO: are there any other cases where we need to still wrap whitespace to match Kobo's behaviour?
+			Func:     transformContentPunctuation,
+			What:     "smart punctuation",
 			Fragment: true,
-			In:       `<p>This is a test.` + "\n" + `    This is another sentence on the next line.<span> </span>Another sentence.</p>` + "\n" + "    <p>Another paragraph.</p><p> </p><p></p>",
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">This is a test.` + "\n" + `    </span><span class="koboSpan" id="kobo.1.2">This is another sentence on the next line.</span><span> </span><span class="koboSpan" id="kobo.1.3">Another sentence.</span></p>` + "\n" + `    <p><span class="koboSpan" id="kobo.2.1">Another paragraph.</span></p><p><span class="koboSpan" id="kobo.3.1"> </span></p><p></p>`,
+			In:       `<p>This is a test sentence to test smartypants' conversion of "quotation marks", dashes like - / -- / ---, and symbols like (c).</p>`,
+			Out:      `<p>This is a test sentence to test smartypants’ conversion of “quotation marks”, dashes like - / – / —, and symbols like ©.</p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "preserve and split segments on formatting and links",
+			Func:     transformContentPunctuation,
+			What:     "skip pre, code, style, and script elements",
 			Fragment: true,
-			In:       `<p>Sentence<b> 1. </b>Sentence <span>2. Se</span>nten<a href="test.html">ce 3. Another word</a></p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence</span><b><span class="koboSpan" id="kobo.1.2"> 1. </span></b><span class="koboSpan" id="kobo.1.3">Sentence </span><span><span class="koboSpan" id="kobo.1.4">2. </span><span class="koboSpan" id="kobo.1.5">Se</span></span><span class="koboSpan" id="kobo.1.6">nten</span><a href="test.html"><span class="koboSpan" id="kobo.1.7">ce 3. </span><span class="koboSpan" id="kobo.1.8">Another word</span></a></p>`,
+			In:       `<p>This is a test sentence to test smartypants' conversion of <code>"quotation marks"</code>, dashes like <pre>- / -- / ---</pre>, and symbols like (c).</p><style>div{font-family:"Test"}</style><script>var a="test"</script>`,
+			Out:      `<p>This is a test sentence to test smartypants’ conversion of <code>&#34;quotation marks&#34;</code>, dashes like </p><pre>- / -- / ---</pre>, and symbols like ©.<p></p><style>div{font-family:"Test"}</style><script>var a="test"</script>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "preserve and split segments on nested formatting and links",
+			Func:     transformContentPunctuation,
+			What:     "leave code listings untouched",
 			Fragment: true,
-			In:       `<p>Sentence<b> 1. Sente<i>nce <span>2. Se</span>nt</i>en<a href="test.html">ce 3. Another word</a></b></p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence</span><b><span class="koboSpan" id="kobo.1.2"> 1. </span><span class="koboSpan" id="kobo.1.3">Sente</span><i><span class="koboSpan" id="kobo.1.4">nce </span><span><span class="koboSpan" id="kobo.1.5">2. </span><span class="koboSpan" id="kobo.1.6">Se</span></span><span class="koboSpan" id="kobo.1.7">nt</span></i><span class="koboSpan" id="kobo.1.8">en</span><a href="test.html"><span class="koboSpan" id="kobo.1.9">ce 3. </span><span class="koboSpan" id="kobo.1.10">Another word</span></a></b></p>`,
+			In:       `<pre><code>$ cmd --flag="value" ---x 'y' -- (c)</code></pre><p>Use <code>--flag="it's"</code> or <code>'</code> -- "then" it's done.</p>`,
+			Out:      `<pre><code>$ cmd --flag=&#34;value&#34; ---x &#39;y&#39; -- (c)</code></pre><p>Use <code>--flag=&#34;it&#39;s&#34;</code> or <code>&#39;</code> – “then” it’s done.</p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "nested lists/paragraphs should not reset numbering once out of scope (i.e. <p [para1]>[span1.1]<ul [para2]><li>[span2.1]</li></ul>[span2.2]</p>)", // TODO: verify against an actual kepub (I'll have to find a free non-fiction one or one with a nested TOC)
+			Func:     transformContentPunctuation,
+			What:     "balance straight quotes with existing curly quotes and across elements",
 			Fragment: true,
-			In:       `<p>Sentence.<ul><li>Another sentence.</li><li>Another sentence.<ul><li>Another sentence.</li><li>Another sentence.</li></ul></li><li>Another sentence.</li></ul> Another sentence.</p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence.</span></p><ul><li><span class="koboSpan" id="kobo.2.1">Another sentence.</span></li><li><span class="koboSpan" id="kobo.2.2">Another sentence.</span><ul><li><span class="koboSpan" id="kobo.3.1">Another sentence.</span></li><li><span class="koboSpan" id="kobo.3.2">Another sentence.</span></li></ul></li><li><span class="koboSpan" id="kobo.3.3">Another sentence.</span></li></ul><span class="koboSpan" id="kobo.3.4"> Another sentence.</span><p></p>`,
+			In:       `<p>“Hello," she said. "It's <em>nice</em>"—she paused—"isn't it?” “Ahem"(coughs)</p><p>"<em>Quoted</em>" and 'single <b>quoted</b>' in the '90s.</p><p>"Multiple</p><p>"paragraphs."</p>`,
+			Out:      `<p>“Hello,” she said. “It’s <em>nice</em>”—she paused—“isn’t it?” “Ahem”(coughs)</p><p>“<em>Quoted</em>” and ‘single <b>quoted</b>’ in the ’90s.</p><p>“Multiple</p><p>“paragraphs.”</p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "don't touch the contents of script, style, pre, audio, video tags",
+			Func:     transformContentPunctuation,
+			What:     "nested quotes, apostrophes, and quotes adjacent to tags",
 			Fragment: true,
-			In:       `<p>Touch this.</p><script>not this</script><style>or this</style><pre>or this</pre><audio>or this</audio><video>or this</video><p>Touch this.</p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">Touch this.</span></p><script>not this</script><style>or this</style><pre>or this</pre><audio>or this</audio><video>or this</video><p><span class="koboSpan" id="kobo.2.1">Touch this.</span></p>`,
+			In:       `<p>"She said 'don't go' to me," he said. Music from the '90s. <em>"Quoted"</em> and "<a href="x" title="'t' &quot;q&quot;">link</a>". He said, "'Hi.'"</p>`,
+			Out:      `<p>“She said ‘don’t go’ to me,” he said. Music from the ’90s. <em>“Quoted”</em> and “<a href="x" title="&#39;t&#39; &#34;q&#34;">link</a>”. He said, “‘Hi.’”</p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "treat an img as a new paragraph and add a span around it",
+			Func:     transformContentPunctuation,
+			What:     "convert dashes without changing the spacing around them",
 			Fragment: true,
-			In:       `<p>One.</p><img src="test"><p>Three.</p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">One.</span></p><span class="koboSpan" id="kobo.2.1"><img src="test"/></span><p><span class="koboSpan" id="kobo.3.1">Three.</span></p>`,
+			In:       `<p>A well--known and well---liked book.</p><p>A sentence -- with an aside -- and an end.</p><p>A sentence --- with an aside --- and an end.</p><p>A range 1--2, an interruption---</p>`,
+			Out:      `<p>A well–known and well—liked book.</p><p>A sentence – with an aside – and an end.</p><p>A sentence — with an aside — and an end.</p><p>A range 1–2, an interruption—</p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "don't increment paragraph counter if no spans were added",
+			Func: func(doc *html.Node) {
+				transformContentPunctuationWithOptions(doc, punctuationOptions{Language: "fr-CA"})
+			},
+			What:     "language-specific quotes",
 			Fragment: true,
-			In:       `<p>One.</p><p> </p><p><!-- comment --></p><p>Two.</p><p><b>Three.</b></p>`,
-			Out:      `<p><span class="koboSpan" id="kobo.1.1">One.</span></p><p><span class="koboSpan" id="kobo.2.1"> </span></p><p><!-- comment --></p><p><span class="koboSpan" id="kobo.3.1">Two.</span></p><p><b><span class="koboSpan" id="kobo.4.1">Three.</span></b></p>`,
+			In:       `<p>"C'est 'bien'," dit-il en '68.</p>`,
+			Out:      `<p>«C’est ‹bien›,» dit-il en ’68.</p>`,
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "don't add spans to svg and math elements",
+			Func:     transformContentPunctuation,
+			What:     "leave svg and math untouched",
 			Fragment: true,
-			In:       `<svg xmlns="http://www.w3.org/2000/svg"><g><text font-size="24" y="20" x="0">kepubify</text></g></svg><math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>=</mo><mfrac><mrow><mo>-</mo><mi>b</mi><mo>±</mo><msqrt><msup><mi>b</mi><mn>2</mn></msup><mo>-</mo><mn>4</mn><mi>a</mi><mi>c</mi></msqrt></mrow><mrow><mn>2</mn><mi>a</mi></mrow></mfrac></math>`,
-			Out:      `<svg xmlns="http://www.w3.org/2000/svg"><g><text font-size="24" y="20" x="0">kepubify</text></g></svg><math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>=</mo><mfrac><mrow><mo>-</mo><mi>b</mi><mo>±</mo><msqrt><msup><mi>b</mi><mn>2</mn></msup><mo>-</mo><mn>4</mn><mi>a</mi><mi>c</mi></msqrt></mrow><mrow><mn>2</mn><mi>a</mi></mrow></mfrac></math>`,
+			In:       `<p>"A" -- <svg xmlns="http://www.w3.org/2000/svg"><path d="M0 0--5 5"></path><text x="0" y="10">"B" -- C...</text></svg> <math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>--</mo><mi>y'</mi></math> "D"</p>`,
+			Out:      `<p>“A” – <svg xmlns="http://www.w3.org/2000/svg"><path d="M0 0--5 5"></path><text x="0" y="10">&#34;B&#34; -- C...</text></svg> <math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>--</mo><mi>y&#39;</mi></math> “D”</p>`,
 		}.Run(t)
 
-		// The following cases were found after using kobotest on a bunch of files (the previous cases are also based on kepubs, but I did them manually and didn't keep track):
-
 		transformContentCase{
-			Func:     transformContentKoboSpans,
-			What:     "also increment paragraph counter on heading tags and don't split sentences after colons or if there isn't any spaces after a period", // 69b8ba8c-1799-4e0d-ba3a-ce366410335e (Janurary 2020): Arthur Conan Doyle - The Complete Sherlock Holmes.kepub/OEBPS/bookwire/bookwire_advertisement1.xhtml
+			Func:     transformContentPunctuation,
+			What:     "ellipses",
 			Fragment: true,
-			In:       `<div class="img_container"><p class="ad_image"><img src="bookwire_ad_cover1.jpg" alt="image"/></p></div>` + "\n" + `    <h2 class="subheadline">The Christmas Collection: All Of Your Favourite Classic Christmas Stories, Novels, Poems, Carols in One Ebook</h2>` + "\n" + `    <p class="subheadline2"></p>` + "\n" + `    <p class="metadata">Carr, Annie Roe</p>`,
-			Out:      `<div class="img_container"><p class="ad_image"><span class="koboSpan" id="kobo.1.1"><img src="bookwire_ad_cover1.jpg" alt="image"/></span></p></div>` + "\n" + `    <h2 class="subheadline"><span class="koboSpan" id="kobo.2.1">The Christmas Collection: All Of Your Favourite Classic Christmas Stories, Novels, Poems, Carols in One Ebook</span></h2>` + "\n" + `    <p class="subheadline2"></p>` + "\n" + `    <p class="metadata"><span class="koboSpan" id="kobo.3.1">Carr, Annie Roe</span></p>`,
+			In:       `<p>Wait... what? And then . . . nothing.</p><pre>for i in 1...3</pre><p>Run <code>go test ./...</code>.</p>`,
+			Out:      `<p>Wait… what? And then … nothing.</p><pre>for i in 1...3</pre><p>Run <code>go test ./...</code>.</p>`,
 		}.Run(t)
-	})
 
-	t.Run("AddStyle", func(t *testing.T) {
 		transformContentCase{
-			Func:     func(doc *html.Node) { transformContentAddStyle(doc, "kepubify-test", "div > div { color: black; }") },
-			What:     "add style to head",
-			Fragment: false,
-			In:       `<!DOCTYPE html><html><head><title>Kepubify Test</title></head><body></body></html>`,
-			Out:      `<!DOCTYPE html><html><head><title>Kepubify Test</title><style type="text/css" class="kepubify-test">div > div { color: black; }</style></head><body></body></html>`,
+			Func: func(doc *html.Node) {
+				transformContentPunctuationWithOptions(doc, punctuationOptions{NoSpacedEllipses: true})
+			},
+			What:     "ellipses without spaced ellipses",
+			Fragment: true,
+			In:       `<p>Wait... what? And then . . . nothing -- really.</p>`,
+			Out:      `<p>Wait… what? And then . . . nothing – really.</p>`,
 		}.Run(t)
-	})
 
-	t.Run("SmartyPants", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentPunctuation,
-			What:     "smart punctuation",
+			Func: func(doc *html.Node) {
+				transformContentPunctuationWithOptions(doc, punctuationOptions{NoEllipses: true})
+			},
+			What:     "no ellipses",
 			Fragment: true,
-			In:       `<p>This is a test sentence to test smartypants' conversion of "quotation marks", dashes like - / -- / ---, and symbols like (c).</p>`,
-			Out:      `<p>This is a test sentence to test smartypants’ conversion of “quotation marks”, dashes like - / – / —, and symbols like ©.</p>`,
+			In:       `<p>Wait... what? And then . . . nothing -- "really."</p>`,
+			Out:      `<p>Wait... what? And then . . . nothing – “really.”</p>`,
 		}.Run(t)
 
 		transformContentCase{
 			Func:     transformContentPunctuation,
-			What:     "skip pre, code, style, and script elements",
+			What:     "convert runs of dashes",
 			Fragment: true,
-			In:       `<p>This is a test sentence to test smartypants' conversion of <code>"quotation marks"</code>, dashes like <pre>- / -- / ---</pre>, and symbols like (c).</p><style>div{font-family:"Test"}</style><script>var a="test"</script>`,
-			Out:      `<p>This is a test sentence to test smartypants’ conversion of <code>&#34;quotation marks&#34;</code>, dashes like </p><pre>- / -- / ---</pre>, and symbols like ©.<p></p><style>div{font-family:"Test"}</style><script>var a="test"</script>`,
+			In:       `<p>a--b a---b a----b a-----b a------b</p><p>----</p>`,
+			Out:      `<p>a–b a—b a——b a——b a———b</p><p>——</p>`,
 		}.Run(t)
 
 		transformContentCase{
@@ -361,6 +1615,24 @@ func TestTransformContentParts(t *testing.T) {
 		}.Run(t)
 	})
 
+	t.Run("RemoveEmpty", func(t *testing.T) {
+		transformContentCase{
+			Func:     transformContentRemoveEmpty,
+			What:     "remove truly empty divs and spans",
+			Fragment: true,
+			In:       `<div></div><p>One<span></span>.</p><div><div><span></span></div></div><p>Two.</p>`,
+			Out:      `<p>One.</p><p>Two.</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentRemoveEmpty,
+			What:     "keep elements with attributes, whitespace, or comments",
+			Fragment: true,
+			In:       `<div class="spacer"></div><p>One<span> </span>two.</p><div><!-- comment --></div><span class="koboSpan" id="kobo.1.1"></span><p></p>`,
+			Out:      `<div class="spacer"></div><p>One<span> </span>two.</p><div><!-- comment --></div><span class="koboSpan" id="kobo.1.1"></span><p></p>`,
+		}.Run(t)
+	})
+
 	t.Run("Replacements", func(t *testing.T) {
 		const corpus = `<!DOCTYPE html><html><head><title></title></head><body><b>Lorem ipsum</b> dolor sit amet, <a href="https://example.com">consectetur adipiscing elit</a>, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat. Duis aute irure dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur. Excepteur sint occaecat cupidatat non proident, sunt in culpa qui officia deserunt mollit anim id est laborum.</body></html>`
 		for _, tc := range []struct {
@@ -575,6 +1847,77 @@ func TestTransformOPFParts(t *testing.T) {
     <spine toc="ncx">
         <itemref idref="xhtml_text1"/>
     </spine>
+</package>`,
+		}.Run(t)
+
+		transformXMLTestCase{
+			Func: transformOPFCoverImage,
+			What: "leave existing cover-image property on another item",
+			In: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <meta name="cover" content="cover"/>
+    </metadata>
+    <manifest>
+        <item id="cover" href="cover.jpg" media-type="image/jpeg"/>
+        <item id="cover3" href="cover3.jpg" media-type="image/jpeg" properties="cover-image"/>
+    </manifest>
+</package>`,
+			Out: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <meta name="cover" content="cover"/>
+    </metadata>
+    <manifest>
+        <item id="cover" href="cover.jpg" media-type="image/jpeg"/>
+        <item id="cover3" href="cover3.jpg" media-type="image/jpeg" properties="cover-image"/>
+    </manifest>
+</package>`,
+		}.Run(t)
+
+		transformXMLTestCase{
+			Func: transformOPFCoverImage,
+			What: "meta[name=cover] references a missing item",
+			In: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <meta name="cover" content="missing"/>
+    </metadata>
+    <manifest>
+        <item id="cover-image" href="cover.jpg" media-type="image/jpeg"/>
+    </manifest>
+</package>`,
+			Out: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <meta name="cover" content="missing"/>
+    </metadata>
+    <manifest>
+        <item id="cover-image" href="cover.jpg" media-type="image/jpeg"/>
+    </manifest>
+</package>`,
+		}.Run(t)
+
+		transformXMLTestCase{
+			Func: transformOPFCoverImage,
+			What: "append to existing properties",
+			In: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <meta name="cover" content="cover"/>
+    </metadata>
+    <manifest>
+        <item id="cover" href="cover.svg" media-type="image/svg+xml" properties="svg"/>
+    </manifest>
+</package>`,
+			Out: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <meta name="cover" content="cover"/>
+    </metadata>
+    <manifest>
+        <item id="cover" href="cover.svg" media-type="image/svg+xml" properties="svg cover-image"/>
+    </manifest>
 </package>`,
 		}.Run(t)
 	})
@@ -604,6 +1947,357 @@ func TestTransformOPFParts(t *testing.T) {
 </package>`,
 		}.Run(t)
 	})
+
+	t.Run("Series", func(t *testing.T) {
+		series := func(doc *etree.Document) {
+			transformOPFSeries(doc)
+			doc.Indent(4)
+		}
+
+		transformXMLTestCase{
+			Func: series,
+			What: "add belongs-to-collection from calibre:series",
+			In: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <dc:title>Title</dc:title>
+        <meta name="calibre:series" content="Some Series"/>
+        <meta name="calibre:series_index" content="2.5"/>
+    </metadata>
+</package>`,
+			Out: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <dc:title>Title</dc:title>
+        <meta name="calibre:series" content="Some Series"/>
+        <meta name="calibre:series_index" content="2.5"/>
+        <meta property="belongs-to-collection" id="kepubify-series">Some Series</meta>
+        <meta refines="#kepubify-series" property="collection-type">series</meta>
+        <meta refines="#kepubify-series" property="group-position">2.5</meta>
+    </metadata>
+</package>`,
+		}.Run(t)
+
+		for _, c := range []struct {
+			What     string
+			Package  string
+			Metadata string
+		}{
+			{"no series", `version="3.0"`, `<dc:title>Title</dc:title>`},
+			{"existing collection", `version="3.0"`, `<meta name="calibre:series" content="Some Series"/><meta property="belongs-to-collection">Other</meta>`},
+			{"epub2", `version="2.0"`, `<meta name="calibre:series" content="Some Series"/>`},
+		} {
+			opf := `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" ` + c.Package + `>
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        ` + c.Metadata + `
+    </metadata>
+</package>`
+			transformXMLTestCase{
+				Func: transformOPFSeries,
+				What: "no-op for " + c.What,
+				In:   opf,
+				Out:  opf,
+			}.Run(t)
+		}
+	})
+
+	t.Run("BlockMediaTypes", func(t *testing.T) {
+		c := &Converter{blockMediaTypes: []string{"audio/*", "video/mp4"}}
+		transformXMLTestCase{
+			Func: func(doc *etree.Document) { transformOPFBlockMediaTypes(doc, c.isBlockedMediaType) },
+			What: "remove blocked manifest items and spine items",
+			In: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <manifest>
+        <item id="xhtml_text1" href="xhtml/text1.xhtml" media-type="application/xhtml+xml"/>
+        <!-- --><item id="audio1" href="audio/track1.mp3" media-type="audio/mpeg"/>
+        <!-- --><item id="video1" href="video/clip1.mp4" media-type="Video/MP4; codecs=avc1"/>
+        <item id="video2" href="video/clip2.webm" media-type="video/webm"/>
+        <!-- --><item id="audio2" href="audio/track2.xhtml" media-type="audio/ogg"/>
+    </manifest>
+    <spine>
+        <itemref idref="xhtml_text1"/>
+        <!-- --><itemref idref="audio2"/>
+    </spine>
+</package>`,
+			Out: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <manifest>
+        <item id="xhtml_text1" href="xhtml/text1.xhtml" media-type="application/xhtml+xml"/>
+        <!-- -->
+        <!-- -->
+        <item id="video2" href="video/clip2.webm" media-type="video/webm"/>
+        <!-- -->
+    </manifest>
+    <spine>
+        <itemref idref="xhtml_text1"/>
+        <!-- -->
+    </spine>
+</package>`,
+		}.Run(t)
+	})
+}
+
+func TestTransformCSS(t *testing.T) {
+	epub := fstest.MapFS{
+		"OEBPS/css/main.css":        {Data: []byte(`@import url("https://example.com/remote.css");` + "\n" + `@import "base.css";` + "\n" + `@import url('../fonts/fonts.css') screen;` + "\n" + `@import "missing.css";` + "\n" + `/* @import "commented.css"; */` + "\n" + `p { margin: 0 }`)},
+		"OEBPS/css/base.css":        {Data: []byte(`@import "main.css"; body { color: black }`)},
+		"OEBPS/fonts/fonts.css":     {Data: []byte(`@font-face { src: url(font.otf), url("//example.com/font.otf") }`)},
+		"OEBPS/fonts/unrelated.css": {Data: []byte(`@import "unused.css";`)},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := transformCSS(buf, bytes.NewReader(epub["OEBPS/css/main.css"].Data), epub, "OEBPS/css/main.css"); err != nil {
+		t.Fatalf("transform: unexpected error: %v", err)
+	}
+	if exp := "\n\n\n" + `@import "missing.css";` + "\n" + ` body { color: black }` + "\n" + `@media screen {` + "\n" + `@font-face { src: url("../fonts/font.otf"), url("//example.com/font.otf") }` + "\n" + `}` + "\n" + `/* @import "commented.css"; */` + "\n" + `p { margin: 0 }`; buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+}
+
+func TestTransformNCX(t *testing.T) {
+	transformXMLTestCase{
+		Func: func(doc *etree.Document) {
+			transformNCXRemoveTargets(doc, func(src string) bool {
+				return src == "text/part2.xhtml"
+			})
+			doc.Indent(4)
+		},
+		What: "remove targets pointing to removed files and renumber play order",
+		In: `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+    <navMap>
+        <navPoint id="np1" playOrder="1">
+            <navLabel>
+                <text>Chapter 1</text>
+            </navLabel>
+            <content src="text/ch1.xhtml"/>
+        </navPoint>
+        <navPoint id="np2" playOrder="2">
+            <navLabel>
+                <text>Part 2</text>
+            </navLabel>
+            <content src="text/part2.xhtml#start"/>
+            <navPoint id="np3" playOrder="3">
+                <navLabel>
+                    <text>Chapter 2</text>
+                </navLabel>
+                <content src="text/ch2.xhtml"/>
+            </navPoint>
+        </navPoint>
+        <navPoint id="np4" playOrder="4">
+            <navLabel>
+                <text>Chapter 3</text>
+            </navLabel>
+            <content src="text/ch3.xhtml"/>
+        </navPoint>
+    </navMap>
+    <pageList>
+        <pageTarget id="p1" type="normal" value="1" playOrder="1">
+            <navLabel>
+                <text>1</text>
+            </navLabel>
+            <content src="text/ch1.xhtml#p1"/>
+        </pageTarget>
+        <pageTarget id="p2" type="normal" value="2" playOrder="2">
+            <navLabel>
+                <text>2</text>
+            </navLabel>
+            <content src="text/part2.xhtml#p2"/>
+        </pageTarget>
+        <pageTarget id="p3" type="normal" value="3" playOrder="4">
+            <navLabel>
+                <text>3</text>
+            </navLabel>
+            <content src="text/ch3.xhtml#p3"/>
+        </pageTarget>
+    </pageList>
+</ncx>`,
+		Out: `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+    <navMap>
+        <navPoint id="np1" playOrder="1">
+            <navLabel>
+                <text>Chapter 1</text>
+            </navLabel>
+            <content src="text/ch1.xhtml"/>
+        </navPoint>
+        <navPoint id="np3" playOrder="2">
+            <navLabel>
+                <text>Chapter 2</text>
+            </navLabel>
+            <content src="text/ch2.xhtml"/>
+        </navPoint>
+        <navPoint id="np4" playOrder="3">
+            <navLabel>
+                <text>Chapter 3</text>
+            </navLabel>
+            <content src="text/ch3.xhtml"/>
+        </navPoint>
+    </navMap>
+    <pageList>
+        <pageTarget id="p1" type="normal" value="1" playOrder="1">
+            <navLabel>
+                <text>1</text>
+            </navLabel>
+            <content src="text/ch1.xhtml#p1"/>
+        </pageTarget>
+        <pageTarget id="p3" type="normal" value="3" playOrder="3">
+            <navLabel>
+                <text>3</text>
+            </navLabel>
+            <content src="text/ch3.xhtml#p3"/>
+        </pageTarget>
+    </pageList>
+</ncx>`,
+	}.Run(t)
+}
+
+func TestGenerateNav(t *testing.T) {
+	const ncx = `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+    <docTitle>
+        <text> Test   Book </text>
+    </docTitle>
+    <navMap>
+        <navPoint id="np1" playOrder="1">
+            <navLabel>
+                <text>Chapter 1</text>
+            </navLabel>
+            <content src="text/ch1.xhtml"/>
+        </navPoint>
+        <navPoint id="np2" playOrder="2">
+            <navLabel>
+                <text>Part &amp; 2</text>
+            </navLabel>
+            <content src="text/part2.xhtml#start"/>
+            <navPoint id="np3" playOrder="3">
+                <navLabel>
+                    <text>Chapter 2</text>
+                </navLabel>
+                <content src="text/ch2.xhtml"/>
+            </navPoint>
+        </navPoint>
+    </navMap>
+    <pageList>
+        <pageTarget id="p1" type="normal" value="1" playOrder="1">
+            <navLabel>
+                <text>1</text>
+            </navLabel>
+            <content src="text/ch1.xhtml#p1"/>
+        </pageTarget>
+    </pageList>
+</ncx>`
+
+	buf := bytes.NewBuffer(nil)
+	if err := generateNav(buf, strings.NewReader(ncx), func(src string) string {
+		if strings.HasPrefix(src, "text/part2.xhtml") {
+			return ""
+		}
+		return "../" + src
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if exp := `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+    <head>
+        <title>Test Book</title>
+    </head>
+    <body>
+        <nav epub:type="toc" id="toc">
+            <h1>Test Book</h1>
+            <ol>
+                <li>
+                    <a href="../text/ch1.xhtml">Chapter 1</a>
+                </li>
+                <li>
+                    <span>Part &amp; 2</span>
+                    <ol>
+                        <li>
+                            <a href="../text/ch2.xhtml">Chapter 2</a>
+                        </li>
+                    </ol>
+                </li>
+            </ol>
+        </nav>
+        <nav epub:type="page-list" hidden="hidden">
+            <ol>
+                <li>
+                    <a href="../text/ch1.xhtml#p1">1</a>
+                </li>
+            </ol>
+        </nav>
+    </body>
+</html>
+`; buf.String() != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, buf)
+	}
+}
+
+func TestTransformNav(t *testing.T) {
+	pages := []pageListEntry{{"text/ch01.xhtml#p1", "1"}, {"text/ch01.xhtml#p2", "ii"}}
+
+	transformContentCase{
+		Func: func(doc *html.Node) {
+			transformNavPageList(doc, pages)
+		},
+		What:     "add page list",
+		Fragment: true,
+		In:       `<nav epub:type="toc"><ol><li><a href="text/ch01.xhtml">Chapter 1</a></li></ol></nav>`,
+		Out:      `<nav epub:type="toc"><ol><li><a href="text/ch01.xhtml">Chapter 1</a></li></ol></nav><nav epub:type="page-list" hidden="hidden"><ol><li><a href="text/ch01.xhtml#p1">1</a></li><li><a href="text/ch01.xhtml#p2">ii</a></li></ol></nav>`,
+	}.Run(t)
+
+	transformContentCase{
+		Func: func(doc *html.Node) {
+			transformNavPageList(doc, pages)
+		},
+		What:     "don't replace existing page list",
+		Fragment: true,
+		In:       `<nav epub:type="toc"></nav><section><nav epub:type="page-list"><ol><li><a href="text/ch01.xhtml#x">x</a></li></ol></nav></section>`,
+		Out:      `<nav epub:type="toc"></nav><section><nav epub:type="page-list"><ol><li><a href="text/ch01.xhtml#x">x</a></li></ol></nav></section>`,
+	}.Run(t)
+
+	doc, err := html.Parse(strings.NewReader(`<p>One.<span epub:type="pagebreak" id="p1" title=" 1 "></span></p><hr role="doc-pagebreak" id="p2" aria-label="ii"/><p><span epub:type="pagebreak" id="p3"> <b>3</b> </span><span epub:type="pagebreak" id="p4"></span><span epub:type="pagebreak" title="5"></span><span epub:type="noteref pagebreak" id="p6">6</span></p>`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if act, exp := contentPageBreaks(doc), []pageListEntry{{"#p1", "1"}, {"#p2", "ii"}, {"#p3", "3"}, {"#p6", "6"}}; !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected page breaks %v, got %v", exp, act)
+	}
+
+	for _, c := range [][3]string{
+		{"OEBPS", "OEBPS/text/ch01.xhtml", "text/ch01.xhtml"},
+		{"OEBPS/nav", "OEBPS/text/ch01.xhtml", "../text/ch01.xhtml"},
+		{".", "OEBPS/ch01.xhtml", "OEBPS/ch01.xhtml"},
+		{"OEBPS/a/b", "ch01.xhtml", "../../../ch01.xhtml"},
+	} {
+		if act := relativePath(c[0], c[1]); act != c[2] {
+			t.Errorf("relative path of %q from %q: expected %q, got %q", c[1], c[0], c[2], act)
+		}
+	}
+}
+
+func TestWalkText(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<!DOCTYPE html><html><head><title>Title</title><style>p { color: red; }</style><script>var x = "script";</script></head><body><h1>Head<em>ing</em></h1><p>One <b>two</b>.</p><pre>not
+this</pre><p>Three<br/>four</p><script>nor "this"</script><!-- or this --></body></html>`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var texts []string
+	walkText(findAtom(doc, atom.Body), func(text string) {
+		texts = append(texts, text)
+	})
+	if exp := []string{"\n", "Head", "ing", "\n", "\n", "One ", "two", ".", "\n", "\n", "Three", "\n", "\n", "four", "\n"}; !reflect.DeepEqual(texts, exp) {
+		t.Errorf("expected %q, got %q", exp, texts)
+	}
+
+	if act, exp := strings.Fields(textContent(doc)), []string{"Title", "Heading", "One", "two.", "Three", "four"}; !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected text content %q, got %q", exp, act)
+	}
 }
 
 func TestTransformFileFilter(t *testing.T) {
@@ -1203,6 +2897,9 @@ var testSentences = []string{
 	"test\u00a0.\u0080.\u00a0.",
 	"",
 	"🌝. 🌝      🌝.    🌝",
+	"यह एक वाक्य है। यह दूसरा वाक्य है॥ और यह तीसरा।",
+	"吾輩は猫である。名前はまだ無い。「どこで生れたか、とんと見当がつかぬ。」何でも薄暗いじめじめした所で泣いていた事だけは記憶している！？ 吾輩はここで始めて人間というものを見た",
+	"他说：“你好。”然后走了。。。 Then. 。？ !。\xFF、、」a。. b",
 	"!",
 	"? ",
 	"? ?",
@@ -1221,6 +2918,76 @@ var testSentences = []string{
 	" ?'  .   .'\xe2\x82\x28\xFF.",
 }
 
+func TestSplitSentencesNumbers(t *testing.T) {
+	// colons aren't sentence terminators, and periods are only terminators if
+	// followed by whitespace, so numbers shouldn't ever be split
+	for _, tc := range []struct {
+		In  string
+		Out []string
+	}{
+		{"The meeting is at 10:30. It ends at 11:45:30.", []string{"The meeting is at 10:30. ", "It ends at 11:45:30."}},
+		{"Mix it in a 2:1 ratio. Then 3:2:1.", []string{"Mix it in a 2:1 ratio. ", "Then 3:2:1."}},
+		{"See 1 Cor 13:4-7 and John 3:16. Done.", []string{"See 1 Cor 13:4-7 and John 3:16. ", "Done."}},
+		{"Note: this is one sentence.", []string{"Note: this is one sentence."}},
+		{"It costs 3.50 dollars. Version 1.2.3 works.", []string{"It costs 3.50 dollars. ", "Version 1.2.3 works."}},
+	} {
+		if ss := splitSentences(tc.In, nil); !reflect.DeepEqual(ss, tc.Out) {
+			t.Errorf("%q: expected %q, got %q", tc.In, tc.Out, ss)
+		}
+	}
+}
+
+func TestSplitSentencesCJK(t *testing.T) {
+	for _, tc := range []struct {
+		In  string
+		Out []string
+	}{
+		{"吾輩は猫である。名前はまだ無い。", []string{"吾輩は猫である。", "名前はまだ無い。"}},
+		{"「どこで生れたか、とんと見当がつかぬ。」何でも薄暗い所で泣いていた！？ 記憶している", []string{"「どこで生れたか、", "とんと見当がつかぬ。」", "何でも薄暗い所で泣いていた！？ ", "記憶している"}},
+		{"你好吗？我很好。", []string{"你好吗？", "我很好。"}},
+	} {
+		if ss := splitSentences(tc.In, nil); !reflect.DeepEqual(ss, tc.Out) {
+			t.Errorf("%q: expected %q, got %q", tc.In, tc.Out, ss)
+		}
+	}
+}
+
+func TestSplitSentencesDanda(t *testing.T) {
+	for _, tc := range []struct {
+		In  string
+		Out []string
+	}{
+		{"यह एक वाक्य है। यह दूसरा वाक्य है॥ और यह तीसरा।", []string{"यह एक वाक्य है। ", "यह दूसरा वाक्य है॥ ", "और यह तीसरा।"}},
+		{"धर्मक्षेत्रे कुरुक्षेत्रे समवेता युयुत्सवः। मामकाः पाण्डवाश्चैव किमकुर्वत सञ्जय॥१॥", []string{"धर्मक्षेत्रे कुरुक्षेत्रे समवेता युयुत्सवः। ", "मामकाः पाण्डवाश्चैव किमकुर्वत सञ्जय॥१॥"}},
+	} {
+		if ss := splitSentences(tc.In, nil); !reflect.DeepEqual(ss, tc.Out) {
+			t.Errorf("%q: expected %q, got %q", tc.In, tc.Out, ss)
+		}
+	}
+}
+
+func TestSplitSentencesAbbreviations(t *testing.T) {
+	for _, tc := range []struct {
+		In  string
+		Out []string
+	}{
+		{"Mr. Smith and Mrs. Smith. Done.", []string{"Mr. Smith and Mrs. Smith. ", "Done."}},
+		{"Ask DR. Jones. Done.", []string{"Ask DR. Jones. ", "Done."}},
+		{"Cats vs. dogs. Apples, pears, etc. and more.", []string{"Cats vs. dogs. ", "Apples, pears, etc. and more."}},
+		{"Fruit, e.g. apples. Fruit, i.e.  pears.", []string{"Fruit, e.g. apples. ", "Fruit, i.e.  pears."}},
+		{"Pi is 3.14 or so. Then 2.5.", []string{"Pi is 3.14 or so. ", "Then 2.5."}},
+		{"I saw Dr.  ", []string{"I saw Dr.  "}},
+		{"Call the Medr. Now.", []string{"Call the Medr. ", "Now."}},
+	} {
+		if ss := mergeAbbreviations(tc.In, splitSentences(tc.In, nil), defaultAbbreviations); !reflect.DeepEqual(ss, tc.Out) {
+			t.Errorf("%q: expected %q, got %q", tc.In, tc.Out, ss)
+		}
+		if ss := mergeAbbreviations(tc.In, splitSentences(tc.In, nil), nil); strings.Join(ss, "") != tc.In {
+			t.Errorf("%q: expected sentences to be unchanged without abbreviations, got %q", tc.In, ss)
+		}
+	}
+}
+
 func TestSplitSentences(t *testing.T) {
 	for _, v := range testSentences {
 		sss := splitSentences(v, nil)
@@ -1261,7 +3028,31 @@ func BenchmarkSplitSentences(b *testing.B) {
 	})
 }
 
-var sentenceRe = regexp.MustCompile(`((?ms).*?[\.\!\?]['"”’“…]?\s+)`)
+func BenchmarkTransformContentKoboSpans(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title></title></head><body>`)
+	for i := 0; buf.Len() < 2<<20; i++ {
+		fmt.Fprintf(&buf, "<h2>Section %d</h2>\n", i)
+		for _, v := range testSentences {
+			fmt.Fprintf(&buf, "<p>%s <em>%s</em> %s</p>\n", html.EscapeString(v), html.EscapeString(v), html.EscapeString(v))
+		}
+	}
+	buf.WriteString(`</body></html>`)
+
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		doc, err := html.Parse(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			panic(err)
+		}
+		b.StartTimer()
+		transformContentKoboSpans(doc)
+	}
+}
+
+var sentenceRe = regexp.MustCompile(`((?ms).*?(?:[\.\!\?।॥]['"”’“…]?\s+|[。！？、][。！？、'"”’“…」』）〕】〉》]*\s*))`)
 
 func splitSentencesRegexp(str string) (r []string) {
 	if matches := sentenceRe.FindAllStringIndex(str, -1); len(matches) == 0 {